@@ -0,0 +1,61 @@
+package tagger
+
+// RenameTag returns a copy of a tag with the given name, keeping it's value
+func RenameTag(t Tag, name string) Tag {
+	switch t.Kind() {
+	case IntKind:
+		return NewValueTag(name, t.Value())
+	case StringKind:
+		return NewStringTag(name, t.StringValue())
+	case FloatKind:
+		return NewFloatTag(name, t.FloatValue())
+	case DateKind:
+		return NewDateTag(name, t.DateValue())
+	case BoolKind:
+		return NewBoolTag(name, t.BoolValue())
+	}
+	return NewNamedTag(name)
+}
+
+// ResolveAlias returns the tag name an alias refers to, or the name itself
+// if it isn't an alias
+func ResolveAlias(aliases map[string]string, name string) string {
+	if canonical, ok := aliases[name]; ok {
+		return canonical
+	}
+	return name
+}
+
+// RewriteAliases returns a copy of a filter where every tag name that is an
+// alias is replaced by the tag name it refers to. Filters of unknown types
+// are left as is.
+func RewriteAliases(f Filter, aliases map[string]string) Filter {
+	switch f := f.(type) {
+	case NameFilter:
+		f.Name = ResolveAlias(aliases, f.Name)
+		return f
+
+	case ComparinsonFilter:
+		f.Name = ResolveAlias(aliases, f.Name)
+		return f
+
+	case AndFilter:
+		return AndFilter{Filters: rewriteAliases(f.Filters, aliases)}
+
+	case OrFilter:
+		return OrFilter{Filters: rewriteAliases(f.Filters, aliases)}
+
+	case NotFilter:
+		return NotFilter{Filter: RewriteAliases(f.Filter, aliases)}
+	}
+
+	return f
+}
+
+func rewriteAliases(filters []Filter, aliases map[string]string) []Filter {
+	rewritten := make([]Filter, 0, len(filters))
+	for _, filter := range filters {
+		rewritten = append(rewritten, RewriteAliases(filter, aliases))
+	}
+	return rewritten
+}
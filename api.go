@@ -2,8 +2,13 @@ package tagger
 
 import (
 	"code.google.com/p/go-uuid/uuid"
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"regexp"
+	"strconv"
+	"time"
 )
 
 type (
@@ -11,43 +16,237 @@ type (
 	StorageProvider interface {
 		io.Closer
 
+		// Begin starts a transaction. Every method of the returned
+		// transactional view is part of the transaction. Closing the view
+		// rolls back the transaction unless it has been committed.
+		Begin() (Tx, error)
+
+		// WithContext returns a view of the storage whose methods, including
+		// transactions begun through it, stop with the context's error once
+		// the context is cancelled. The view shares the resources of the
+		// storage, so closing it has no effect.
+		WithContext(ctx context.Context) StorageProvider
+
 		GetFile(u uuid.UUID) (File, error)
 		GetFileForPath(path string) (File, error)
+		// GetFileForHash returns a file with the given content hash sum.
+		// If several files have the same contents, the first by path is
+		// returned.
+		GetFileForHash(sum string) (File, error)
 		GetAllFiles() ([]File, error)
 		GetMatchingFiles(f Filter) ([]File, error)
 
+		// IterateAllFiles and IterateMatchingFiles are streaming versions
+		// of GetAllFiles and GetMatchingFiles, which return the files one
+		// at a time instead of loading them all into memory.
+		IterateAllFiles() (FileIterator, error)
+		IterateMatchingFiles(f Filter) (FileIterator, error)
+		// QueryFiles returns the files matching a filter in the order and
+		// range given by the options. A nil filter matches every file.
+		QueryFiles(f Filter, opts QueryOptions) (FileIterator, error)
+
+		// UpdateTag sets a tag on a file, replacing all existing values of
+		// the tag, and returns ErrNoFile if the file isn't stored. RemoveTag
+		// removes the tag and all of it's values.
 		UpdateTag(f File, t Tag) error
 		RemoveTag(f File, t Tag) error
 		GetTags(f File) ([]Tag, error)
-		// GetAllTags() ([]Tag, error) // TODO: Reconsider this method. Maybe split into two? (tags, values)
 
+		// AddTagValue adds a value to a tag on a file, keeping any existing
+		// values, and returns ErrNoFile if the file isn't stored.
+		// RemoveTagValue removes a single value from a tag.
+		// GetTagValues returns every value of the named tag on a file, or
+		// ErrNoTag if the file doesn't have the tag.
+		AddTagValue(f File, t Tag) error
+		RemoveTagValue(f File, t Tag) error
+		GetTagValues(f File, name string) ([]Tag, error)
+
+		// GetChildTags returns the names of the direct children of a tag in
+		// the tag hierarchy, or the top level tags if parent is empty.
+		GetChildTags(parent string) ([]string, error)
+
+		// AddAlias makes alias an alternative name for the named tag. Tags
+		// written under an alias are stored under the tag name, and filters
+		// on an alias match the tag name.
+		AddAlias(alias, name string) error
+		RemoveAlias(alias string) error
+		// GetAliases returns all aliases mapped to the tag names they
+		// refer to.
+		GetAliases() (map[string]string, error)
+
+		// AddRule stores a rule and returns it's ID. Rules are applied when
+		// tags are written to a file, but are only applied to existing
+		// files by ApplyRules. Implied tags are not removed again if the
+		// condition stops matching.
+		AddRule(r Rule) (int, error)
+		RemoveRule(id int) error
+		GetRules() ([]Rule, error)
+		ApplyRules() error
+		// GetAllTags returns usage statistics for every tag name in
+		// storage, sorted by name.
+		GetAllTags() ([]TagInfo, error)
+
+		// UpdateFile stores a file and sets the given tags on it, keeping
+		// the tags it already has. A file already stored with the same path
+		// is replaced, along with it's tags. RemoveFile removes a file and
+		// all of it's tags.
 		UpdateFile(f File, t []Tag) error
 		RemoveFile(f File) error
 	}
 
+	// FileIterator steps through the files returned by a query. Next must be
+	// called before the first file is read, and the iterator must be closed
+	// when done with it.
+	//
+	//	it, err := p.IterateAllFiles()
+	//	...
+	//	defer it.Close()
+	//	for it.Next() {
+	//		f := it.File()
+	//		...
+	//	}
+	//	if err := it.Err(); err != nil {
+	//		...
+	//	}
+	FileIterator interface {
+		io.Closer
+
+		// Next advances to the next file, and returns false when there are
+		// no more files or an error occured.
+		Next() bool
+		// File returns the current file
+		File() File
+		// Err returns the error that stopped the iteration, if any
+		Err() error
+	}
+
+	// Tx is a transactional view of a storage provider. Changes made through
+	// it are only visible to others once committed.
+	Tx interface {
+		StorageProvider
+		Commit() error
+		Rollback() error
+	}
+
 	// File is a structure that represents a file in the database
 	File struct {
 		uuid uuid.UUID
 		path string
+		hash ContentHash
+	}
+
+	// ContentHash identifies the contents of a file, so the file can be
+	// recognized after it has been moved or renamed
+	ContentHash struct {
+		// Sum is the hex encoded SHA-256 sum of the contents
+		Sum     string
+		Size    int64
+		ModTime time.Time
+	}
+
+	// QueryOptions control the order and range of the files returned by
+	// QueryFiles. The zero value returns every file ordered by path.
+	QueryOptions struct {
+		// SortTag is the name of the tag whose value files are ordered by,
+		// or empty to order files by path. Files with several values are
+		// ordered by their smallest value, or their largest if sorting in
+		// descending order. Values are ordered like the values in TagInfo,
+		// and files without a value come last. Ties are ordered by path.
+		SortTag string
+		// Descending reverses the order
+		Descending bool
+		// Limit is the largest number of files returned, or 0 for no limit
+		Limit int
+		// Offset is the number of files skipped before the first file
+		// returned
+		Offset int
+	}
+
+	// TagInfo describes how a tag name is used across all files
+	TagInfo struct {
+		Name string
+		// Files is the number of files with the tag
+		Files int
+		// Min and Max are tags holding the smallest and largest values of
+		// the tag, or nil if the tag never has a value. Values of different
+		// kinds are ordered by kind, with integers and floats ordered
+		// together.
+		Min, Max Tag
+		// Valueless is whether the tag is ever used without a value
+		Valueless bool
 	}
 
 	// Tag is an interface representing the needed methods on a tag
 	Tag interface {
 		Name() string
 		HasValue() bool
+		// Kind returns the type of the tag's value. Only the accessor
+		// matching the kind returns a meaningful value.
+		Kind() Kind
 		Value() int
+		StringValue() string
+		FloatValue() float64
+		DateValue() time.Time
+		BoolValue() bool
 	}
 
+	// Kind describes the type of the value of a tag
+	Kind int
+
 	// NamedTag is a tag with just a name
 	NamedTag struct {
+		noValue
 		name string
 	}
 
-	// ValueTag is a tag with both a name and a value
+	// ValueTag is a tag with both a name and an integer value
 	ValueTag struct {
+		noValue
 		name  string
 		value int
 	}
+
+	// StringTag is a tag with both a name and a string value
+	StringTag struct {
+		noValue
+		name  string
+		value string
+	}
+
+	// FloatTag is a tag with both a name and a floating point value
+	FloatTag struct {
+		noValue
+		name  string
+		value float64
+	}
+
+	// DateTag is a tag with both a name and a date value
+	DateTag struct {
+		noValue
+		name  string
+		value time.Time
+	}
+
+	// BoolTag is a tag with both a name and a boolean value
+	BoolTag struct {
+		noValue
+		name  string
+		value bool
+	}
+
+	// noValue provides the zero value accessors for tags of other kinds
+	noValue struct{}
+)
+
+// Definitions of the various kinds of tag values. The numeric values are
+// persisted by storage backends and must not be changed.
+const (
+	NoKind Kind = iota
+	IntKind
+	StringKind
+	FloatKind
+	DateKind
+	BoolKind
 )
 
 // NewFile creates a new file struct an populates it's fields
@@ -65,12 +264,98 @@ func NewValueTag(name string, value int) *ValueTag {
 	return &ValueTag{name: name, value: value}
 }
 
+// NewStringTag creates a new StringTag struct an populates it's fields
+func NewStringTag(name string, value string) *StringTag {
+	return &StringTag{name: name, value: value}
+}
+
+// NewFloatTag creates a new FloatTag struct an populates it's fields
+func NewFloatTag(name string, value float64) *FloatTag {
+	return &FloatTag{name: name, value: value}
+}
+
+// NewDateTag creates a new DateTag struct an populates it's fields
+func NewDateTag(name string, value time.Time) *DateTag {
+	return &DateTag{name: name, value: value}
+}
+
+// NewBoolTag creates a new BoolTag struct an populates it's fields
+func NewBoolTag(name string, value bool) *BoolTag {
+	return &BoolTag{name: name, value: value}
+}
+
+// NewTagFromString creates a tag from a textual value, picking the kind of
+// the tag from the format of the value. Integers, floats, dates in the
+// "2006-01-02" or RFC 3339 formats and the words true and false are
+// recognised, anything else is stored as a string. Only finite decimal
+// numbers are floats, so words like "nan" and "inf" are strings.
+func NewTagFromString(name string, value string) Tag {
+	if n, err := strconv.Atoi(value); err == nil {
+		return NewValueTag(name, n)
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil && decimalPattern.MatchString(value) {
+		return NewFloatTag(name, f)
+	}
+	if d, err := ParseDate(value); err == nil {
+		return NewDateTag(name, d)
+	}
+	if value == "true" || value == "false" {
+		return NewBoolTag(name, value == "true")
+	}
+	return NewStringTag(name, value)
+}
+
+// decimalPattern matches the decimal numbers NewTagFromString turns into
+// floats. ParseFloat also accepts hexadecimal numbers, infinity and NaN.
+var decimalPattern = regexp.MustCompile(`^[+-]?(?:[0-9]+\.?[0-9]*|\.[0-9]+)(?:[eE][+-]?[0-9]+)?$`)
+
+// ParseDate parses a date in either the "2006-01-02" or the RFC 3339 format
+func ParseDate(value string) (time.Time, error) {
+	if d, err := time.Parse("2006-01-02", value); err == nil {
+		return d, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// TagValue returns the value of a tag as an int, string, float64, time.Time
+// or bool depending on it's kind, or nil if the tag has no value
+func TagValue(t Tag) interface{} {
+	switch t.Kind() {
+	case IntKind:
+		return t.Value()
+	case StringKind:
+		return t.StringValue()
+	case FloatKind:
+		return t.FloatValue()
+	case DateKind:
+		return t.DateValue()
+	case BoolKind:
+		return t.BoolValue()
+	}
+	return nil
+}
+
 // UUID returns the UUID of a file
 func (f File) UUID() uuid.UUID { return f.uuid }
 
 // Path returns the path of a file
 func (f File) Path() string { return f.path }
 
+// Hash returns the content hash of a file, and false if it isn't known
+func (f File) Hash() (ContentHash, bool) { return f.hash, f.hash.Sum != "" }
+
+// WithPath returns a copy of a file with the given path
+func (f File) WithPath(path string) File {
+	f.path = path
+	return f
+}
+
+// WithHash returns a copy of a file with the given content hash
+func (f File) WithHash(h ContentHash) File {
+	f.hash = h
+	return f
+}
+
 // Name returns the name of a tag
 func (t NamedTag) Name() string { return t.name }
 
@@ -89,10 +374,98 @@ func (t NamedTag) Value() int { return -1 }
 // Value returns the value of a value tag
 func (t ValueTag) Value() int { return t.value }
 
+// Name returns the name of a tag
+func (t StringTag) Name() string { return t.name }
+
+// Name returns the name of a tag
+func (t FloatTag) Name() string { return t.name }
+
+// Name returns the name of a tag
+func (t DateTag) Name() string { return t.name }
+
+// Name returns the name of a tag
+func (t BoolTag) Name() string { return t.name }
+
+// HasValue returns whether the tag has a value
+func (t StringTag) HasValue() bool { return true }
+
+// HasValue returns whether the tag has a value
+func (t FloatTag) HasValue() bool { return true }
+
+// HasValue returns whether the tag has a value
+func (t DateTag) HasValue() bool { return true }
+
+// HasValue returns whether the tag has a value
+func (t BoolTag) HasValue() bool { return true }
+
+// Kind returns the kind of the tags value
+func (t NamedTag) Kind() Kind { return NoKind }
+
+// Kind returns the kind of the tags value
+func (t ValueTag) Kind() Kind { return IntKind }
+
+// Kind returns the kind of the tags value
+func (t StringTag) Kind() Kind { return StringKind }
+
+// Kind returns the kind of the tags value
+func (t FloatTag) Kind() Kind { return FloatKind }
+
+// Kind returns the kind of the tags value
+func (t DateTag) Kind() Kind { return DateKind }
+
+// Kind returns the kind of the tags value
+func (t BoolTag) Kind() Kind { return BoolKind }
+
+// StringValue returns the value of a string tag
+func (t StringTag) StringValue() string { return t.value }
+
+// FloatValue returns the value of a float tag
+func (t FloatTag) FloatValue() float64 { return t.value }
+
+// DateValue returns the value of a date tag
+func (t DateTag) DateValue() time.Time { return t.value }
+
+// BoolValue returns the value of a bool tag
+func (t BoolTag) BoolValue() bool { return t.value }
+
+// Value returns -1 on tags that aren't integer tags
+func (noValue) Value() int { return -1 }
+
+// StringValue returns "" on tags that aren't string tags
+func (noValue) StringValue() string { return "" }
+
+// FloatValue returns 0 on tags that aren't float tags
+func (noValue) FloatValue() float64 { return 0 }
+
+// DateValue returns the zero time on tags that aren't date tags
+func (noValue) DateValue() time.Time { return time.Time{} }
+
+// BoolValue returns false on tags that aren't bool tags
+func (noValue) BoolValue() bool { return false }
+
 // Errors
 var (
 	ErrNoFile       = errors.New("tagger: No such file in storage")
 	ErrNoTag        = errors.New("tagger: No such tag on file")
 	ErrNoMatches    = errors.New("tagger: No matching files in storage")
 	ErrInvalidValue = errors.New("tagger: Invalid tag value")
+	ErrAliasCycle   = errors.New("tagger: Alias refers to itself")
+	ErrRuleCycle    = errors.New("tagger: Rule implies itself")
+	ErrNoRule       = errors.New("tagger: No such rule in storage")
+	ErrNestedTx     = errors.New("tagger: Transactions can't be nested")
+)
+
+// Error categories. Errors returned by storage backends and the filter
+// parser wrap one of these, and can be checked with errors.Is.
+var (
+	// ErrStorageCorrupt means the storage contains data that can't be read
+	ErrStorageCorrupt = errors.New("tagger: Storage is corrupt")
+	// ErrSchemaMismatch means the layout of the storage isn't the one
+	// expected by this version of tagger
+	ErrSchemaMismatch = errors.New("tagger: Storage schema mismatch")
+	// ErrInvalidLiteral means a value in a filter or rule couldn't be
+	// converted to it's type, for instance an integer that overflows
+	ErrInvalidLiteral = errors.New("tagger: Invalid literal")
+
+	ErrSchemaTooNew = fmt.Errorf("%w: Storage was created by a newer version of tagger", ErrSchemaMismatch)
 )
@@ -0,0 +1,39 @@
+package tagger
+
+import (
+	"testing"
+)
+
+func TestNewTagFromString(t *testing.T) {
+	tests := []struct {
+		value string
+		kind  Kind
+	}{
+		{"42", IntKind},
+		{"-7", IntKind},
+		{"1.5", FloatKind},
+		{"-.5", FloatKind},
+		{"1e3", FloatKind},
+		{"2020-01-02", DateKind},
+		{"true", BoolKind},
+		{"hello", StringKind},
+		// Only finite decimal numbers are floats
+		{"nan", StringKind},
+		{"NaN", StringKind},
+		{"inf", StringKind},
+		{"-Inf", StringKind},
+		{"Infinity", StringKind},
+		{"0x1p-2", StringKind},
+		{"1e400", StringKind},
+	}
+
+	for _, test := range tests {
+		tag := NewTagFromString("n", test.value)
+		if tag.Kind() != test.kind {
+			t.Errorf("NewTagFromString(%q) returned a tag of kind %d, want %d", test.value, tag.Kind(), test.kind)
+		}
+		if tag.Kind() == StringKind && tag.StringValue() != test.value {
+			t.Errorf("NewTagFromString(%q) returned %q", test.value, tag.StringValue())
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package tagger
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ProblemKind is the type of an inconsistency found by Check
+type ProblemKind int
+
+const (
+	// MissingPath means the path of a file doesn't exist
+	MissingPath ProblemKind = iota
+	// PermissionDenied means the file at the path of a file can't be read
+	PermissionDenied
+	// DuplicatePath means several files refer to the same path, written in
+	// different ways
+	DuplicatePath
+	// InvalidUUID means a file is stored with an identifier that isn't a
+	// valid UUID
+	InvalidUUID
+	// OrphanedTags means tags are stored for a file that doesn't exist
+	OrphanedTags
+)
+
+// ErrNotRepairable is returned by Repair for problems it can't fix
+var ErrNotRepairable = errors.New("tagger: Problem can't be repaired")
+
+type (
+	// Problem describes an inconsistency between the storage and the
+	// filesystem, or within the storage itself
+	Problem struct {
+		Kind ProblemKind
+		// File is the file with the problem, if it can be read from storage
+		File File
+		// Other is the file a duplicate refers to the same path as
+		Other File
+		// ID is the identifier of the file as stored, for problems that keep
+		// the file from being read from storage
+		ID string
+		// Path is the path involved in the problem
+		Path string
+		// Err is the error reported by the filesystem, if any
+		Err error
+	}
+
+	// IntegrityChecker is implemented by storage providers that can find and
+	// repair problems in their data that can't be seen through the
+	// StorageProvider interface, such as invalid UUIDs and orphaned tags.
+	IntegrityChecker interface {
+		CheckIntegrity() ([]Problem, error)
+		RepairIntegrity(p Problem) error
+	}
+)
+
+func (p Problem) String() string {
+	switch p.Kind {
+	case MissingPath:
+		return fmt.Sprintf("%s: Path doesn't exist", p.Path)
+	case PermissionDenied:
+		return fmt.Sprintf("%s: %s", p.Path, p.Err)
+	case DuplicatePath:
+		return fmt.Sprintf("%s: Same path as %s", p.Path, p.Other.Path())
+	case InvalidUUID:
+		return fmt.Sprintf("%s: Invalid UUID %q", p.Path, p.ID)
+	case OrphanedTags:
+		return fmt.Sprintf("Tags of missing file %s", p.ID)
+	}
+	return fmt.Sprintf("Unknown problem with %s", p.Path)
+}
+
+// Check looks for files whose paths are missing or can't be read, and for
+// files that refer to the same path. If the storage is an IntegrityChecker,
+// the problems found by it are included.
+func Check(p StorageProvider) ([]Problem, error) {
+	problems := make([]Problem, 0)
+
+	checker, isChecker := p.(IntegrityChecker)
+	if isChecker {
+		found, err := checker.CheckIntegrity()
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, found...)
+	}
+
+	files, err := p.GetAllFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make(map[string]File)
+	for _, f := range files {
+		// Files with an invalid UUID are reported by the storage if it can
+		// repair them
+		if f.UUID() == nil {
+			if !isChecker {
+				problems = append(problems, Problem{Kind: InvalidUUID, File: f, Path: f.Path()})
+			}
+			continue
+		}
+
+		// Paths written differently, such as "a" and "./a", are the same
+		clean := filepath.Clean(f.Path())
+		if other, ok := paths[clean]; ok {
+			// The file with the path written the clean way is kept
+			if f.Path() == clean {
+				paths[clean] = f
+				f, other = other, f
+			}
+			problems = append(problems, Problem{Kind: DuplicatePath, File: f, Other: other, Path: f.Path()})
+			continue
+		}
+		paths[clean] = f
+
+		if problem, ok := checkPath(f); ok {
+			problems = append(problems, problem)
+		}
+	}
+
+	return problems, nil
+}
+
+// checkPath checks that the path of a file exists and can be read
+func checkPath(f File) (Problem, bool) {
+	file, err := os.Open(f.Path())
+	if os.IsPermission(err) {
+		return Problem{Kind: PermissionDenied, File: f, Path: f.Path(), Err: err}, true
+	} else if err != nil {
+		// Any other error means there is no file to read at the path
+		return Problem{Kind: MissingPath, File: f, Path: f.Path(), Err: err}, true
+	}
+	file.Close()
+
+	return Problem{}, false
+}
+
+// Repair fixes a problem found by Check. Files with missing paths are
+// removed, and duplicates are merged into the file they duplicate. Problems
+// found by an IntegrityChecker are repaired by it. ErrNotRepairable is
+// returned for other problems, such as paths that can't be read.
+func Repair(p StorageProvider, problem Problem) error {
+	switch problem.Kind {
+	case MissingPath:
+		return p.RemoveFile(problem.File)
+
+	case DuplicatePath:
+		tags, err := p.GetTags(problem.File)
+		if err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			err = p.AddTagValue(problem.Other, tag)
+			if err != nil {
+				return err
+			}
+		}
+		return p.RemoveFile(problem.File)
+
+	case InvalidUUID, OrphanedTags:
+		if checker, ok := p.(IntegrityChecker); ok && problem.ID != "" {
+			return checker.RepairIntegrity(problem)
+		}
+	}
+
+	return ErrNotRepairable
+}
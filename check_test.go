@@ -0,0 +1,100 @@
+package tagger_test
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/kiljacken/tagger"
+	"github.com/kiljacken/tagger/storage"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	a, locked := filepath.Join(dir, "a"), filepath.Join(dir, "locked")
+	for _, path := range []string{a, locked} {
+		if err := os.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	p := storage.NewMemoryStorage()
+	kept := tagger.NewFile(uuid.NewUUID(), a)
+	duplicate := tagger.NewFile(uuid.NewUUID(), dir+string(filepath.Separator)+"."+string(filepath.Separator)+"a")
+	missing := tagger.NewFile(uuid.NewUUID(), filepath.Join(dir, "missing"))
+	files := []struct {
+		file tagger.File
+		tags []tagger.Tag
+	}{
+		{kept, []tagger.Tag{tagger.NewNamedTag("photo"), tagger.NewValueTag("rating", 3)}},
+		{duplicate, []tagger.Tag{tagger.NewNamedTag("reviewed"), tagger.NewValueTag("rating", 5)}},
+		{missing, []tagger.Tag{}},
+		{tagger.NewFile(uuid.NewUUID(), locked), []tagger.Tag{}},
+	}
+	for _, f := range files {
+		if err := p.UpdateFile(f.file, f.tags); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	problems, err := tagger.Check(p)
+	if err != nil {
+		t.Fatalf("Check: %s", err)
+	}
+
+	// Root can read any file, so the permission problem only shows up for
+	// other users
+	denied := os.Geteuid() != 0
+	found := make(map[tagger.ProblemKind]tagger.Problem)
+	for _, problem := range problems {
+		found[problem.Kind] = problem
+	}
+	if len(problems) != len(found) {
+		t.Errorf("Check returned %v, want one problem of each kind", problems)
+	}
+	if problem, ok := found[tagger.MissingPath]; !ok || problem.Path != missing.Path() {
+		t.Errorf("Check didn't report %s as missing: %v", missing.Path(), problems)
+	}
+	if problem, ok := found[tagger.DuplicatePath]; !ok || problem.Path != duplicate.Path() || problem.Other.Path() != kept.Path() {
+		t.Errorf("Check didn't report %s as a duplicate of %s: %v", duplicate.Path(), kept.Path(), problems)
+	}
+	if problem, ok := found[tagger.PermissionDenied]; ok != denied || ok && problem.Path != locked {
+		t.Errorf("Check reported %s as unreadable: %t, want %t", locked, ok, denied)
+	}
+
+	for _, problem := range problems {
+		err := tagger.Repair(p, problem)
+		if problem.Kind == tagger.PermissionDenied {
+			if err != tagger.ErrNotRepairable {
+				t.Errorf("Repair(%s) returned %v, want ErrNotRepairable", problem, err)
+			}
+		} else if err != nil {
+			t.Errorf("Repair(%s): %s", problem, err)
+		}
+	}
+
+	// The missing file and the duplicate are removed, and the tags of the
+	// duplicate are merged into the file kept
+	for _, f := range []tagger.File{missing, duplicate} {
+		if _, err := p.GetFile(f.UUID()); err != tagger.ErrNoFile {
+			t.Errorf("GetFile(%s) returned %v, want ErrNoFile", f.Path(), err)
+		}
+	}
+	for name, want := range map[string]int{"photo": 1, "reviewed": 1, "rating": 2} {
+		values, err := p.GetTagValues(kept, name)
+		if err != nil || len(values) != want {
+			t.Errorf("GetTagValues(%s) returned %v, %v, want %d values", name, values, err, want)
+		}
+	}
+
+	problems, err = tagger.Check(p)
+	if err != nil {
+		t.Fatalf("Check: %s", err)
+	}
+	if len(problems) != len(found)-2 {
+		t.Errorf("Check after repairing returned %v", problems)
+	}
+}
@@ -1,14 +1,25 @@
 package main
 
 import (
+	"bufio"
 	"code.google.com/p/go-uuid/uuid"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/kiljacken/tagger"
+	"github.com/kiljacken/tagger/scanner"
 	"github.com/kiljacken/tagger/storage"
+	"github.com/kiljacken/tagger/watch"
+	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
 )
 
 const NAME = "tagger-cli"
@@ -32,13 +43,28 @@ func init() {
 		{addFile, "add", "adds a file to the tag database"},
 		{removeFile, "remove", "removes a file from the tag database"},
 		{moveFile, "move", "moves a file to a new location"},
+		{relink, "relink", "finds moved files in a directory tree by their contents"},
+		{scan, "scan", "adds the files of a directory tree"},
+		{watchDir, "watch", "keeps the database in sync with changes to a directory tree"},
 		// Tag manipulation
 		{setTag, "set", "sets a tag on a file"},
 		{unsetTag, "unset", "unsets a tag on a file"},
+		{addValue, "add-value", "adds a value to a tag on a file"},
+		{removeValue, "remove-value", "removes a value from a tag on a file"},
+		{batch, "batch", "applies a script of add/set/unset operations atomically"},
 		// Querying
 		{match, "match", "find files matching filter"},
 		{get, "get", "gets the tags on a file"},
 		{files, "files", "gets all files in database"},
+		{tree, "tree", "prints the tag hierarchy with file counts"},
+		{tags, "tags", "prints usage statistics for all tags"},
+		// Aliases
+		{alias, "alias", "adds, removes or lists tag aliases"},
+		// Database maintenance
+		{dbCommand, "db", "manages the tag database"},
+		{check, "check", "finds and optionally fixes problems in the tag database"},
+		// Rules
+		{rule, "rule", "adds, lists, removes or applies tag implication rules"},
 	}
 
 	commandMap = map[string]command{}
@@ -49,6 +75,79 @@ func init() {
 
 var provider tagger.StorageProvider
 
+// dbFlag is the DSN of the tag database given on the command line
+var dbFlag = flag.String("db", "", "the tag database, such as sqlite:/path/to/tags.db (default $TAGGER_DB, or a database in the XDG data directory)")
+
+// databaseDSN returns the DSN of the tag database, which is taken from the
+// --db flag, the TAGGER_DB environment variable, or else is a database in the
+// XDG data directory. The directory of the default database is created if it
+// doesn't exist.
+func databaseDSN() (string, error) {
+	if *dbFlag != "" {
+		return *dbFlag, nil
+	}
+	if env := os.Getenv("TAGGER_DB"); env != "" {
+		return env, nil
+	}
+
+	dir, err := dataDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	// Builds without cgo don't have sqlite
+	driver, path := "bolt", filepath.Join(dir, "tags.bolt")
+	for _, name := range storage.Drivers() {
+		if name == "sqlite" {
+			driver, path = "sqlite", filepath.Join(dir, "tags.db")
+		}
+	}
+
+	// The database used to be kept in the working directory
+	if _, err := os.Stat(legacyDBPath); err == nil {
+		fmt.Fprintf(os.Stderr, "Note: %s is no longer used by default, pass --db sqlite:%[1]s to keep using it\n", legacyDBPath)
+	}
+
+	return driver + ":" + path, nil
+}
+
+// openStorage opens the tag database
+func openStorage() (tagger.StorageProvider, error) {
+	dsn, err := databaseDSN()
+	if err != nil {
+		return nil, err
+	}
+	return storage.Open(dsn)
+}
+
+// legacyDBPath is where the tag database was kept before it could be chosen
+const legacyDBPath = "./test.db"
+
+// dataDir returns the directory of tagger in the XDG data directory, which is
+// $XDG_DATA_HOME or ~/.local/share
+func dataDir() (string, error) {
+	if dir := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "tagger"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "share", "tagger"), nil
+}
+
+// noProvider lists the commands that don't need the storage provider to be
+// opened before running
+var noProvider = map[string]bool{
+	"help":    true,
+	"version": true,
+	"db":      true,
+}
+
 func main() {
 	// TODO: os.Exit(?) prohibits defers from executing. this could be bad
 	flag.Parse()
@@ -67,16 +166,18 @@ func main() {
 	}
 
 	// Setup storage provider
-	prov, err := storage.NewSqliteStorage("./test.db") //":memory:")
-	if err != nil {
-		fmt.Printf("Error while opening storage: %s\n", err)
-		os.Exit(1)
+	if !noProvider[cmd.name] {
+		prov, err := openStorage()
+		if err != nil {
+			fmt.Printf("Error while opening storage: %s\n", err)
+			os.Exit(1)
+		}
+		provider = prov
+		defer provider.Close()
 	}
-	provider = prov
-	defer provider.Close()
 
 	// Execute the command
-	if err = cmd.f(); err != nil {
+	if err := cmd.f(); err != nil {
 		fmt.Printf("Error while executing command: %s\n", err)
 		os.Exit(1)
 	}
@@ -86,16 +187,38 @@ func main() {
 }
 
 func getFileFromArg(arg string) (tagger.File, error) {
+	return getFileFrom(provider, arg)
+}
+
+func getFileFrom(p tagger.StorageProvider, arg string) (tagger.File, error) {
 	// If path contains the prefix 'uuid:' consider it an uuid
 	if strings.HasPrefix(arg, "uuid:") {
 		// Get the file matching the uuid
-		return provider.GetFile(uuid.Parse(arg[5:]))
+		return p.GetFile(uuid.Parse(arg[5:]))
 	} else {
 		// Get the file matching the file
-		return provider.GetFileForPath(arg)
+		return p.GetFileForPath(arg)
 	}
 }
 
+// newFile creates a file with a new UUID, or returns the stored file if the
+// path is already known, as storing a new file with the path would replace it
+// and it's tags. The content hash is recorded if the path is a readable
+// file, so the file can be relinked after being moved.
+func newFile(p tagger.StorageProvider, path string) (tagger.File, error) {
+	file, err := p.GetFileForPath(path)
+	if err == tagger.ErrNoFile {
+		file = tagger.NewFile(uuid.NewUUID(), path)
+	} else if err != nil {
+		return tagger.File{}, err
+	}
+
+	if h, err := tagger.HashFile(path); err == nil {
+		file = file.WithHash(h)
+	}
+	return file, nil
+}
+
 func ensureArgs(n int, msg string) error {
 	if flag.NArg() < ARG_OFFSET+n {
 		return fmt.Errorf("Expected %d arguments, got %d.\nUsage: %s", n, flag.NArg()-ARG_OFFSET, msg)
@@ -104,12 +227,20 @@ func ensureArgs(n int, msg string) error {
 }
 
 func usage() error {
-	fmt.Printf("Usage: tagger-cli [command] <arguments>\n")
+	fmt.Printf("Usage: tagger-cli [--db dsn] [command] <arguments>\n")
 	fmt.Printf("\n")
 	fmt.Printf("Available commands:\n")
 	for _, cmd := range commands {
 		fmt.Printf("  %s: %s\n", cmd.name, cmd.desc)
 	}
+	fmt.Printf("\n")
+	fmt.Printf("The tag database is given by --db or $TAGGER_DB as driver:location,\n")
+	fmt.Printf("where the driver is one of %s.\n", strings.Join(storage.Drivers(), ", "))
+	fmt.Printf("\n")
+	fmt.Printf("A batch script has one operation per line: add [path],\n")
+	fmt.Printf("set [path] [tag] (value) or unset [path] [tag]. Fields with spaces\n")
+	fmt.Printf("are double quoted like Go strings, such as \"my file.txt\". Lines\n")
+	fmt.Printf("starting with # are ignored.\n")
 
 	return nil
 }
@@ -128,10 +259,13 @@ func addFile() error {
 	path := flag.Arg(ARG_OFFSET)
 
 	// Create the new file
-	file := tagger.NewFile(uuid.NewUUID(), path)
+	file, err := newFile(provider, path)
+	if err != nil {
+		return err
+	}
 
 	// Update the file, an return if an error occurs
-	err := provider.UpdateFile(file, []tagger.Tag{})
+	err = provider.UpdateFile(file, []tagger.Tag{})
 	if err != nil {
 		return err
 	}
@@ -182,12 +316,176 @@ func moveFile() error {
 	}
 
 	// Update the file path
-	file = tagger.NewFile(file.UUID(), dst)
+	file = file.WithPath(dst)
 
 	// Update the file and return the error value
 	return provider.UpdateFile(file, tags)
 }
 
+// stringList is a flag that can be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// scanFlags are the flags deciding which files are added from a directory
+// tree, and how they are tagged
+type scanFlags struct {
+	include, exclude, rules stringList
+	noHash                  *bool
+}
+
+func addScanFlags(fs *flag.FlagSet) *scanFlags {
+	f := new(scanFlags)
+	fs.Var(&f.include, "include", "only add files matching this glob, can be repeated")
+	fs.Var(&f.exclude, "exclude", "skip files and directories matching this glob, can be repeated")
+	fs.Var(&f.rules, "tag", "tag files matching a glob, as in \"*.jpg => photo\", can be repeated")
+	f.noHash = fs.Bool("no-hash", false, "don't record content hashes of the added files")
+	return f
+}
+
+// options returns the scan options given by the flags
+func (f *scanFlags) options() (scanner.Options, error) {
+	opts := scanner.Options{Include: f.include, Exclude: f.exclude, SkipHash: *f.noHash}
+	for _, r := range f.rules {
+		rule, err := scanner.ParseGlobRule(r)
+		if err != nil {
+			return opts, err
+		}
+		opts.Rules = append(opts.Rules, rule)
+	}
+	return opts, nil
+}
+
+func scan() error {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	flags := addScanFlags(fs)
+	if err := fs.Parse(flag.Args()[ARG_OFFSET:]); err != nil {
+		return err
+	}
+
+	root := "."
+	if fs.NArg() > 0 {
+		root = fs.Arg(0)
+	}
+
+	opts, err := flags.options()
+	if err != nil {
+		return err
+	}
+
+	// Add all files in a single transaction
+	tx, err := provider.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	summary, err := scanner.Scan(tx, root, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, err := range summary.Failed {
+		fmt.Printf("Skipped: %s\n", err)
+	}
+	fmt.Printf("Added %d files, %d already known, %d excluded, %d failed\n",
+		summary.Added, summary.Known, summary.Excluded, len(summary.Failed))
+	return nil
+}
+
+func watchDir() error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	flags := addScanFlags(fs)
+	removeDeleted := fs.Bool("remove-deleted", false, fmt.Sprintf("remove deleted files instead of tagging them %q", watch.MissingTag))
+	if err := fs.Parse(flag.Args()[ARG_OFFSET:]); err != nil {
+		return err
+	}
+
+	if fs.NArg() < 1 {
+		return fmt.Errorf("Expected a directory.\nUsage: watch [--include glob] [--exclude glob] [--tag rule] [--remove-deleted] [dir]")
+	}
+
+	scanOpts, err := flags.options()
+	if err != nil {
+		return err
+	}
+	opts := watch.Options{
+		Scan:          scanOpts,
+		RemoveDeleted: *removeDeleted,
+		Logger:        log.New(os.Stdout, "", log.LstdFlags),
+	}
+
+	// Watch until interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Printf("Watching %s\n", fs.Arg(0))
+	return watch.Watch(ctx, provider, fs.Arg(0), opts)
+}
+
+func relink() error {
+	root := "."
+	if flag.NArg() > ARG_OFFSET {
+		root = flag.Arg(ARG_OFFSET)
+	}
+
+	// Find the files whose path no longer exists
+	files, err := provider.GetAllFiles()
+	if err != nil {
+		return err
+	}
+	orphans := make([]tagger.File, 0)
+	for _, file := range files {
+		if _, ok := file.Hash(); !ok {
+			continue
+		}
+		if _, err := os.Stat(file.Path()); os.IsNotExist(err) {
+			orphans = append(orphans, file)
+		}
+	}
+
+	if len(orphans) == 0 {
+		fmt.Printf("No orphaned files\n")
+		return nil
+	}
+
+	// Move all found files in a single transaction
+	tx, err := provider.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	moves, failed, err := scanner.Relink(tx, root, orphans)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, err := range failed {
+		fmt.Printf("Skipped: %s\n", err)
+	}
+	for _, move := range moves {
+		fmt.Printf("%s -> %s\n", move.From, move.File.Path())
+	}
+	fmt.Printf("Relinked %d of %d orphaned files\n", len(moves), len(orphans))
+	return nil
+}
+
 func setTag() error {
 	// Ensure we have enough arguments
 	if err := ensureArgs(2, "set [path] [tag] (value)"); err != nil {
@@ -206,14 +504,8 @@ func setTag() error {
 	// Depending on the amount of arguments, create a value tag or a named tag
 	var tag tagger.Tag
 	if flag.NArg() > ARG_OFFSET+2 {
-		// Parse tag value
-		value, err := strconv.Atoi(flag.Arg(ARG_OFFSET + 2))
-		if err != nil {
-			return tagger.ErrInvalidValue
-		}
-
-		// Create a value tag
-		tag = tagger.NewValueTag(name, int(value))
+		// Create a value tag, the type of which depends on the value
+		tag = tagger.NewTagFromString(name, flag.Arg(ARG_OFFSET+2))
 	} else {
 		// Create a named tag
 		tag = tagger.NewNamedTag(name)
@@ -244,36 +536,301 @@ func unsetTag() error {
 	return provider.RemoveTag(file, tag)
 }
 
+func batch() error {
+	// Read the script from the given file, or from stdin
+	in := os.Stdin
+	if flag.NArg() > ARG_OFFSET && flag.Arg(ARG_OFFSET) != "-" {
+		f, err := os.Open(flag.Arg(ARG_OFFSET))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	// Start a transaction, which is rolled back unless every operation
+	// succeeds
+	tx, err := provider.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	// Apply each line of the script
+	lines := bufio.NewScanner(in)
+	for n := 1; lines.Scan(); n++ {
+		if err := batchLine(tx, lines.Text()); err != nil {
+			return fmt.Errorf("line %d: %s", n, err)
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// batchLine applies a single line of a batch script. Each line is one of
+// "add [path]", "set [path] [tag] (value)" or "unset [path] [tag]", with the
+// fields split by splitFields. Empty lines and lines starting with '#' are
+// ignored.
+func batchLine(p tagger.StorageProvider, line string) error {
+	if strings.HasPrefix(strings.TrimSpace(line), "#") {
+		return nil
+	}
+
+	args, err := splitFields(line)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	switch {
+	case args[0] == "add" && len(args) == 2:
+		file, err := newFile(p, args[1])
+		if err != nil {
+			return err
+		}
+		return p.UpdateFile(file, []tagger.Tag{})
+
+	case args[0] == "set" && (len(args) == 3 || len(args) == 4):
+		file, err := getFileFrom(p, args[1])
+		if err != nil {
+			return err
+		}
+
+		// Depending on the amount of arguments, create a value tag or a
+		// named tag
+		var tag tagger.Tag = tagger.NewNamedTag(args[2])
+		if len(args) == 4 {
+			tag = tagger.NewTagFromString(args[2], args[3])
+		}
+		return p.UpdateTag(file, tag)
+
+	case args[0] == "unset" && len(args) == 3:
+		file, err := getFileFrom(p, args[1])
+		if err != nil {
+			return err
+		}
+		return p.RemoveTag(file, tagger.NewNamedTag(args[2]))
+	}
+
+	return fmt.Errorf("invalid operation: %s", line)
+}
+
+// batchSpace are the characters separating the fields of a batch script
+const batchSpace = " \t\r"
+
+// splitFields splits a line of a batch script into fields separated by white
+// space. A field can be a double quoted string in Go syntax, so paths and
+// values with spaces or escaped characters can be given.
+func splitFields(line string) ([]string, error) {
+	fields := make([]string, 0)
+	for {
+		line = strings.TrimLeft(line, batchSpace)
+		if line == "" {
+			return fields, nil
+		}
+
+		// Unquoted fields end at the next white space
+		if line[0] != '"' {
+			end := strings.IndexAny(line, batchSpace)
+			if end < 0 {
+				end = len(line)
+			}
+			fields = append(fields, line[:end])
+			line = line[end:]
+			continue
+		}
+
+		// Quoted fields end at the first quote that isn't escaped
+		end := 1
+		for end < len(line) && line[end] != '"' {
+			if line[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(line) {
+			return nil, fmt.Errorf("unterminated string: %s", line)
+		}
+
+		field, err := strconv.Unquote(line[:end+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s: %s", line[:end+1], err)
+		}
+		fields = append(fields, field)
+
+		// The string must be followed by white space
+		line = line[end+1:]
+		if line != "" && !strings.ContainsRune(batchSpace, rune(line[0])) {
+			return nil, fmt.Errorf("missing space after string: %s", line)
+		}
+	}
+}
+
+func addValue() error {
+	// Ensure we have enough arguments
+	if err := ensureArgs(3, "add-value [path] [tag] [value]"); err != nil {
+		return err
+	}
+
+	path := flag.Arg(ARG_OFFSET)
+	name := flag.Arg(ARG_OFFSET + 1)
+	value := flag.Arg(ARG_OFFSET + 2)
+
+	// Get specified file
+	file, err := getFileFromArg(path)
+	if err != nil {
+		return err
+	}
+
+	// Add the value to the tag and return any errors
+	return provider.AddTagValue(file, tagger.NewTagFromString(name, value))
+}
+
+func removeValue() error {
+	// Ensure we have enough arguments
+	if err := ensureArgs(3, "remove-value [path] [tag] [value]"); err != nil {
+		return err
+	}
+
+	path := flag.Arg(ARG_OFFSET)
+	name := flag.Arg(ARG_OFFSET + 1)
+	value := flag.Arg(ARG_OFFSET + 2)
+
+	// Get specified file
+	file, err := getFileFromArg(path)
+	if err != nil {
+		return err
+	}
+
+	// Remove the value from the tag and return any errors
+	return provider.RemoveTagValue(file, tagger.NewTagFromString(name, value))
+}
+
 func match() error {
-	if err := ensureArgs(1, "match [filter]"); err != nil {
+	if err := ensureArgs(1, "match [--timeout duration] [--sort key [desc]] [--limit n] [--offset n] [filter]"); err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("match", flag.ContinueOnError)
+	timeout := fs.Duration("timeout", 0, "give up if matching takes longer than this")
+	query := addQueryFlags(fs)
+	if err := fs.Parse(flag.Args()[ARG_OFFSET:]); err != nil {
+		return err
+	}
+
+	opts, err := query.options()
+	if err != nil {
 		return err
 	}
 
 	// Stich filter together from arguments for user convinience
 	arg := ""
-	for i := ARG_OFFSET; i < flag.NArg(); i++ {
-		arg = fmt.Sprintf("%s %s", arg, flag.Arg(i))
+	for _, a := range fs.Args() {
+		arg = fmt.Sprintf("%s %s", arg, a)
 	}
 
+	arg = strings.TrimSpace(arg)
+
 	// Parse the filter
 	r := strings.NewReader(arg)
 	filter, err := tagger.ParseFilter(r)
-	if err != nil {
+	if perr, ok := err.(*tagger.ParseError); ok {
+		// Point out where in the filter the error occured
+		fmt.Printf("%s\n%s^\n", arg, strings.Repeat(" ", perr.Offset))
+		return err
+	} else if err != nil {
 		return err
 	}
 
-	// Get all files matching the filter
-	files, err := provider.GetMatchingFiles(filter)
+	// Stop the query if it runs for too long
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	// Find the files matching the filter
+	it, err := provider.WithContext(ctx).QueryFiles(filter, opts)
 	if err != nil {
 		return err
 	}
+	defer it.Close()
 
-	// Print all matched files
-	for _, file := range files {
+	// Print the matched files as they are found
+	return printFiles(it)
+}
+
+// queryFlags are the flags controlling the order and range of listed files
+type queryFlags struct {
+	sort          *string
+	limit, offset *int
+}
+
+func addQueryFlags(fs *flag.FlagSet) queryFlags {
+	return queryFlags{
+		sort:   fs.String("sort", "path", "order files by \"path\" or by the value of a tag, optionally followed by \"asc\" or \"desc\""),
+		limit:  fs.Int("limit", 0, "list at most this many files"),
+		offset: fs.Int("offset", 0, "skip this many files first"),
+	}
+}
+
+// options returns the query options given by the flags
+func (q queryFlags) options() (tagger.QueryOptions, error) {
+	opts := tagger.QueryOptions{Limit: *q.limit, Offset: *q.offset}
+	if opts.Limit < 0 || opts.Offset < 0 {
+		return opts, fmt.Errorf("Limit and offset can't be negative")
+	}
+
+	// The sort key may be followed by a direction
+	fields := strings.Fields(*q.sort)
+	if len(fields) == 0 || len(fields) > 2 {
+		return opts, fmt.Errorf("Invalid sort order: %q", *q.sort)
+	}
+	if len(fields) == 2 {
+		switch strings.ToLower(fields[1]) {
+		case "asc":
+		case "desc":
+			opts.Descending = true
+		default:
+			return opts, fmt.Errorf("Invalid sort direction: %q", fields[1])
+		}
+	}
+	if fields[0] != "path" {
+		opts.SortTag = fields[0]
+	}
+
+	return opts, nil
+}
+
+// printFiles prints the UUID and path of each file from an iterator
+func printFiles(it tagger.FileIterator) error {
+	for it.Next() {
+		file := it.File()
 		fmt.Printf("%s %s\n", file.UUID(), file.Path())
 	}
+	return it.Err()
+}
 
-	return nil
+// countFiles counts the files matching a filter as they are found, without
+// keeping them in memory
+func countFiles(f tagger.Filter) (int, error) {
+	it, err := provider.QueryFiles(f, tagger.QueryOptions{})
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+
+	n := 0
+	for it.Next() {
+		n++
+	}
+	return n, it.Err()
 }
 
 func get() error {
@@ -297,7 +854,7 @@ func get() error {
 	// Loop through each tag and print it out
 	for _, tag := range tags {
 		if tag.HasValue() {
-			fmt.Printf("%s=%d ", tag.Name(), tag.Value())
+			fmt.Printf("%s=%s ", tag.Name(), tagger.FormatValue(tagger.TagValue(tag)))
 		} else {
 			fmt.Printf("%s ", tag.Name())
 		}
@@ -308,16 +865,336 @@ func get() error {
 }
 
 func files() error {
-	// Get the list of all files
-	files, err := provider.GetAllFiles()
+	fs := flag.NewFlagSet("files", flag.ContinueOnError)
+	query := addQueryFlags(fs)
+	if err := fs.Parse(flag.Args()[ARG_OFFSET:]); err != nil {
+		return err
+	}
+
+	opts, err := query.options()
 	if err != nil {
 		return err
 	}
 
-	// Loop through each file and print their UUID and path
-	for _, file := range files {
-		fmt.Printf("%s %s\n", file.UUID(), file.Path())
+	// Go through all files
+	it, err := provider.QueryFiles(nil, opts)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	// Print their UUID and path as they are read
+	return printFiles(it)
+}
+
+func tags() error {
+	// Get the statistics for all tags, sorted by name
+	infos, err := provider.GetAllTags()
+	if err != nil {
+		return err
+	}
+
+	// Optionally sort by the number of files instead
+	order := "name"
+	if flag.NArg() > ARG_OFFSET {
+		order = flag.Arg(ARG_OFFSET)
+	}
+
+	switch order {
+	case "name":
+	case "count":
+		sort.SliceStable(infos, func(i, j int) bool {
+			return infos[i].Files > infos[j].Files
+		})
+	default:
+		return fmt.Errorf("Unknown sort order: %s\nUsage: tags (name|count)", order)
+	}
+
+	// Print the statistics as a table
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "NAME\tFILES\tMIN\tMAX\tVALUELESS\n")
+	for _, info := range infos {
+		min, max := "-", "-"
+		if info.Min != nil {
+			min = tagger.FormatValue(tagger.TagValue(info.Min))
+			max = tagger.FormatValue(tagger.TagValue(info.Max))
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%t\n", info.Name, info.Files, min, max, info.Valueless)
+	}
+
+	return w.Flush()
+}
+
+func tree() error {
+	// Start at the given tag, or at the top of the hierarchy
+	root := ""
+	if flag.NArg() > ARG_OFFSET {
+		root = flag.Arg(ARG_OFFSET)
+	}
+
+	return printTree(root, 0)
+}
+
+func printTree(parent string, depth int) error {
+	// Get the children of the tag
+	children, err := provider.GetChildTags(parent)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		// Count the files tagged with the child or any of it's descendants
+		n, err := countFiles(tagger.NameFilter{Name: child, Descendants: true})
+		if err != nil {
+			return err
+		}
+
+		// Print the last level of the name, indented by the depth
+		name := child[strings.LastIndex(child, tagger.TagSeparator)+1:]
+		fmt.Printf("%s%s (%d)\n", strings.Repeat("  ", depth), name, n)
+
+		// Print the children of the child
+		if err := printTree(child, depth+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func alias() error {
+	if err := ensureArgs(1, "alias [add|remove|list]"); err != nil {
+		return err
+	}
+
+	switch sub := flag.Arg(ARG_OFFSET); sub {
+	case "add":
+		if err := ensureArgs(3, "alias add [alias] [tag]"); err != nil {
+			return err
+		}
+		return provider.AddAlias(flag.Arg(ARG_OFFSET+1), flag.Arg(ARG_OFFSET+2))
+
+	case "remove":
+		if err := ensureArgs(2, "alias remove [alias]"); err != nil {
+			return err
+		}
+		return provider.RemoveAlias(flag.Arg(ARG_OFFSET + 1))
+
+	case "list":
+		aliases, err := provider.GetAliases()
+		if err != nil {
+			return err
+		}
+
+		// Print the aliases sorted by name
+		names := make([]string, 0, len(aliases))
+		for alias := range aliases {
+			names = append(names, alias)
+		}
+		sort.Strings(names)
+
+		for _, alias := range names {
+			fmt.Printf("%s => %s\n", alias, aliases[alias])
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("Unknown alias command: %s", sub)
+	}
+}
+
+func rule() error {
+	if err := ensureArgs(1, "rule [add|list|remove|apply]"); err != nil {
+		return err
+	}
+
+	switch sub := flag.Arg(ARG_OFFSET); sub {
+	case "add":
+		if err := ensureArgs(2, "rule add [condition] => [tag] (= value)"); err != nil {
+			return err
+		}
+
+		// Stich rule together from arguments for user convinience
+		arg := strings.Join(flag.Args()[ARG_OFFSET+1:], " ")
+
+		// Parse the rule
+		r, err := tagger.ParseRule(arg)
+		if err != nil {
+			return err
+		}
+
+		// Add the rule and print it's id to the user
+		id, err := provider.AddRule(r)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d\n", id)
+		return nil
+
+	case "list":
+		rules, err := provider.GetRules()
+		if err != nil {
+			return err
+		}
+
+		for _, r := range rules {
+			fmt.Printf("%d: %s\n", r.ID, r)
+		}
+		return nil
+
+	case "remove":
+		if err := ensureArgs(2, "rule remove [id]"); err != nil {
+			return err
+		}
+
+		id, err := strconv.Atoi(flag.Arg(ARG_OFFSET + 1))
+		if err != nil {
+			return tagger.ErrNoRule
+		}
+		return provider.RemoveRule(id)
+
+	case "apply":
+		return provider.ApplyRules()
+
+	default:
+		return fmt.Errorf("Unknown rule command: %s", sub)
+	}
+}
+
+func check() error {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	fix := fs.Bool("fix", false, "fix the problems found, removing files whose path is missing")
+	search := fs.String("search", "", "with --fix, look for files with a missing path in this directory first")
+	if err := fs.Parse(flag.Args()[ARG_OFFSET:]); err != nil {
+		return err
+	}
+
+	// Check and fix everything in a single transaction
+	tx, err := provider.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	problems, err := tagger.Check(tx)
+	if err != nil {
+		return err
+	}
+
+	if len(problems) == 0 {
+		fmt.Printf("No problems found\n")
+		return nil
 	}
 
+	// Try to find files with missing paths before removing them
+	relinked := make(map[string]bool)
+	if *fix && *search != "" {
+		missing := make([]tagger.File, 0)
+		for _, problem := range problems {
+			if problem.Kind == tagger.MissingPath {
+				missing = append(missing, problem.File)
+			}
+		}
+
+		moves, _, err := scanner.Relink(tx, *search, missing)
+		if err != nil {
+			return err
+		}
+		for _, move := range moves {
+			relinked[move.From] = true
+			fmt.Printf("%s: Found at %s\n", move.From, move.File.Path())
+		}
+	}
+
+	fixed := 0
+	for _, problem := range problems {
+		if problem.Kind == tagger.MissingPath && relinked[problem.Path] {
+			fixed++
+			continue
+		}
+
+		fmt.Printf("%s\n", problem)
+		if !*fix {
+			continue
+		}
+
+		err := tagger.Repair(tx, problem)
+		if err == tagger.ErrNotRepairable {
+			fmt.Printf("\tCan't be fixed\n")
+			continue
+		} else if err != nil {
+			return err
+		}
+		fixed++
+	}
+
+	if !*fix {
+		fmt.Printf("Found %d problems, run with --fix to fix them\n", len(problems))
+		return nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Fixed %d of %d problems\n", fixed, len(problems))
 	return nil
 }
+
+func dbCommand() error {
+	if err := ensureArgs(1, "db [migrate]"); err != nil {
+		return err
+	}
+
+	switch sub := flag.Arg(ARG_OFFSET); sub {
+	case "migrate":
+		fs := flag.NewFlagSet("db migrate", flag.ContinueOnError)
+		dryRun := fs.Bool("dry-run", false, "only show the pending migrations")
+		if err := fs.Parse(flag.Args()[ARG_OFFSET+1:]); err != nil {
+			return err
+		}
+
+		dsn, err := databaseDSN()
+		if err != nil {
+			return err
+		}
+
+		// Find the migrations that haven't been applied yet. Drivers that
+		// can't list them still apply them when the storage is opened.
+		pending, err := storage.PendingMigrations(dsn)
+		if errors.Is(err, storage.ErrUnlistedMigrations) && !*dryRun {
+			fmt.Printf("Applying any pending migrations\n")
+			return migrateStorage(dsn)
+		} else if err != nil {
+			return err
+		}
+
+		if len(pending) == 0 {
+			fmt.Printf("Database is up to date\n")
+			return nil
+		}
+
+		for _, step := range pending {
+			fmt.Printf("%s\n", step)
+		}
+
+		if *dryRun {
+			return nil
+		}
+
+		return migrateStorage(dsn)
+
+	default:
+		return fmt.Errorf("Unknown db command: %s", sub)
+	}
+}
+
+// migrateStorage applies the pending migrations of a storage, which is done
+// when opening it
+func migrateStorage(dsn string) error {
+	prov, err := storage.Open(dsn)
+	if err != nil {
+		return err
+	}
+	return prov.Close()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSplitFields(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", []string{}},
+		{"set a.txt genre rock", []string{"set", "a.txt", "genre", "rock"}},
+		{"  set\ta.txt  genre\r", []string{"set", "a.txt", "genre"}},
+		{`set "my file.txt" title "Hello, world"`, []string{"set", "my file.txt", "title", "Hello, world"}},
+		{`set a.txt quote "say \"hi\"\n"`, []string{"set", "a.txt", "quote", "say \"hi\"\n"}},
+		{`add ""`, []string{"add", ""}},
+		// Quotes inside a field are part of it
+		{`set a"b.txt x`, []string{"set", `a"b.txt`, "x"}},
+	}
+
+	for _, test := range tests {
+		got, err := splitFields(test.line)
+		if err != nil {
+			t.Errorf("splitFields(%q): %s", test.line, err)
+			continue
+		}
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", test.want) {
+			t.Errorf("splitFields(%q) returned %q, want %q", test.line, got, test.want)
+		}
+	}
+
+	for _, line := range []string{`add "a.txt`, `add "a\"`, `add "a"b`, `add "\q"`} {
+		if got, err := splitFields(line); err == nil {
+			t.Errorf("splitFields(%q) returned %q, want an error", line, got)
+		}
+	}
+}
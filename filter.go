@@ -2,11 +2,11 @@ package tagger
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 )
 
-// TODO: Investigate negate/invert filter and it's sql equivalent
-
 // Filter provides an interface to filter files based on their tags
 type Filter interface {
 	fmt.Stringer
@@ -14,9 +14,11 @@ type Filter interface {
 	Matches(t []Tag) bool
 }
 
-// NameFilter filters tags on their names
+// NameFilter filters tags on their names. If Descendants is set, tags below
+// the name in the tag hierarchy match as well.
 type NameFilter struct {
-	Name string
+	Name        string
+	Descendants bool
 }
 
 // Matches check if the filter matches the given tags
@@ -25,6 +27,9 @@ func (n NameFilter) Matches(tags []Tag) bool {
 		if tag.Name() == n.Name {
 			return true
 		}
+		if n.Descendants && IsDescendantOf(tag.Name(), n.Name) {
+			return true
+		}
 	}
 	return false
 }
@@ -62,44 +67,174 @@ func ComparatorFromString(val string) Comparator {
 	}
 }
 
-// ComparinsonFilter filters value tags based on their value
+// ComparinsonFilter filters value tags based on their value.
+//
+// Value may be an int, string, float64, time.Time or bool. Integers and
+// floats compare numerically with each other, strings compare
+// lexicographically, dates compare chronologically to the second and false
+// is less than true. A tag whose value can't be compared with the filter
+// value never matches.
+//
+// When a file has several values for the tag, the filter matches if any of
+// the values match. If All is set, the filter instead only matches if the
+// file has the tag and every one of it's values match.
 type ComparinsonFilter struct {
 	Name     string
-	Value    int
+	Value    interface{}
 	Function Comparator
+	All      bool
 }
 
 // Matches check if the filter matches the given tags
 func (c ComparinsonFilter) Matches(tags []Tag) bool {
+	found := false
 	for _, tag := range tags {
-		if tag.Name() == c.Name {
-			if !tag.HasValue() {
-				return false
-			}
+		if tag.Name() != c.Name {
+			continue
+		}
+		found = true
+
+		matches := c.matchesTag(tag)
+		if matches && !c.All {
+			return true
+		} else if !matches && c.All {
+			return false
+		}
+	}
+
+	// If we're matching all values, we've only made it here if every value
+	// matched
+	return c.All && found
+}
+
+// matchesTag checks if the value of a single tag matches the filter
+func (c ComparinsonFilter) matchesTag(tag Tag) bool {
+	if !tag.HasValue() {
+		return false
+	}
+
+	cmp, ok := compareValues(TagValue(tag), c.Value)
+	if !ok {
+		return false
+	}
+
+	switch c.Function {
+	case Equals:
+		return cmp == 0
+
+	case NotEquals:
+		return cmp != 0
+
+	case LessThan:
+		return cmp < 0
+
+	case GreaterThan:
+		return cmp > 0
+
+	case LessThanOrEqual:
+		return cmp <= 0
+
+	case GreaterThanOrEqual:
+		return cmp >= 0
+	}
 
-			switch c.Function {
-			case Equals:
-				return tag.Value() == c.Value
+	return false
+}
 
-			case NotEquals:
-				return tag.Value() != c.Value
+// compareValues compares two values of the types returned by TagValue. It
+// returns -1, 0 or 1 if a is less than, equal to or greater than b, and
+// whether the values could be compared at all.
+func compareValues(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case int:
+		switch b := b.(type) {
+		case int:
+			switch {
+			case a < b:
+				return -1, true
+			case a > b:
+				return 1, true
+			}
+			return 0, true
+		case float64:
+			return compareFloats(float64(a), b), true
+		}
 
-			case LessThan:
-				return tag.Value() < c.Value
+	case float64:
+		switch b := b.(type) {
+		case int:
+			return compareFloats(a, float64(b)), true
+		case float64:
+			return compareFloats(a, b), true
+		}
 
-			case GreaterThan:
-				return tag.Value() > c.Value
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), true
+		}
 
-			case LessThanOrEqual:
-				return tag.Value() <= c.Value
+	case time.Time:
+		// Dates are compared to the second, as they are stored
+		if b, ok := b.(time.Time); ok {
+			switch {
+			case a.Unix() < b.Unix():
+				return -1, true
+			case a.Unix() > b.Unix():
+				return 1, true
+			}
+			return 0, true
+		}
 
-			case GreaterThanOrEqual:
-				return tag.Value() >= c.Value
+	case bool:
+		if b, ok := b.(bool); ok {
+			switch {
+			case a == b:
+				return 0, true
+			case b:
+				return -1, true
 			}
+			return 1, true
 		}
 	}
 
-	return false
+	return 0, false
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// FormatValue formats a value of one of the types returned by TagValue in the
+// syntax used by the filter language
+func FormatValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return strconv.Quote(v)
+
+	case float64:
+		// Make sure the value doesn't read back as an integer
+		s := strconv.FormatFloat(v, 'f', -1, 64)
+		if !strings.Contains(s, ".") {
+			s += ".0"
+		}
+		return s
+
+	case time.Time:
+		// Dates are written in UTC, as a day when they are at midnight
+		v = v.UTC()
+		if v.Equal(v.Truncate(24 * time.Hour)) {
+			return v.Format("2006-01-02")
+		}
+		return v.Format(time.RFC3339Nano)
+	}
+
+	return fmt.Sprintf("%v", v)
 }
 
 // AndFilter allows the joining of two or more filters, all which must match
@@ -134,6 +269,16 @@ func (o OrFilter) Matches(tags []Tag) bool {
 	return false
 }
 
+// NotFilter inverts the result of another filter
+type NotFilter struct {
+	Filter Filter
+}
+
+// Matches check if the wrapped filter doesn't match the given tags
+func (n NotFilter) Matches(tags []Tag) bool {
+	return !n.Filter.Matches(tags)
+}
+
 // Debuggg
 
 func (c Comparator) String() string {
@@ -160,11 +305,17 @@ func (c Comparator) String() string {
 }
 
 func (n NameFilter) String() string {
+	if n.Descendants {
+		return fmt.Sprintf("%s%s*", n.Name, TagSeparator)
+	}
 	return fmt.Sprintf("%s", n.Name)
 }
 
 func (c ComparinsonFilter) String() string {
-	return fmt.Sprintf("%s %s %d", c.Name, c.Function, c.Value)
+	if c.All {
+		return fmt.Sprintf("all %s %s %s", c.Name, c.Function, FormatValue(c.Value))
+	}
+	return fmt.Sprintf("%s %s %s", c.Name, c.Function, FormatValue(c.Value))
 }
 
 func (a AndFilter) String() string {
@@ -172,7 +323,7 @@ func (a AndFilter) String() string {
 	for _, f := range a.Filters {
 		subs = append(subs, f.String())
 	}
-	return fmt.Sprintf("(%s)", strings.Join(subs, ", "))
+	return fmt.Sprintf("(%s)", strings.Join(subs, " && "))
 }
 
 func (a OrFilter) String() string {
@@ -180,5 +331,9 @@ func (a OrFilter) String() string {
 	for _, f := range a.Filters {
 		subs = append(subs, f.String())
 	}
-	return fmt.Sprintf("(%s)", strings.Join(subs, ", "))
+	return fmt.Sprintf("(%s)", strings.Join(subs, " || "))
+}
+
+func (n NotFilter) String() string {
+	return fmt.Sprintf("!%s", n.Filter)
 }
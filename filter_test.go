@@ -0,0 +1,49 @@
+package tagger
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatValue(t *testing.T) {
+	east, west := time.FixedZone("UTC+2", 2*60*60), time.FixedZone("UTC-5", -5*60*60)
+
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{4, "4"},
+		{-2, "-2"},
+		{2.5, "2.5"},
+		{3.0, "3.0"},
+		{`say "hi"`, `"say \"hi\""`},
+		{true, "true"},
+		{time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC), "2020-03-01"},
+		// Dates are written in UTC
+		{time.Date(2020, 2, 29, 19, 0, 0, 0, west), "2020-03-01"},
+		{time.Date(2020, 3, 1, 0, 0, 0, 0, east), "2020-02-29T22:00:00Z"},
+		{time.Date(2020, 3, 1, 23, 30, 0, 0, east), "2020-03-01T21:30:00Z"},
+		{time.Date(2020, 3, 1, 21, 30, 0, 250e6, time.UTC), "2020-03-01T21:30:00.25Z"},
+	}
+
+	for _, test := range tests {
+		got := FormatValue(test.value)
+		if got != test.want {
+			t.Errorf("FormatValue(%#v) returned %s, want %s", test.value, got, test.want)
+		}
+
+		// The value reads back as the same value
+		v, err := parseLiteral(got)
+		if err != nil {
+			t.Errorf("parseLiteral(%q): %s", got, err)
+			continue
+		}
+		if d, ok := test.value.(time.Time); ok {
+			if !d.Equal(v.(time.Time)) {
+				t.Errorf("%s reads back as %s, want %s", got, v, d)
+			}
+		} else if v != test.value {
+			t.Errorf("%s reads back as %#v, want %#v", got, v, test.value)
+		}
+	}
+}
@@ -1,15 +1,16 @@
 package tagger
 
-//go:generate go tool yacc -o filterparse_gen.go filterparse.y
+//go:generate goyacc -o filterparse_gen.go filterparse.y
 
 import (
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"regexp"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
 var (
@@ -20,22 +21,77 @@ func makeErr(part, msg string) error {
 	return fmt.Errorf("tagger: Error while parsing %s:\n\t%s", part, msg)
 }
 
+// ParseError describes a syntax error in a filter
+type ParseError struct {
+	// Offset is the byte offset of the offending token in the input
+	Offset int
+	// Token is the offending token, or an empty string at end of input
+	Token string
+	// Expected is the set of tokens that would have been valid at Offset
+	Expected []string
+	// Err is the cause of the error if the syntax was valid, such as
+	// ErrInvalidLiteral
+	Err error
+}
+
+// Unwrap returns the cause of the error
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ParseError) Error() string {
+	token := "end of input"
+	if e.Token != "" {
+		token = fmt.Sprintf("%q", e.Token)
+	}
+
+	if e.Err != nil {
+		return fmt.Sprintf("%s in filter at pos %d: %s", e.Err, e.Offset, token)
+	}
+
+	msg := fmt.Sprintf("tagger: Syntax error in filter at pos %d: unexpected %s", e.Offset, token)
+	if len(e.Expected) > 0 {
+		msg = fmt.Sprintf("%s, expecting %s", msg, strings.Join(e.Expected, " or "))
+	}
+
+	return msg
+}
+
 // ParseFilter parses a filter from a reader, and returns the described
 // filter.
 //
 // The format of the filter is a simple logic language.
 // There is a simple precedence heirachy:
 // 1. Parentheses
-// 2. And expressions
-// 3. Or expressions
-// 4. Tags and comparators
+// 2. Negations
+// 3. And expressions
+// 4. Or expressions
+// 5. Tags and comparators
 //
 // This means that "tag1 && tag2 && tag3 || tag4" parses as equivalent to
-// "(tag1 && tag2 && tag3) || tag4".
+// "(tag1 && tag2 && tag3) || tag4", and "!tag1 && tag2" parses as equivalent
+// to "(!tag1) && tag2".
+//
+// Parentheses are never part of a tag name, so "!(tag1)" is the negation of
+// tag1 and the output of Filter.String always parses back to the same filter.
 //
 // Examples of filters:
 // "picture && year > 2007 && year < 2009"
 // "todo && (important || easy)"
+// "photo && !reviewed"
+// "author == \"alice\" && rating >= 4.5 && taken < 2014-06-01"
+//
+// Values may be integers, floats, dates in the "2006-01-02" or RFC 3339
+// formats, the words true and false, or strings quoted with either single or
+// double quotes.
+//
+// Tags are organised in a hierarchy by separating levels with a slash, as in
+// "project/tagger/bugs". Suffixing a tag with "/*", as in "project/tagger/*",
+// matches the tag itself and all tags below it in the hierarchy.
+//
+// A comparison matches if any value of a tag with several values matches.
+// Prefixing the comparison with "all", as in "all person != 3", requires
+// every value of the tag to match instead.
 func ParseFilter(reader io.Reader) (Filter, error) {
 	// Lex the input
 	tokens, err := lexer(reader)
@@ -45,9 +101,11 @@ func ParseFilter(reader io.Reader) (Filter, error) {
 
 	// Call the generated parser
 	ret := yyParse(tokens)
-	if ret != 0 {
-		// TODO: Make a proper error message
-		return nil, errors.New("tagger: something bad happened yo")
+	if tokens.err != nil {
+		// The lexer hit an invalid literal
+		return nil, tokens.err
+	} else if ret != 0 {
+		return nil, tokens.parseError()
 	}
 
 	// Return the generated filter
@@ -58,12 +116,16 @@ func ParseFilter(reader io.Reader) (Filter, error) {
 type tokenType int
 
 const (
+	tokEOF    tokenType = 0
 	tokLparen tokenType = LPAREN
 	tokRparen           = RPAREN
 	tokAnd              = AND
 	tokOr               = OR
+	tokNot              = NOT
+	tokAll              = ALL
 	tokComp             = COMP
 	tokTag              = TAG
+	tokTree             = TREE
 	tokVal              = VAL
 )
 
@@ -77,10 +139,16 @@ func (t tokenType) String() string {
 		return "AND"
 	case tokOr:
 		return "OR"
+	case tokNot:
+		return "NOT"
+	case tokAll:
+		return "ALL"
 	case tokComp:
 		return "COMP"
 	case tokTag:
 		return "TAG"
+	case tokTree:
+		return "TREE"
 	case tokVal:
 		return "VAL"
 	default:
@@ -88,29 +156,88 @@ func (t tokenType) String() string {
 	}
 }
 
+// describe returns a human readable description of the token type, used in
+// error messages
+func (t tokenType) describe() string {
+	switch t {
+	case tokEOF:
+		return "end of input"
+	case tokLparen:
+		return `"("`
+	case tokRparen:
+		return `")"`
+	case tokAnd:
+		return `"&&"`
+	case tokOr:
+		return `"||"`
+	case tokNot:
+		return `"!"`
+	case tokAll:
+		return `"all"`
+	case tokComp:
+		return "comparator"
+	case tokTag, tokTree:
+		return "tag"
+	case tokVal:
+		return "value"
+	default:
+		return "INVALID"
+	}
+}
+
 // token describes an indivdual token
 type token struct {
 	typ   tokenType
 	value string
+	pos   int
 }
 
-// tokenDef defines which pattern matches a given token type
+// tokenDef defines which pattern matches a given token type. If the pattern
+// has a group, only the group is part of the token, and the rest of the
+// match must follow it.
 type tokenDef struct {
 	pattern string
 	typ     tokenType
 }
 
 var tokenDefs = []tokenDef{
-	{`[ \"\'\n\r]+`, -1},
+	{`[ \t\n\r]+`, -1},
 	{`\(`, tokLparen},
 	{`\)`, tokRparen},
 	{`&&`, tokAnd},
 	{`\|\|`, tokOr},
 	{`==|!=|>=|<=|>|<`, tokComp},
-	{`[a-zA-Z][a-zA-Z0-9_\-\?\(\)]*`, tokTag},
+	{`!`, tokNot},
+	{`"(?:[^"\\]|\\.)*"|'[^']*'`, tokVal},
+	// Keywords are tags when they are followed by more of a tag name, and
+	// all is only a keyword in front of a comparison
+	{`(true|false)(?:[^a-zA-Z0-9_\-\?/]|$)`, tokVal},
+	{`(all)[ \t\n\r]+[a-zA-Z][a-zA-Z0-9_\-\?/]*[ \t\n\r]*(?:==|!=|>=|<=|>|<)`, tokAll},
+	{`[a-zA-Z][a-zA-Z0-9_\-\?/]*/\*`, tokTree},
+	{`[a-zA-Z][a-zA-Z0-9_\-\?/]*`, tokTag},
+	{`[0-9]{4}-[0-9]{2}-[0-9]{2}(?:T[0-9]{2}:[0-9]{2}:[0-9]{2}(?:\.[0-9]+)?(?:Z|[+-][0-9]{2}:[0-9]{2}))?`, tokVal},
+	{`-?[0-9]+\.[0-9]+`, tokVal},
 	{`-?[0-9]+`, tokVal},
 }
 
+// parseLiteral converts a value token into a string, bool, date, float or
+// integer depending on it's format
+func parseLiteral(value string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		return strconv.Unquote(value)
+	case strings.HasPrefix(value, "'"):
+		return value[1 : len(value)-1], nil
+	case value == "true" || value == "false":
+		return value == "true", nil
+	case strings.Count(value, "-") >= 2:
+		return ParseDate(value)
+	case strings.Contains(value, "."):
+		return strconv.ParseFloat(value, 64)
+	}
+	return strconv.Atoi(value)
+}
+
 func lexer(reader io.Reader) (*lex, error) {
 	// Read the whole input stream into a string
 	input_bytes, err := ioutil.ReadAll(reader)
@@ -134,9 +261,10 @@ outer:
 			patt := regexp.MustCompile(tokenDef.pattern)
 
 			// If the pattern matches, and starts at the first character (0-indexed)
-			if matches := patt.FindStringIndex(input[pos:]); matches != nil && matches[0] == 0 {
-				// Capture the start and end position
-				start, end := matches[0], matches[1]
+			if matches := patt.FindStringSubmatchIndex(input[pos:]); matches != nil && matches[0] == 0 {
+				// Capture the start and end position, which is the end of
+				// the group if the pattern has one
+				start, end := matches[0], matches[len(matches)-1]
 
 				// Extract the value from our input
 				value := input[pos+start : pos+end]
@@ -146,7 +274,7 @@ outer:
 
 				// If the token is not whitespace, add it to the array of tokens
 				if tokenDef.typ != -1 {
-					token := token{value: value, typ: tokenDef.typ}
+					token := token{value: strings.TrimSpace(value), typ: tokenDef.typ, pos: pos - len(value)}
 					tokens = append(tokens, token)
 				}
 
@@ -157,27 +285,38 @@ outer:
 
 		// This point should only be reached if we reach something not matching
 		// any token patterns, so we return an error.
-		return nil, fmt.Errorf("tagger: Invalid char in filter at pos %d: %s", pos, input[pos:])
+		_, size := utf8.DecodeRuneInString(input[pos:])
+		return nil, &ParseError{Offset: pos, Token: input[pos : pos+size]}
 	}
 
 	// Return the tokens
-	return &lex{tokens: tokens}, nil
+	return &lex{tokens: tokens, end: len(input)}, nil
 }
 
 type lex struct {
 	tokens []token
+	end    int
 	filter Filter
+
+	// next is the index of the next token to be returned, and last is the
+	// index of the last token returned to the parser
+	next, last int
+
+	// err is set if a token couldn't be converted for the parser
+	err error
 }
 
 func (l *lex) Lex(lval *yySymType) int {
-	// If we didn't parse any tokens, return 0
-	if len(l.tokens) == 0 {
-		return 0
+	l.last = l.next
+
+	// If we ran out of tokens, return 0
+	if l.next >= len(l.tokens) {
+		return int(tokEOF)
 	}
 
-	// Pop the first token from the list
-	v := l.tokens[0]
-	l.tokens = l.tokens[1:]
+	// Pop the next token from the list
+	v := l.tokens[l.next]
+	l.next++
 
 	// Process the token depending on type
 	switch v.typ {
@@ -190,21 +329,79 @@ func (l *lex) Lex(lval *yySymType) int {
 	case tokTag:
 		lval.tag = v.value
 
-	// If the token is a value, convert it to an integer and store it in the
-	// destination struct
+	// If the token is a tag tree, strip the trailing wildcard and store the
+	// name in the destination struct
+	case tokTree:
+		lval.tag = strings.TrimSuffix(v.value, TagSeparator+"*")
+
+	// If the token is a value, convert it to it's typed representation and
+	// store it in the destination struct
 	case tokVal:
-		n, err := strconv.Atoi(v.value)
+		val, err := parseLiteral(v.value)
 		if err != nil {
-			// TODO: Find a way to handle gracefully
-			log.Fatal("tagger: invalid integer value")
+			// Stop the parser by pretending the input ended, and report the
+			// invalid literal
+			l.err = &ParseError{Offset: v.pos, Token: v.value, Err: ErrInvalidLiteral}
+			return int(tokEOF)
 		}
-		lval.val = n
+		lval.val = val
 	}
 
 	// Return the type of the tag
 	return int(v.typ)
 }
 
-func (l *lex) Error(e string) {
-	log.Fatal(e)
+// Error is called by the parser on a syntax error. The error is built by
+// parseError once the parser returns, so the message is ignored.
+func (l *lex) Error(e string) {}
+
+// parseError constructs a ParseError describing the token that caused the
+// parser to fail
+func (l *lex) parseError() *ParseError {
+	err := &ParseError{Offset: l.end, Expected: make([]string, 0)}
+	if l.last < len(l.tokens) {
+		err.Offset = l.tokens[l.last].pos
+		err.Token = l.tokens[l.last].value
+	}
+
+	for _, typ := range l.expected(l.last) {
+		err.Expected = append(err.Expected, typ.describe())
+	}
+
+	return err
+}
+
+// candidates are the tokens tried by expected, along with an example value
+var candidates = []token{
+	{typ: tokLparen, value: "("},
+	{typ: tokRparen, value: ")"},
+	{typ: tokAnd, value: "&&"},
+	{typ: tokOr, value: "||"},
+	{typ: tokNot, value: "!"},
+	{typ: tokAll, value: "all "},
+	{typ: tokComp, value: "=="},
+	{typ: tokTag, value: "tag"},
+	{typ: tokVal, value: "0"},
+}
+
+// expected finds the token types the parser would accept after the first n
+// tokens. It does so by parsing the first n tokens followed by each candidate
+// token, which is accepted if the parser doesn't fail on the candidate itself.
+func (l *lex) expected(n int) []tokenType {
+	types := make([]tokenType, 0)
+
+	for _, candidate := range candidates {
+		tokens := append(append(make([]token, 0, n+1), l.tokens[:n]...), candidate)
+		trial := &lex{tokens: tokens}
+		if yyParse(trial) == 0 || trial.last > n {
+			types = append(types, candidate.typ)
+		}
+	}
+
+	// Finally check whether the input could have ended here
+	if yyParse(&lex{tokens: l.tokens[:n]}) == 0 {
+		types = append(types, tokEOF)
+	}
+
+	return types
 }
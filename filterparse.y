@@ -5,17 +5,21 @@ package tagger
 %union{
 	filter Filter
 	tag string
-	val int
+	val interface{}
 	comp Comparator
 }
 
-%token TAG VAL COMP
-%token AND OR
+%token TAG TREE VAL COMP
+%token AND OR NOT ALL
 %token LPAREN RPAREN
 
-%type <filter> expr paren and_expr or_expr comp tag
+%left OR
+%left AND
+%right NOT
+
+%type <filter> expr paren and_expr or_expr not_expr comp tag
 %type <val> VAL
-%type <tag> TAG
+%type <tag> TAG TREE
 %type <comp> COMP
 
 %%
@@ -27,6 +31,7 @@ expr:
 	paren
 |	and_expr
 |	or_expr
+|	not_expr
 |	comp
 |	tag
 
@@ -34,23 +39,29 @@ paren:
 	LPAREN expr RPAREN { $$ = $2 }
 
 and_expr:
-	and_expr AND expr
-	{
-		$$ = AndFilter{Filters: append($1.(AndFilter).Filters, $3)}	
-	}
-|	expr AND expr
+	expr AND expr
 	{
-		$$ = AndFilter{Filters: []Filter{$1, $3}}
+		if and, ok := $1.(AndFilter); ok {
+			$$ = AndFilter{Filters: append(and.Filters, $3)}
+		} else {
+			$$ = AndFilter{Filters: []Filter{$1, $3}}
+		}
 	}
 
 or_expr:
-	or_expr OR expr
+	expr OR expr
 	{
-		$$ = OrFilter{Filters: append($1.(OrFilter).Filters, $3)}	
+		if or, ok := $1.(OrFilter); ok {
+			$$ = OrFilter{Filters: append(or.Filters, $3)}
+		} else {
+			$$ = OrFilter{Filters: []Filter{$1, $3}}
+		}
 	}
-|	expr OR expr
+
+not_expr:
+	NOT expr
 	{
-		$$ = OrFilter{Filters: []Filter{$1, $3}}
+		$$ = NotFilter{Filter: $2}
 	}
 
 comp:
@@ -58,12 +69,19 @@ comp:
 	{
 		$$ = ComparinsonFilter{Name: $1, Value: $3, Function: $2}
 	}
+|	ALL TAG COMP VAL
+	{
+		$$ = ComparinsonFilter{Name: $2, Value: $4, Function: $3, All: true}
+	}
 
 tag:
 	TAG
 	{
 		$$ = NameFilter{Name: $1}
 	}
+|	TREE
+	{
+		$$ = NameFilter{Name: $1, Descendants: true}
+	}
 
 %%
-
@@ -1,126 +1,163 @@
+// Code generated by goyacc -o filterparse_gen.go filterparse.y. DO NOT EDIT.
+
 //line filterparse.y:2
 package tagger
 
 import __yyfmt__ "fmt"
 
 //line filterparse.y:2
+
 //line filterparse.y:5
 type yySymType struct {
 	yys    int
 	filter Filter
 	tag    string
-	val    int
+	val    interface{}
 	comp   Comparator
 }
 
 const TAG = 57346
-const VAL = 57347
-const COMP = 57348
-const AND = 57349
-const OR = 57350
-const LPAREN = 57351
-const RPAREN = 57352
-
-var yyToknames = []string{
+const TREE = 57347
+const VAL = 57348
+const COMP = 57349
+const AND = 57350
+const OR = 57351
+const NOT = 57352
+const ALL = 57353
+const LPAREN = 57354
+const RPAREN = 57355
+
+var yyToknames = [...]string{
+	"$end",
+	"error",
+	"$unk",
 	"TAG",
+	"TREE",
 	"VAL",
 	"COMP",
 	"AND",
 	"OR",
+	"NOT",
+	"ALL",
 	"LPAREN",
 	"RPAREN",
 }
-var yyStatenames = []string{}
+
+var yyStatenames = [...]string{}
 
 const yyEofCode = 1
 const yyErrCode = 2
-const yyMaxDepth = 200
+const yyInitialStackSize = 16
 
-//line filterparse.y:68
+//line filterparse.y:87
 
 //line yacctab:1
-var yyExca = []int{
+var yyExca = [...]int8{
 	-1, 1,
 	1, -1,
 	-2, 0,
 }
 
-const yyNprod = 14
 const yyPrivate = 57344
 
-var yyTokenNames []string
-var yyStates []string
-
-const yyLast = 23
+const yyLast = 28
 
-var yyAct = []int{
-
-	2, 10, 11, 9, 20, 10, 11, 12, 8, 14,
-	13, 16, 17, 18, 19, 15, 21, 1, 7, 6,
-	5, 4, 3,
+var yyAct = [...]int8{
+	2, 11, 13, 14, 15, 25, 14, 10, 12, 9,
+	16, 17, 14, 15, 24, 20, 21, 22, 18, 23,
+	19, 1, 8, 7, 6, 5, 4, 3,
 }
-var yyPact = []int{
 
-	-1, -1000, -2, -1000, 0, 2, -1000, -1000, -1, 9,
-	-1, -1, -1, -1, -6, 11, -2, -2, -2, -2,
-	-1000, -1000,
+var yyPact = [...]int16{
+	-3, -1000, -5, -1000, -1000, -1000, -1000, -1000, -1000, -3,
+	-3, 11, 16, -1000, -3, -3, 4, -1000, 13, 7,
+	-1000, -2, -1000, -1000, -1, -1000,
 }
-var yyPgo = []int{
 
-	0, 0, 22, 21, 20, 19, 18, 17,
+var yyPgo = [...]int8{
+	0, 0, 27, 26, 25, 24, 23, 22, 21,
 }
-var yyR1 = []int{
 
-	0, 7, 1, 1, 1, 1, 1, 2, 3, 3,
-	4, 4, 5, 6,
+var yyR1 = [...]int8{
+	0, 8, 1, 1, 1, 1, 1, 1, 2, 3,
+	4, 5, 6, 6, 7, 7,
 }
-var yyR2 = []int{
 
-	0, 1, 1, 1, 1, 1, 1, 3, 3, 3,
-	3, 3, 3, 1,
+var yyR2 = [...]int8{
+	0, 1, 1, 1, 1, 1, 1, 1, 3, 3,
+	3, 2, 3, 4, 1, 1,
 }
-var yyChk = []int{
 
-	-1000, -7, -1, -2, -3, -4, -5, -6, 9, 4,
-	7, 8, 7, 8, -1, 6, -1, -1, -1, -1,
-	10, 5,
+var yyChk = [...]int16{
+	-1000, -8, -1, -2, -3, -4, -5, -6, -7, 12,
+	10, 4, 11, 5, 8, 9, -1, -1, 7, 4,
+	-1, -1, 13, 6, 7, 6,
 }
-var yyDef = []int{
 
-	0, -2, 1, 2, 3, 4, 5, 6, 0, 13,
-	0, 0, 0, 0, 0, 0, 9, 11, 8, 10,
-	7, 12,
+var yyDef = [...]int8{
+	0, -2, 1, 2, 3, 4, 5, 6, 7, 0,
+	0, 14, 0, 15, 0, 0, 0, 11, 0, 0,
+	9, 10, 8, 12, 0, 13,
 }
-var yyTok1 = []int{
 
+var yyTok1 = [...]int8{
 	1,
 }
-var yyTok2 = []int{
 
-	2, 3, 4, 5, 6, 7, 8, 9, 10,
+var yyTok2 = [...]int8{
+	2, 3, 4, 5, 6, 7, 8, 9, 10, 11,
+	12, 13,
 }
-var yyTok3 = []int{
+
+var yyTok3 = [...]int8{
 	0,
 }
 
+var yyErrorMessages = [...]struct {
+	state int
+	token int
+	msg   string
+}{}
+
 //line yaccpar:1
 
 /*	parser for yacc output	*/
 
-var yyDebug = 0
+var (
+	yyDebug        = 0
+	yyErrorVerbose = false
+)
 
 type yyLexer interface {
 	Lex(lval *yySymType) int
 	Error(s string)
 }
 
+type yyParser interface {
+	Parse(yyLexer) int
+	Lookahead() int
+}
+
+type yyParserImpl struct {
+	lval  yySymType
+	stack [yyInitialStackSize]yySymType
+	char  int
+}
+
+func (p *yyParserImpl) Lookahead() int {
+	return p.char
+}
+
+func yyNewParser() yyParser {
+	return &yyParserImpl{}
+}
+
 const yyFlag = -1000
 
 func yyTokname(c int) string {
-	// 4 is TOKSTART above
-	if c >= 4 && c-4 < len(yyToknames) {
-		if yyToknames[c-4] != "" {
-			return yyToknames[c-4]
+	if c >= 1 && c-1 < len(yyToknames) {
+		if yyToknames[c-1] != "" {
+			return yyToknames[c-1]
 		}
 	}
 	return __yyfmt__.Sprintf("tok-%v", c)
@@ -135,51 +172,127 @@ func yyStatname(s int) string {
 	return __yyfmt__.Sprintf("state-%v", s)
 }
 
-func yylex1(lex yyLexer, lval *yySymType) int {
-	c := 0
-	char := lex.Lex(lval)
+func yyErrorMessage(state, lookAhead int) string {
+	const TOKSTART = 4
+
+	if !yyErrorVerbose {
+		return "syntax error"
+	}
+
+	for _, e := range yyErrorMessages {
+		if e.state == state && e.token == lookAhead {
+			return "syntax error: " + e.msg
+		}
+	}
+
+	res := "syntax error: unexpected " + yyTokname(lookAhead)
+
+	// To match Bison, suggest at most four expected tokens.
+	expected := make([]int, 0, 4)
+
+	// Look for shiftable tokens.
+	base := int(yyPact[state])
+	for tok := TOKSTART; tok-1 < len(yyToknames); tok++ {
+		if n := base + tok; n >= 0 && n < yyLast && int(yyChk[int(yyAct[n])]) == tok {
+			if len(expected) == cap(expected) {
+				return res
+			}
+			expected = append(expected, tok)
+		}
+	}
+
+	if yyDef[state] == -2 {
+		i := 0
+		for yyExca[i] != -1 || int(yyExca[i+1]) != state {
+			i += 2
+		}
+
+		// Look for tokens that we accept or reduce.
+		for i += 2; yyExca[i] >= 0; i += 2 {
+			tok := int(yyExca[i])
+			if tok < TOKSTART || yyExca[i+1] == 0 {
+				continue
+			}
+			if len(expected) == cap(expected) {
+				return res
+			}
+			expected = append(expected, tok)
+		}
+
+		// If the default action is to accept or reduce, give up.
+		if yyExca[i+1] != 0 {
+			return res
+		}
+	}
+
+	for i, tok := range expected {
+		if i == 0 {
+			res += ", expecting "
+		} else {
+			res += " or "
+		}
+		res += yyTokname(tok)
+	}
+	return res
+}
+
+func yylex1(lex yyLexer, lval *yySymType) (char, token int) {
+	token = 0
+	char = lex.Lex(lval)
 	if char <= 0 {
-		c = yyTok1[0]
+		token = int(yyTok1[0])
 		goto out
 	}
 	if char < len(yyTok1) {
-		c = yyTok1[char]
+		token = int(yyTok1[char])
 		goto out
 	}
 	if char >= yyPrivate {
 		if char < yyPrivate+len(yyTok2) {
-			c = yyTok2[char-yyPrivate]
+			token = int(yyTok2[char-yyPrivate])
 			goto out
 		}
 	}
 	for i := 0; i < len(yyTok3); i += 2 {
-		c = yyTok3[i+0]
-		if c == char {
-			c = yyTok3[i+1]
+		token = int(yyTok3[i+0])
+		if token == char {
+			token = int(yyTok3[i+1])
 			goto out
 		}
 	}
 
 out:
-	if c == 0 {
-		c = yyTok2[1] /* unknown char */
+	if token == 0 {
+		token = int(yyTok2[1]) /* unknown char */
 	}
 	if yyDebug >= 3 {
-		__yyfmt__.Printf("lex %s(%d)\n", yyTokname(c), uint(char))
+		__yyfmt__.Printf("lex %s(%d)\n", yyTokname(token), uint(char))
 	}
-	return c
+	return char, token
 }
 
 func yyParse(yylex yyLexer) int {
+	return yyNewParser().Parse(yylex)
+}
+
+func (yyrcvr *yyParserImpl) Parse(yylex yyLexer) int {
 	var yyn int
-	var yylval yySymType
 	var yyVAL yySymType
-	yyS := make([]yySymType, yyMaxDepth)
+	var yyDollar []yySymType
+	_ = yyDollar // silence set and not used
+	yyS := yyrcvr.stack[:]
 
 	Nerrs := 0   /* number of errors */
 	Errflag := 0 /* error recovery flag */
 	yystate := 0
-	yychar := -1
+	yyrcvr.char = -1
+	yytoken := -1 // yyrcvr.char translated into internal numbering
+	defer func() {
+		// Make sure we report no lookahead when not parsing.
+		yystate = -1
+		yyrcvr.char = -1
+		yytoken = -1
+	}()
 	yyp := -1
 	goto yystack
 
@@ -192,7 +305,7 @@ ret1:
 yystack:
 	/* put a state and value onto the stack */
 	if yyDebug >= 4 {
-		__yyfmt__.Printf("char %v in %v\n", yyTokname(yychar), yyStatname(yystate))
+		__yyfmt__.Printf("char %v in %v\n", yyTokname(yytoken), yyStatname(yystate))
 	}
 
 	yyp++
@@ -205,21 +318,22 @@ yystack:
 	yyS[yyp].yys = yystate
 
 yynewstate:
-	yyn = yyPact[yystate]
+	yyn = int(yyPact[yystate])
 	if yyn <= yyFlag {
 		goto yydefault /* simple state */
 	}
-	if yychar < 0 {
-		yychar = yylex1(yylex, &yylval)
+	if yyrcvr.char < 0 {
+		yyrcvr.char, yytoken = yylex1(yylex, &yyrcvr.lval)
 	}
-	yyn += yychar
+	yyn += yytoken
 	if yyn < 0 || yyn >= yyLast {
 		goto yydefault
 	}
-	yyn = yyAct[yyn]
-	if yyChk[yyn] == yychar { /* valid shift */
-		yychar = -1
-		yyVAL = yylval
+	yyn = int(yyAct[yyn])
+	if int(yyChk[yyn]) == yytoken { /* valid shift */
+		yyrcvr.char = -1
+		yytoken = -1
+		yyVAL = yyrcvr.lval
 		yystate = yyn
 		if Errflag > 0 {
 			Errflag--
@@ -229,27 +343,27 @@ yynewstate:
 
 yydefault:
 	/* default state action */
-	yyn = yyDef[yystate]
+	yyn = int(yyDef[yystate])
 	if yyn == -2 {
-		if yychar < 0 {
-			yychar = yylex1(yylex, &yylval)
+		if yyrcvr.char < 0 {
+			yyrcvr.char, yytoken = yylex1(yylex, &yyrcvr.lval)
 		}
 
 		/* look through exception table */
 		xi := 0
 		for {
-			if yyExca[xi+0] == -1 && yyExca[xi+1] == yystate {
+			if yyExca[xi+0] == -1 && int(yyExca[xi+1]) == yystate {
 				break
 			}
 			xi += 2
 		}
 		for xi += 2; ; xi += 2 {
-			yyn = yyExca[xi+0]
-			if yyn < 0 || yyn == yychar {
+			yyn = int(yyExca[xi+0])
+			if yyn < 0 || yyn == yytoken {
 				break
 			}
 		}
-		yyn = yyExca[xi+1]
+		yyn = int(yyExca[xi+1])
 		if yyn < 0 {
 			goto ret0
 		}
@@ -258,11 +372,11 @@ yydefault:
 		/* error ... attempt to resume parsing */
 		switch Errflag {
 		case 0: /* brand new error */
-			yylex.Error("syntax error")
+			yylex.Error(yyErrorMessage(yystate, yytoken))
 			Nerrs++
 			if yyDebug >= 1 {
 				__yyfmt__.Printf("%s", yyStatname(yystate))
-				__yyfmt__.Printf(" saw %s\n", yyTokname(yychar))
+				__yyfmt__.Printf(" saw %s\n", yyTokname(yytoken))
 			}
 			fallthrough
 
@@ -271,10 +385,10 @@ yydefault:
 
 			/* find a state where "error" is a legal shift action */
 			for yyp >= 0 {
-				yyn = yyPact[yyS[yyp].yys] + yyErrCode
+				yyn = int(yyPact[yyS[yyp].yys]) + yyErrCode
 				if yyn >= 0 && yyn < yyLast {
-					yystate = yyAct[yyn] /* simulate a shift of "error" */
-					if yyChk[yystate] == yyErrCode {
+					yystate = int(yyAct[yyn]) /* simulate a shift of "error" */
+					if int(yyChk[yystate]) == yyErrCode {
 						goto yystack
 					}
 				}
@@ -290,12 +404,13 @@ yydefault:
 
 		case 3: /* no shift yet; clobber input char */
 			if yyDebug >= 2 {
-				__yyfmt__.Printf("error recovery discards %s\n", yyTokname(yychar))
+				__yyfmt__.Printf("error recovery discards %s\n", yyTokname(yytoken))
 			}
-			if yychar == yyEofCode {
+			if yytoken == yyEofCode {
 				goto ret1
 			}
-			yychar = -1
+			yyrcvr.char = -1
+			yytoken = -1
 			goto yynewstate /* try again in the same state */
 		}
 	}
@@ -309,74 +424,93 @@ yydefault:
 	yypt := yyp
 	_ = yypt // guard against "declared and not used"
 
-	yyp -= yyR2[yyn]
+	yyp -= int(yyR2[yyn])
+	// yyp is now the index of $0. Perform the default action. Iff the
+	// reduced production is ε, $1 is possibly out of range.
+	if yyp+1 >= len(yyS) {
+		nyys := make([]yySymType, len(yyS)*2)
+		copy(nyys, yyS)
+		yyS = nyys
+	}
 	yyVAL = yyS[yyp+1]
 
 	/* consult goto table to find next state */
-	yyn = yyR1[yyn]
-	yyg := yyPgo[yyn]
+	yyn = int(yyR1[yyn])
+	yyg := int(yyPgo[yyn])
 	yyj := yyg + yyS[yyp].yys + 1
 
 	if yyj >= yyLast {
-		yystate = yyAct[yyg]
+		yystate = int(yyAct[yyg])
 	} else {
-		yystate = yyAct[yyj]
-		if yyChk[yystate] != -yyn {
-			yystate = yyAct[yyg]
+		yystate = int(yyAct[yyj])
+		if int(yyChk[yystate]) != -yyn {
+			yystate = int(yyAct[yyg])
 		}
 	}
 	// dummy call; replaced with literal code
 	switch yynt {
 
 	case 1:
-		//line filterparse.y:24
-		{
-			yylex.(*lex).filter = yyS[yypt-0].filter
-		}
-	case 2:
-		yyVAL.filter = yyS[yypt-0].filter
-	case 3:
-		yyVAL.filter = yyS[yypt-0].filter
-	case 4:
-		yyVAL.filter = yyS[yypt-0].filter
-	case 5:
-		yyVAL.filter = yyS[yypt-0].filter
-	case 6:
-		yyVAL.filter = yyS[yypt-0].filter
-	case 7:
-		//line filterparse.y:34
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line filterparse.y:28
 		{
-			yyVAL.filter = yyS[yypt-1].filter
+			yylex.(*lex).filter = yyDollar[1].filter
 		}
 	case 8:
-		//line filterparse.y:38
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line filterparse.y:39
 		{
-			yyVAL.filter = AndFilter{Filters: append(yyS[yypt-2].filter.(AndFilter).Filters, yyS[yypt-0].filter)}
+			yyVAL.filter = yyDollar[2].filter
 		}
 	case 9:
-		//line filterparse.y:42
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line filterparse.y:43
 		{
-			yyVAL.filter = AndFilter{Filters: []Filter{yyS[yypt-2].filter, yyS[yypt-0].filter}}
+			if and, ok := yyDollar[1].filter.(AndFilter); ok {
+				yyVAL.filter = AndFilter{Filters: append(and.Filters, yyDollar[3].filter)}
+			} else {
+				yyVAL.filter = AndFilter{Filters: []Filter{yyDollar[1].filter, yyDollar[3].filter}}
+			}
 		}
 	case 10:
-		//line filterparse.y:48
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line filterparse.y:53
 		{
-			yyVAL.filter = OrFilter{Filters: append(yyS[yypt-2].filter.(OrFilter).Filters, yyS[yypt-0].filter)}
+			if or, ok := yyDollar[1].filter.(OrFilter); ok {
+				yyVAL.filter = OrFilter{Filters: append(or.Filters, yyDollar[3].filter)}
+			} else {
+				yyVAL.filter = OrFilter{Filters: []Filter{yyDollar[1].filter, yyDollar[3].filter}}
+			}
 		}
 	case 11:
-		//line filterparse.y:52
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line filterparse.y:63
 		{
-			yyVAL.filter = OrFilter{Filters: []Filter{yyS[yypt-2].filter, yyS[yypt-0].filter}}
+			yyVAL.filter = NotFilter{Filter: yyDollar[2].filter}
 		}
 	case 12:
-		//line filterparse.y:58
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line filterparse.y:69
 		{
-			yyVAL.filter = ComparinsonFilter{Name: yyS[yypt-2].tag, Value: yyS[yypt-0].val, Function: yyS[yypt-1].comp}
+			yyVAL.filter = ComparinsonFilter{Name: yyDollar[1].tag, Value: yyDollar[3].val, Function: yyDollar[2].comp}
 		}
 	case 13:
-		//line filterparse.y:64
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line filterparse.y:73
+		{
+			yyVAL.filter = ComparinsonFilter{Name: yyDollar[2].tag, Value: yyDollar[4].val, Function: yyDollar[3].comp, All: true}
+		}
+	case 14:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line filterparse.y:79
+		{
+			yyVAL.filter = NameFilter{Name: yyDollar[1].tag}
+		}
+	case 15:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line filterparse.y:83
 		{
-			yyVAL.filter = NameFilter{Name: yyS[yypt-0].tag}
+			yyVAL.filter = NameFilter{Name: yyDollar[1].tag, Descendants: true}
 		}
 	}
 	goto yystack /* stack new state and value */
@@ -0,0 +1,111 @@
+package tagger
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFilterStringRoundTrip(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"!a", "!a"},
+		{"photo && !reviewed", "(photo && !reviewed)"},
+		{"!(a || b)", "!(a || b)"},
+		{"!a || b && !c", "(!a || (b && !c))"},
+		{"!(a && b) || c", "(!(a && b) || c)"},
+		{"!!a", "!!a"},
+		{"!(a || !b) && (c || !(d && e))", "(!(a || !b) && (c || !(d && e)))"},
+		{"!(n > 1)", "!n > 1"},
+	}
+
+	for _, test := range tests {
+		f, err := ParseFilter(strings.NewReader(test.input))
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %s", test.input, err)
+			continue
+		}
+		if f.String() != test.want {
+			t.Errorf("ParseFilter(%q) returned %s, want %s", test.input, f, test.want)
+		}
+
+		// The string parses back to the same filter
+		g, err := ParseFilter(strings.NewReader(f.String()))
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %s", f.String(), err)
+			continue
+		}
+		if !reflect.DeepEqual(f, g) {
+			t.Errorf("%q parses to %#v, want %#v", f.String(), g, f)
+		}
+	}
+}
+
+func TestParseFilterKeywords(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"done == true", "done == true"},
+		{"done != false", "done != false"},
+		{"all n > 1", "all n > 1"},
+		{"all\tn>1", "all n > 1"},
+		// Keywords followed by more of a tag name are tags
+		{"true-crime", "true-crime"},
+		{"falsehood && x", "(falsehood && x)"},
+		{"alligator > 1", "alligator > 1"},
+		// all is a tag unless a comparison follows
+		{"all && x", "(all && x)"},
+		{"all", "all"},
+		{"!all || x", "(!all || x)"},
+	}
+
+	for _, test := range tests {
+		f, err := ParseFilter(strings.NewReader(test.input))
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %s", test.input, err)
+			continue
+		}
+		if f.String() != test.want {
+			t.Errorf("ParseFilter(%q) returned %s, want %s", test.input, f, test.want)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		offset   int
+		token    string
+		expected []string
+	}{
+		// An unexpected token
+		{"a && && b", 5, "&&", []string{`"("`, `"!"`, `"all"`, "tag"}},
+		{"a b", 2, "b", []string{`"&&"`, `"||"`, "comparator", "end of input"}},
+		// Input ending early
+		{"a &&", 4, "", []string{`"("`, `"!"`, `"all"`, "tag"}},
+		{"(a || b", 7, "", []string{`")"`, `"&&"`, `"||"`, "comparator"}},
+		// Invalid characters, which are reported whole
+		{"a # b", 2, "#", nil},
+		{"a && é", 5, "é", nil},
+		{"日本", 0, "日", nil},
+	}
+
+	for _, test := range tests {
+		_, err := ParseFilter(strings.NewReader(test.input))
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("ParseFilter(%q) returned %v, want a ParseError", test.input, err)
+			continue
+		}
+		if perr.Offset != test.offset || perr.Token != test.token {
+			t.Errorf("ParseFilter(%q) failed at %d on %q, want %d on %q", test.input, perr.Offset, perr.Token, test.offset, test.token)
+		}
+		if fmt.Sprintf("%q", perr.Expected) != fmt.Sprintf("%q", test.expected) {
+			t.Errorf("ParseFilter(%q) expected %q, want %q", test.input, perr.Expected, test.expected)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package tagger
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+// HashFile computes the content hash of the file at the given path
+func HashFile(path string) (ContentHash, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ContentHash{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return ContentHash{}, err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ContentHash{}, err
+	}
+
+	return ContentHash{
+		Sum:     hex.EncodeToString(h.Sum(nil)),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}, nil
+}
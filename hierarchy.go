@@ -0,0 +1,68 @@
+package tagger
+
+import (
+	"sort"
+	"strings"
+)
+
+// TagSeparator separates the levels of a hierarchical tag name, such as
+// "project/tagger/bugs"
+const TagSeparator = "/"
+
+// ParentTag returns the name of the parent of a hierarchical tag, and false
+// if the tag is at the top of the hierarchy
+func ParentTag(name string) (string, bool) {
+	i := strings.LastIndex(name, TagSeparator)
+	if i < 0 {
+		return "", false
+	}
+	return name[:i], true
+}
+
+// TagAncestors returns the names of all ancestors of a tag, starting with
+// it's parent
+func TagAncestors(name string) []string {
+	ancestors := make([]string, 0)
+	for parent, ok := ParentTag(name); ok; parent, ok = ParentTag(parent) {
+		ancestors = append(ancestors, parent)
+	}
+	return ancestors
+}
+
+// IsDescendantOf checks whether a tag is below the given ancestor in the tag
+// hierarchy. A tag is not a descendant of itself.
+func IsDescendantOf(name, ancestor string) bool {
+	return strings.HasPrefix(name, ancestor+TagSeparator)
+}
+
+// ChildTags returns the sorted names of the direct children of parent among
+// the given tag names. A child is included even if only it's descendants
+// are among the names. The top level tags are returned if parent is empty.
+func ChildTags(names []string, parent string) []string {
+	prefix := ""
+	if parent != "" {
+		prefix = parent + TagSeparator
+	}
+
+	seen := make(map[string]bool)
+	children := make([]string, 0)
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) || len(name) == len(prefix) {
+			continue
+		}
+
+		// Cut the name after the first level below the parent
+		child := name
+		if i := strings.Index(name[len(prefix):], TagSeparator); i >= 0 {
+			child = name[:len(prefix)+i]
+		}
+
+		if !seen[child] {
+			seen[child] = true
+			children = append(children, child)
+		}
+	}
+
+	sort.Strings(children)
+	return children
+}
@@ -0,0 +1,207 @@
+package tagger
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Rule describes a tag that is implied by other tags. Whenever the tags of a
+// file match the condition of a rule, the implied tag is added to the file.
+type Rule struct {
+	// ID identifies the rule in storage
+	ID        int
+	Condition Filter
+	Implies   Tag
+}
+
+// ParseRule parses a rule of the form "condition => tag" or
+// "condition => tag = value", where the condition uses the filter language
+// described by ParseFilter and the value uses the same syntax as values in
+// filters.
+//
+// Examples of rules:
+// "cat => animal"
+// "year >= 2000 => modern"
+// "camera == \"x100\" => brand = \"fujifilm\""
+func ParseRule(s string) (Rule, error) {
+	i := strings.Index(s, "=>")
+	if i < 0 {
+		return Rule{}, makeErr("rule", "missing =>")
+	}
+
+	// Parse the condition
+	cond, err := ParseFilter(strings.NewReader(s[:i]))
+	if err != nil {
+		return Rule{}, err
+	}
+
+	// Parse the implied tag, which may have a value
+	if strings.TrimSpace(s[i+2:]) == "" {
+		return Rule{}, makeErr("rule", "missing implied tag")
+	}
+	tag, err := ParseTag(s[i+2:])
+	if err != nil {
+		return Rule{}, err
+	}
+
+	return Rule{Condition: cond, Implies: tag}, nil
+}
+
+// ParseTag parses a tag of the form "name" or "name = value", where the value
+// uses the same syntax as values in filters
+func ParseTag(s string) (Tag, error) {
+	name, value := strings.TrimSpace(s), ""
+	if j := strings.Index(s, "="); j >= 0 {
+		name, value = strings.TrimSpace(s[:j]), strings.TrimSpace(s[j+1:])
+	}
+
+	if name == "" {
+		return nil, makeErr("tag", "missing tag name")
+	}
+
+	if value == "" {
+		return NewNamedTag(name), nil
+	}
+
+	v, err := parseLiteral(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w in tag: %q", ErrInvalidLiteral, value)
+	}
+	return tagFromValue(name, v), nil
+}
+
+func (r Rule) String() string {
+	if r.Implies.HasValue() {
+		return fmt.Sprintf("%s => %s = %s", r.Condition, r.Implies.Name(), FormatValue(TagValue(r.Implies)))
+	}
+	return fmt.Sprintf("%s => %s", r.Condition, r.Implies.Name())
+}
+
+// tagFromValue creates a tag holding a value of one of the types returned by
+// TagValue
+func tagFromValue(name string, v interface{}) Tag {
+	switch v := v.(type) {
+	case int:
+		return NewValueTag(name, v)
+	case string:
+		return NewStringTag(name, v)
+	case float64:
+		return NewFloatTag(name, v)
+	case time.Time:
+		return NewDateTag(name, v)
+	case bool:
+		return NewBoolTag(name, v)
+	}
+	return NewNamedTag(name)
+}
+
+// ImpliedTags returns the tags implied by the given tags under a set of
+// rules. Rules are applied repeatedly, so tags implied by other implied tags
+// are included. Tags that are already present are not returned.
+func ImpliedTags(rules []Rule, tags []Tag) []Tag {
+	current := append(make([]Tag, 0, len(tags)), tags...)
+	implied := make([]Tag, 0)
+
+	for changed := true; changed; {
+		changed = false
+		for _, rule := range rules {
+			if hasTag(current, rule.Implies) || !rule.Condition.Matches(current) {
+				continue
+			}
+
+			current = append(current, rule.Implies)
+			implied = append(implied, rule.Implies)
+			changed = true
+		}
+	}
+
+	return implied
+}
+
+// hasTag checks whether a tag with the same name and value is in the tags
+func hasTag(tags []Tag, t Tag) bool {
+	for _, tag := range tags {
+		if tag.Name() == t.Name() && tag.Kind() == t.Kind() && TagValue(tag) == TagValue(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckRules returns ErrRuleCycle if a tag implied by a rule can, directly
+// or through other rules, cause the rule to be applied again.
+func CheckRules(rules []Rule) error {
+	// Rule i triggers rule j if the tag implied by i is mentioned in the
+	// condition of j
+	triggers := make([][]int, len(rules))
+	for i, a := range rules {
+		for j, b := range rules {
+			if mentionsTag(b.Condition, a.Implies.Name()) {
+				triggers[i] = append(triggers[i], j)
+			}
+		}
+	}
+
+	// Do a depth first search from every rule, looking for a path back to a
+	// rule on the current path
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(rules))
+
+	var visit func(i int) bool
+	visit = func(i int) bool {
+		state[i] = visiting
+		for _, j := range triggers[i] {
+			if state[j] == visiting || (state[j] == unvisited && visit(j)) {
+				return true
+			}
+		}
+		state[i] = visited
+		return false
+	}
+
+	for i := range rules {
+		if state[i] == unvisited && visit(i) {
+			return ErrRuleCycle
+		}
+	}
+
+	return nil
+}
+
+// mentionsTag checks whether a filter depends on the tag with the given name.
+// Filters of unknown types are assumed to depend on every tag.
+func mentionsTag(f Filter, name string) bool {
+	switch f := f.(type) {
+	case NameFilter:
+		return f.Name == name || (f.Descendants && IsDescendantOf(name, f.Name))
+
+	case ComparinsonFilter:
+		return f.Name == name
+
+	case AndFilter:
+		for _, filter := range f.Filters {
+			if mentionsTag(filter, name) {
+				return true
+			}
+		}
+		return false
+
+	case OrFilter:
+		for _, filter := range f.Filters {
+			if mentionsTag(filter, name) {
+				return true
+			}
+		}
+		return false
+
+	case NotFilter:
+		return mentionsTag(f.Filter, name)
+	}
+
+	return true
+}
@@ -0,0 +1,81 @@
+package scanner
+
+import (
+	"github.com/kiljacken/tagger"
+	"os"
+	"path/filepath"
+)
+
+// Move describes a file found at a new path by Relink
+type Move struct {
+	// From is the old path of the file
+	From string
+	// File is the file with it's new path
+	File tagger.File
+}
+
+// Relink looks for files in the directory tree at root by their content
+// hash, and moves each file found to it's new path, keeping it's tags. Files
+// without a content hash can't be found, and paths already in storage are
+// never considered. Errors reading single files or directories are returned
+// in failed, while any error from the storage stops the search.
+func Relink(p tagger.StorageProvider, root string, files []tagger.File) (moves []Move, failed []error, err error) {
+	moves = make([]Move, 0)
+	failed = make([]error, 0)
+
+	// Only files of the same size as a lost file need to be hashed
+	lost := make(map[string][]tagger.File)
+	sizes := make(map[int64]bool)
+	for _, file := range files {
+		if h, ok := file.Hash(); ok {
+			lost[h.Sum] = append(lost[h.Sum], file)
+			sizes[h.Size] = true
+		}
+	}
+
+	if len(lost) == 0 {
+		return moves, failed, nil
+	}
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			failed = append(failed, err)
+			return nil
+		}
+		if !info.Mode().IsRegular() || !sizes[info.Size()] {
+			return nil
+		}
+
+		// Skip files that are already in the database
+		if _, err := p.GetFileForPath(path); err == nil {
+			return nil
+		} else if err != tagger.ErrNoFile {
+			return err
+		}
+
+		h, err := tagger.HashFile(path)
+		if err != nil {
+			failed = append(failed, err)
+			return nil
+		}
+
+		candidates := lost[h.Sum]
+		if len(candidates) == 0 {
+			return nil
+		}
+		file := candidates[0]
+		lost[h.Sum] = candidates[1:]
+
+		// Move the file to the new path, keeping it's tags
+		moved := file.WithPath(path).WithHash(h)
+		err = p.UpdateFile(moved, []tagger.Tag{})
+		if err != nil {
+			return err
+		}
+
+		moves = append(moves, Move{From: file.Path(), File: moved})
+		return nil
+	})
+
+	return moves, failed, err
+}
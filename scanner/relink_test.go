@@ -0,0 +1,70 @@
+package scanner
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/kiljacken/tagger"
+	"github.com/kiljacken/tagger/storage"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRelink(t *testing.T) {
+	root := t.TempDir()
+	old, moved := filepath.Join(root, "a.jpg"), filepath.Join(root, "2020", "b.jpg")
+	writeTree(t, root, "a.jpg", "c.jpg")
+
+	p := storage.NewMemoryStorage()
+	h, err := tagger.HashFile(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lost := tagger.NewFile(uuid.NewUUID(), old).WithHash(h)
+	unhashed := tagger.NewFile(uuid.NewUUID(), filepath.Join(root, "d.jpg"))
+	for _, f := range []tagger.File{lost, unhashed} {
+		if err := p.UpdateFile(f, []tagger.Tag{tagger.NewNamedTag("photo")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The file is moved, next to a file of the same size with other
+	// contents
+	if err := os.MkdirAll(filepath.Dir(moved), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(old, moved); err != nil {
+		t.Fatal(err)
+	}
+
+	moves, failed, err := Relink(p, root, []tagger.File{lost, unhashed})
+	if err != nil {
+		t.Fatalf("Relink: %s", err)
+	}
+	if len(failed) != 0 {
+		t.Errorf("Relink failed on %v", failed)
+	}
+	if len(moves) != 1 || moves[0].From != old || moves[0].File.Path() != moved {
+		t.Fatalf("Relink returned %+v, want %s moved to %s", moves, old, moved)
+	}
+
+	// The file keeps it's UUID and tags at the new path
+	f, err := p.GetFileForPath(moved)
+	if err != nil {
+		t.Fatalf("GetFileForPath(%s): %s", moved, err)
+	}
+	if f.UUID().String() != lost.UUID().String() {
+		t.Errorf("Relinked file has UUID %s, want %s", f.UUID(), lost.UUID())
+	}
+	if _, err := p.GetTagValues(f, "photo"); err != nil {
+		t.Errorf("Relinked file lost it's tags: %s", err)
+	}
+	if _, err := p.GetFileForPath(old); err != tagger.ErrNoFile {
+		t.Errorf("GetFileForPath(%s) returned %v, want ErrNoFile", old, err)
+	}
+
+	// Files already stored at their path aren't found again
+	moves, _, err = Relink(p, root, []tagger.File{f})
+	if err != nil || len(moves) != 0 {
+		t.Errorf("Relink of a stored file returned %+v, %v, want no moves", moves, err)
+	}
+}
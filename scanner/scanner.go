@@ -0,0 +1,217 @@
+// Package scanner adds the files of a directory tree to a tag database
+package scanner
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"fmt"
+	"github.com/kiljacken/tagger"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GlobRule gives a default tag to the files matching a glob pattern
+type GlobRule struct {
+	Pattern string
+	Tag     tagger.Tag
+}
+
+// ParseGlobRule parses a rule of the form "pattern => tag" or
+// "pattern => tag = value", where the tag uses the syntax described by
+// tagger.ParseTag.
+//
+// Examples of rules:
+// "*.jpg => photo"
+// "*.mp3 => format = \"mp3\""
+func ParseGlobRule(s string) (GlobRule, error) {
+	i := strings.Index(s, "=>")
+	if i < 0 {
+		return GlobRule{}, fmt.Errorf("scanner: Missing => in rule: %q", s)
+	}
+
+	pattern := strings.TrimSpace(s[:i])
+	if err := checkPattern(pattern); err != nil {
+		return GlobRule{}, err
+	}
+
+	tag, err := tagger.ParseTag(s[i+2:])
+	if err != nil {
+		return GlobRule{}, err
+	}
+
+	return GlobRule{Pattern: pattern, Tag: tag}, nil
+}
+
+// Options controls which files are added by a scan, and how they are tagged.
+//
+// Patterns without a path separator are matched against the name of a file,
+// while patterns with one are matched against the path of the file relative
+// to the root of the scan.
+type Options struct {
+	// Include are the patterns of files to add. Every file is added if
+	// there are none.
+	Include []string
+	// Exclude are the patterns of files and directories to skip. The files
+	// in a skipped directory are not scanned.
+	Exclude []string
+	// Rules give default tags to the added files
+	Rules []GlobRule
+	// SkipHash disables recording the content hash of added files, which
+	// avoids reading their contents but keeps them from being relinked
+	SkipHash bool
+}
+
+// Summary counts what happened to the files found by a scan
+type Summary struct {
+	// Added is the number of files added to the database
+	Added int
+	// Known is the number of files that already were in the database
+	Known int
+	// Excluded is the number of files skipped because of the include and
+	// exclude patterns
+	Excluded int
+	// Failed lists the errors for files that couldn't be read
+	Failed []error
+}
+
+// Scan walks the directory tree at root and adds every file not already in
+// the storage, tagged with the tags of the matching rules. Files are stored
+// under their path joined with root. Errors reading single files or
+// directories are collected in the summary, while any error from the
+// storage stops the scan.
+func Scan(p tagger.StorageProvider, root string, opts Options) (Summary, error) {
+	summary := Summary{Failed: make([]error, 0)}
+
+	// Check the patterns up front, so a typo doesn't stop the scan halfway
+	patterns := make([]string, 0, len(opts.Include)+len(opts.Exclude)+len(opts.Rules))
+	patterns = append(patterns, opts.Include...)
+	patterns = append(patterns, opts.Exclude...)
+	for _, rule := range opts.Rules {
+		patterns = append(patterns, rule.Pattern)
+	}
+	for _, pattern := range patterns {
+		if err := checkPattern(pattern); err != nil {
+			return summary, err
+		}
+	}
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			summary.Failed = append(summary.Failed, err)
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			// Never skip the root itself
+			if rel != "." && opts.SkipsDir(rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		if !opts.Matches(rel) {
+			summary.Excluded++
+			return nil
+		}
+
+		// Skip files that are already in the database
+		if _, err := p.GetFileForPath(path); err == nil {
+			summary.Known++
+			return nil
+		} else if err != tagger.ErrNoFile {
+			return err
+		}
+
+		file, err := opts.NewFile(path)
+		if err != nil {
+			summary.Failed = append(summary.Failed, err)
+			return nil
+		}
+
+		if err := p.UpdateFile(file, opts.Tags(rel)); err != nil {
+			return err
+		}
+
+		summary.Added++
+		return nil
+	})
+
+	return summary, err
+}
+
+// Matches checks whether a file is added by a scan, given it's path relative
+// to the root of the scan
+func (o Options) Matches(rel string) bool {
+	return !matchAny(o.Exclude, rel) && (len(o.Include) == 0 || matchAny(o.Include, rel))
+}
+
+// SkipsDir checks whether a directory is skipped by a scan, given it's path
+// relative to the root of the scan
+func (o Options) SkipsDir(rel string) bool {
+	return matchAny(o.Exclude, rel)
+}
+
+// Tags returns the default tags of a file, given it's path relative to the
+// root of the scan
+func (o Options) Tags(rel string) []tagger.Tag {
+	tags := make([]tagger.Tag, 0)
+	for _, rule := range o.Rules {
+		if match(rule.Pattern, rel) {
+			tags = append(tags, rule.Tag)
+		}
+	}
+	return tags
+}
+
+// NewFile creates a file with a new UUID for the path, with it's content hash
+// unless SkipHash is set
+func (o Options) NewFile(path string) (tagger.File, error) {
+	file := tagger.NewFile(uuid.NewUUID(), path)
+	if o.SkipHash {
+		return file, nil
+	}
+
+	h, err := tagger.HashFile(path)
+	if err != nil {
+		return tagger.File{}, err
+	}
+	return file.WithHash(h), nil
+}
+
+// checkPattern returns an error if the glob pattern is malformed
+func checkPattern(pattern string) error {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("scanner: Invalid pattern %q: %w", pattern, err)
+	}
+	return nil
+}
+
+// match checks whether a path relative to the root of the scan matches a
+// pattern. Patterns without a separator are matched against the file name.
+func match(pattern, rel string) bool {
+	name := rel
+	if !strings.Contains(pattern, string(filepath.Separator)) {
+		name = filepath.Base(rel)
+	}
+
+	ok, _ := filepath.Match(pattern, name)
+	return ok
+}
+
+func matchAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if match(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
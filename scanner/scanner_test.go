@@ -0,0 +1,174 @@
+package scanner
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/kiljacken/tagger"
+	"github.com/kiljacken/tagger/storage"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestParseGlobRule(t *testing.T) {
+	tests := []struct {
+		rule    string
+		pattern string
+		name    string
+		value   interface{}
+	}{
+		{"*.jpg => photo", "*.jpg", "photo", nil},
+		{"  *.mp3=>format = \"mp3\" ", "*.mp3", "format", "mp3"},
+		{"music/*/*.flac => lossless", filepath.Join("music", "*", "*.flac"), "lossless", nil},
+		{"*.txt => rating = 3", "*.txt", "rating", 3},
+		{"[ab]*.md => draft = true", "[ab]*.md", "draft", true},
+	}
+
+	for _, test := range tests {
+		rule, err := ParseGlobRule(test.rule)
+		if err != nil {
+			t.Errorf("ParseGlobRule(%q): %s", test.rule, err)
+			continue
+		}
+		if rule.Pattern != test.pattern || rule.Tag.Name() != test.name || tagger.TagValue(rule.Tag) != test.value {
+			t.Errorf("ParseGlobRule(%q) returned %q => %s = %v, want %q => %s = %v", test.rule, rule.Pattern, rule.Tag.Name(), tagger.TagValue(rule.Tag), test.pattern, test.name, test.value)
+		}
+	}
+
+	for _, rule := range []string{"*.jpg", "*.jpg =>", "*.jpg => = 1", "[.jpg => photo", "*.txt => n = 1 2"} {
+		if _, err := ParseGlobRule(rule); err == nil {
+			t.Errorf("ParseGlobRule(%q) returned no error", rule)
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	opts := Options{
+		Include: []string{"*.jpg", "*.png"},
+		Exclude: []string{".*", filepath.Join("raw", "*"), "tmp"},
+	}
+
+	tests := []struct {
+		rel     string
+		matches bool
+		skips   bool
+	}{
+		{"a.jpg", true, false},
+		{filepath.Join("2020", "b.png"), true, false},
+		{"a.txt", false, false},
+		// Patterns without a separator match the name in any directory
+		{".hidden.jpg", false, true},
+		{filepath.Join("2020", ".thumbs"), false, true},
+		{"tmp", false, true},
+		{filepath.Join("2020", "tmp"), false, true},
+		// Patterns with one match the whole relative path
+		{filepath.Join("raw", "c.jpg"), false, true},
+		{filepath.Join("2020", "raw", "c.jpg"), true, false},
+	}
+
+	for _, test := range tests {
+		if got := opts.Matches(test.rel); got != test.matches {
+			t.Errorf("Matches(%q) returned %t, want %t", test.rel, got, test.matches)
+		}
+		if got := opts.SkipsDir(test.rel); got != test.skips {
+			t.Errorf("SkipsDir(%q) returned %t, want %t", test.rel, got, test.skips)
+		}
+	}
+
+	// Every file matches without include patterns
+	if !(Options{}).Matches(filepath.Join("a", "b.txt")) {
+		t.Error("Options without patterns don't match every file")
+	}
+}
+
+// writeTree creates the files at the paths relative to root
+func writeTree(t *testing.T, root string, paths ...string) {
+	t.Helper()
+	for _, path := range paths {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root,
+		"a.jpg",
+		"b.txt",
+		filepath.Join("2020", "c.jpg"),
+		filepath.Join("2020", "d.jpg"),
+		filepath.Join(".git", "e.jpg"),
+	)
+
+	p := storage.NewMemoryStorage()
+	known := tagger.NewFile(uuid.NewUUID(), filepath.Join(root, "2020", "d.jpg"))
+	if err := p.UpdateFile(known, []tagger.Tag{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rule, err := ParseGlobRule("*.jpg => photo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{
+		Include: []string{"*.jpg"},
+		Exclude: []string{".git"},
+		Rules:   []GlobRule{rule},
+	}
+
+	summary, err := Scan(p, root, opts)
+	if err != nil {
+		t.Fatalf("Scan: %s", err)
+	}
+	if summary.Added != 2 || summary.Known != 1 || summary.Excluded != 1 || len(summary.Failed) != 0 {
+		t.Errorf("Scan returned %+v, want 2 added, 1 known and 1 excluded", summary)
+	}
+
+	// Only the new files are added and tagged, and the files of skipped
+	// directories are never seen
+	files, err := p.GetAllFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		paths = append(paths, f.Path())
+		_, err := p.GetTagValues(f, "photo")
+		if photo := err == nil; photo != (f.UUID().String() != known.UUID().String()) {
+			t.Errorf("%s is tagged as a photo: %t", f.Path(), photo)
+		}
+		if _, ok := f.Hash(); !ok && f.UUID().String() != known.UUID().String() {
+			t.Errorf("%s was added without a hash", f.Path())
+		}
+	}
+	sort.Strings(paths)
+	want := []string{filepath.Join(root, "2020", "c.jpg"), filepath.Join(root, "2020", "d.jpg"), filepath.Join(root, "a.jpg")}
+	if len(paths) != len(want) {
+		t.Fatalf("Storage holds %q, want %q", paths, want)
+	}
+	for i := range want {
+		if paths[i] != want[i] {
+			t.Errorf("Storage holds %q, want %q", paths, want)
+			break
+		}
+	}
+
+	// A second scan knows every file
+	summary, err = Scan(p, root, opts)
+	if err != nil {
+		t.Fatalf("Scan: %s", err)
+	}
+	if summary.Added != 0 || summary.Known != 3 {
+		t.Errorf("Second scan returned %+v, want 3 known", summary)
+	}
+
+	// Invalid patterns are reported before anything is scanned
+	if _, err := Scan(p, root, Options{Exclude: []string{"["}}); err == nil {
+		t.Error("Scan with an invalid pattern returned no error")
+	}
+}
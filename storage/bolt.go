@@ -0,0 +1,1060 @@
+package storage
+
+import (
+	"bytes"
+	"code.google.com/p/go-uuid/uuid"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kiljacken/tagger"
+	bolt "go.etcd.io/bbolt"
+	"strings"
+	"time"
+)
+
+// BoltStorage is a storage engine backed by a bolt database, a single file
+// B+tree store written in pure Go. Files are indexed by path and content
+// hash, and tags by name and value, so most filters are answered from the
+// index.
+//
+// Only one process can have the database open at a time. Writes are
+// serialized, and a transaction holds the write lock from Begin until it is
+// committed or rolled back. A transactional view must only be used by one
+// goroutine at a time.
+type BoltStorage struct {
+	db *bolt.DB
+	// tx is the transaction of a transactional view, or nil
+	tx *bolt.Tx
+	// ctx is the context all operations check before they start
+	ctx context.Context
+}
+
+// boltTx is a transactional view of a BoltStorage
+type boltTx struct {
+	*BoltStorage
+}
+
+// boltView is a view of a BoltStorage bound to a context
+type boltView struct {
+	*BoltStorage
+}
+
+// boltData reads and changes the buckets of a bolt database within a
+// transaction
+type boltData struct {
+	tx *bolt.Tx
+}
+
+// boltLockTimeout is how long to wait for another process to close the
+// database
+const boltLockTimeout = 5 * time.Second
+
+func init() {
+	Register("bolt", func(location string) (tagger.StorageProvider, error) {
+		s, err := NewBoltStorage(location)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	})
+}
+
+// NewBoltStorage returns a new storage engine backed by the bolt database at
+// the given path, which is created if it doesn't exist
+func NewBoltStorage(path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltLockTimeout})
+	if err != nil {
+		return nil, boltErr(err)
+	}
+
+	storage := &BoltStorage{db: db, ctx: context.Background()}
+
+	// Setup the buckets
+	err = db.Update(func(tx *bolt.Tx) error {
+		return boltData{tx}.init()
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return storage, nil
+}
+
+// boltErr wraps the errors bolt returns for files that aren't valid bolt
+// databases with ErrStorageCorrupt, and the error for databases written by
+// another version of bolt with ErrSchemaMismatch
+func boltErr(err error) error {
+	switch {
+	case errors.Is(err, bolt.ErrInvalid) || errors.Is(err, bolt.ErrChecksum):
+		return fmt.Errorf("%w: %w", tagger.ErrStorageCorrupt, err)
+	case errors.Is(err, bolt.ErrVersionMismatch):
+		return fmt.Errorf("%w: %w", tagger.ErrSchemaMismatch, err)
+	}
+	return err
+}
+
+// init creates the buckets, and checks the schema version of an existing
+// database
+func (d boltData) init() error {
+	for _, name := range boltBuckets {
+		if _, err := d.tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+
+	meta := d.tx.Bucket(boltMetaBucket)
+	v := meta.Get(boltVersionKey)
+	if v == nil {
+		return meta.Put(boltVersionKey, binary.BigEndian.AppendUint64(nil, boltSchemaVersion))
+	}
+	if len(v) != 8 {
+		return fmt.Errorf("%w: Invalid schema version %x", tagger.ErrStorageCorrupt, v)
+	}
+
+	version := binary.BigEndian.Uint64(v)
+	if version > boltSchemaVersion {
+		return fmt.Errorf("%w: Version %d, expected at most %d", tagger.ErrSchemaTooNew, version, boltSchemaVersion)
+	}
+	return nil
+}
+
+// view runs the function with a read-only transaction, or the transaction of
+// a transactional view
+func (s *BoltStorage) view(fn func(d boltData) error) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	if s.tx != nil {
+		if s.tx.DB() == nil {
+			return bolt.ErrTxClosed
+		}
+		return fn(boltData{s.tx})
+	}
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(boltData{tx})
+	})
+}
+
+// update runs the function with a writable transaction, which is committed
+// if the function succeeds. If the storage is a transactional view, the
+// function is run as part of that transaction.
+func (s *BoltStorage) update(fn func(d boltData) error) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	if s.tx != nil {
+		if s.tx.DB() == nil {
+			return bolt.ErrTxClosed
+		}
+		return fn(boltData{s.tx})
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltData{tx})
+	})
+}
+
+func (s *BoltStorage) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStorage) Begin() (tagger.Tx, error) {
+	if s.tx != nil {
+		return nil, tagger.ErrNestedTx
+	}
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+
+	view := *s
+	view.tx = tx
+	return boltTx{&view}, nil
+}
+
+func (s *BoltStorage) WithContext(ctx context.Context) tagger.StorageProvider {
+	view := *s
+	view.ctx = ctx
+	return boltView{&view}
+}
+
+// Close does nothing, as the view shares the database of the storage
+func (v boltView) Close() error {
+	return nil
+}
+
+// Commit commits the changes made through the transaction
+func (t boltTx) Commit() error {
+	return t.tx.Commit()
+}
+
+// Rollback discards the changes made through the transaction
+func (t boltTx) Rollback() error {
+	return t.tx.Rollback()
+}
+
+// Close rolls back the transaction unless it has been committed. It doesn't
+// close the underlying database.
+func (t boltTx) Close() error {
+	err := t.tx.Rollback()
+	if err == bolt.ErrTxClosed {
+		return nil
+	}
+	return err
+}
+
+// fileID returns the key of a file, and false if the file doesn't have a
+// valid UUID
+func fileID(u uuid.UUID) ([]byte, bool) {
+	return []byte(u), len(u) == uuidLen
+}
+
+// file reads the file with the given key
+func (d boltData) file(id []byte) (tagger.File, bool, error) {
+	v := d.tx.Bucket(boltFilesBucket).Get(id)
+	if v == nil {
+		return tagger.File{}, false, nil
+	}
+
+	var rec boltFile
+	if err := json.Unmarshal(v, &rec); err != nil {
+		return tagger.File{}, false, fmt.Errorf("%w: Invalid file record: %w", tagger.ErrStorageCorrupt, err)
+	}
+
+	f := tagger.NewFile(uuid.UUID(append([]byte{}, id...)), rec.Path)
+	if rec.Hash != "" {
+		f = f.WithHash(tagger.ContentHash{Sum: rec.Hash, Size: rec.Size, ModTime: time.Unix(0, rec.ModTime)})
+	}
+	return f, true, nil
+}
+
+// fileFor reads the file with the key stored under a key of an index
+// bucket, and returns ErrNoFile if there is none
+func (d boltData) fileFor(bucket, key []byte) (tagger.File, error) {
+	id := d.tx.Bucket(bucket).Get(key)
+	if id == nil {
+		return tagger.File{}, tagger.ErrNoFile
+	}
+
+	f, ok, err := d.file(id)
+	if err != nil {
+		return tagger.File{}, err
+	} else if !ok {
+		return tagger.File{}, fmt.Errorf("%w: Index refers to missing file %x", tagger.ErrStorageCorrupt, id)
+	}
+	return f, nil
+}
+
+// hasFile checks whether a file is stored
+func (d boltData) hasFile(f tagger.File) bool {
+	id, ok := fileID(f.UUID())
+	return ok && d.tx.Bucket(boltFilesBucket).Get(id) != nil
+}
+
+func (s *BoltStorage) GetFile(u uuid.UUID) (tagger.File, error) {
+	var file tagger.File
+	err := s.view(func(d boltData) error {
+		id, ok := fileID(u)
+		if !ok {
+			return tagger.ErrNoFile
+		}
+
+		f, ok, err := d.file(id)
+		if err != nil {
+			return err
+		} else if !ok {
+			return tagger.ErrNoFile
+		}
+		file = f
+		return nil
+	})
+	return file, err
+}
+
+func (s *BoltStorage) GetFileForPath(path string) (tagger.File, error) {
+	var file tagger.File
+	err := s.view(func(d boltData) error {
+		var err error
+		file, err = d.fileFor(boltPathsBucket, []byte(path))
+		return err
+	})
+	return file, err
+}
+
+func (s *BoltStorage) GetFileForHash(sum string) (tagger.File, error) {
+	var file tagger.File
+	err := s.view(func(d boltData) error {
+		// The first key with the hash is the first file by path
+		prefix := hashKey(sum, "")
+		key, _ := d.tx.Bucket(boltHashesBucket).Cursor().Seek(prefix)
+		if key == nil || !bytes.HasPrefix(key, prefix) {
+			return tagger.ErrNoFile
+		}
+
+		var err error
+		file, err = d.fileFor(boltHashesBucket, key)
+		return err
+	})
+	return file, err
+}
+
+// allFiles returns every file ordered by path
+func (d boltData) allFiles() ([]tagger.File, error) {
+	files := make([]tagger.File, 0)
+	err := d.tx.Bucket(boltPathsBucket).ForEach(func(path, id []byte) error {
+		f, ok, err := d.file(id)
+		if err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("%w: Path %s refers to missing file %x", tagger.ErrStorageCorrupt, path, id)
+		}
+		files = append(files, f)
+		return nil
+	})
+	return files, err
+}
+
+func (s *BoltStorage) GetAllFiles() ([]tagger.File, error) {
+	var files []tagger.File
+	err := s.view(func(d boltData) error {
+		var err error
+		files, err = d.allFiles()
+		return err
+	})
+	return files, err
+}
+
+func (s *BoltStorage) GetMatchingFiles(f tagger.Filter) ([]tagger.File, error) {
+	var files []tagger.File
+	err := s.view(func(d boltData) error {
+		var err error
+		files, err = d.matchingFiles(f)
+		return err
+	})
+	return files, err
+}
+
+// IterateAllFiles returns the files ordered by path. The files are read all
+// at once, so the iterator doesn't keep a transaction open.
+func (s *BoltStorage) IterateAllFiles() (tagger.FileIterator, error) {
+	files, err := s.GetAllFiles()
+	if err != nil {
+		return nil, err
+	}
+	return &sliceIterator{files: files}, nil
+}
+
+// IterateMatchingFiles returns the matching files ordered by path. The files
+// are read all at once, so the iterator doesn't keep a transaction open.
+func (s *BoltStorage) IterateMatchingFiles(f tagger.Filter) (tagger.FileIterator, error) {
+	files, err := s.GetMatchingFiles(f)
+	if err != nil {
+		return nil, err
+	}
+	return &sliceIterator{files: files}, nil
+}
+
+func (s *BoltStorage) QueryFiles(f tagger.Filter, opts tagger.QueryOptions) (tagger.FileIterator, error) {
+	var files []tagger.File
+	err := s.view(func(d boltData) error {
+		var err error
+		if f == nil {
+			files, err = d.allFiles()
+		} else {
+			files, err = d.matchingFiles(f)
+		}
+		if err != nil {
+			return err
+		}
+
+		keys, err := d.sortKeys(files, opts)
+		if err != nil {
+			return err
+		}
+		sortFiles(files, keys, opts.Descending)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &sliceIterator{files: pageFiles(files, opts)}, nil
+}
+
+// sortKeys returns the values of the sort tag of the files, or nil if they
+// are ordered by path. The values are read from the index.
+func (d boltData) sortKeys(files []tagger.File, opts tagger.QueryOptions) (sortKeys, error) {
+	if opts.SortTag == "" {
+		return nil, nil
+	}
+
+	paths := make(map[string]string, len(files))
+	for _, f := range files {
+		paths[string(f.UUID())] = f.Path()
+	}
+
+	keys := make(sortKeys, len(files))
+	err := d.scanIndex(indexPrefix(d.resolveAlias(opts.SortTag)), func(id []byte, t tagger.Tag) {
+		if path, ok := paths[string(id)]; ok {
+			keys.add(path, t, opts.Descending)
+		}
+	})
+	return keys, err
+}
+
+// scanIndex calls the function with every tag in the index with a key
+// starting with the prefix
+func (d boltData) scanIndex(prefix []byte, fn func(id []byte, t tagger.Tag)) error {
+	return d.scanIndexRange(prefix, prefixEnd(prefix), fn)
+}
+
+// scanIndexRange calls the function with every tag in the index with a key
+// from lo up to, but not including, hi. A nil hi scans to the end.
+func (d boltData) scanIndexRange(lo, hi []byte, fn func(id []byte, t tagger.Tag)) error {
+	c := d.tx.Bucket(boltIndexBucket).Cursor()
+	for k, v := c.Seek(lo); k != nil && (hi == nil || bytes.Compare(k, hi) < 0); k, v = c.Next() {
+		id, t, err := parseIndexKey(k, v)
+		if err != nil {
+			return err
+		}
+		fn(id, t)
+	}
+	return nil
+}
+
+func (s *BoltStorage) UpdateTag(f tagger.File, t tagger.Tag) error {
+	return s.update(func(d boltData) error {
+		if !d.hasFile(f) {
+			return tagger.ErrNoFile
+		}
+
+		err := d.updateTag(f, t)
+		if err != nil {
+			return err
+		}
+
+		// Add any tags implied by the new tag
+		rules, err := d.canonicalRules()
+		if err != nil {
+			return err
+		}
+		return d.applyRules(f, rules)
+	})
+}
+
+// updateTag replaces the values of a tag on a stored file without applying
+// rules
+func (d boltData) updateTag(f tagger.File, t tagger.Tag) error {
+	// Check the value before the old values are removed
+	if err := checkValue(t); err != nil {
+		return err
+	}
+
+	err := d.removeTag(f, t.Name())
+	if err != nil {
+		return err
+	}
+	return d.addTagValue(f, t)
+}
+
+func (s *BoltStorage) AddTagValue(f tagger.File, t tagger.Tag) error {
+	return s.update(func(d boltData) error {
+		if !d.hasFile(f) {
+			return tagger.ErrNoFile
+		}
+
+		err := d.addTagValue(f, t)
+		if err != nil {
+			return err
+		}
+
+		// Add any tags implied by the new value
+		rules, err := d.canonicalRules()
+		if err != nil {
+			return err
+		}
+		return d.applyRules(f, rules)
+	})
+}
+
+// canonicalTag returns the tag renamed to it's canonical name if it's name is
+// an alias
+func (d boltData) canonicalTag(t tagger.Tag) tagger.Tag {
+	if name := d.resolveAlias(t.Name()); name != t.Name() {
+		return tagger.RenameTag(t, name)
+	}
+	return t
+}
+
+// addTagValue adds a value to a tag on a stored file without applying rules.
+// A value the file already has is stored under the same keys again.
+func (d boltData) addTagValue(f tagger.File, t tagger.Tag) error {
+	t = d.canonicalTag(t)
+	if strings.Contains(t.Name(), "\x00") {
+		return errNulInName
+	}
+	if err := checkValue(t); err != nil {
+		return err
+	}
+
+	id, _ := fileID(f.UUID())
+	err := d.tx.Bucket(boltTagsBucket).Put(tagKey(id, t), []byte{})
+	if err != nil {
+		return err
+	}
+	return d.tx.Bucket(boltIndexBucket).Put(indexKey(id, t), encodeValue(t))
+}
+
+// removeTagValue removes a single value of a tag from a file
+func (d boltData) removeTagValue(id []byte, t tagger.Tag) error {
+	err := d.tx.Bucket(boltTagsBucket).Delete(tagKey(id, t))
+	if err != nil {
+		return err
+	}
+	return d.tx.Bucket(boltIndexBucket).Delete(indexKey(id, t))
+}
+
+func (s *BoltStorage) RemoveTagValue(f tagger.File, t tagger.Tag) error {
+	if err := checkValue(t); err != nil {
+		return err
+	}
+
+	return s.update(func(d boltData) error {
+		id, ok := fileID(f.UUID())
+		if !ok {
+			return nil
+		}
+		return d.removeTagValue(id, normalizeTag(d.canonicalTag(t)))
+	})
+}
+
+// fileTags returns the tags of a file whose keys start with the prefix
+func (d boltData) fileTags(prefix []byte) ([]tagger.Tag, error) {
+	tags := make([]tagger.Tag, 0)
+	c := d.tx.Bucket(boltTagsBucket).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		t, err := parseTagKey(k)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, nil
+}
+
+func (s *BoltStorage) GetTagValues(f tagger.File, name string) ([]tagger.Tag, error) {
+	var tags []tagger.Tag
+	err := s.view(func(d boltData) error {
+		id, ok := fileID(f.UUID())
+		if !ok {
+			return tagger.ErrNoTag
+		}
+
+		var err error
+		tags, err = d.fileTags(tagPrefix(id, d.resolveAlias(name)))
+		if err != nil {
+			return err
+		}
+
+		// If no values were found, the file doesn't have the tag
+		if len(tags) == 0 {
+			return tagger.ErrNoTag
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func (s *BoltStorage) RemoveTag(f tagger.File, t tagger.Tag) error {
+	return s.update(func(d boltData) error {
+		return d.removeTag(f, t.Name())
+	})
+}
+
+// removeTag removes all values of a tag from a file
+func (d boltData) removeTag(f tagger.File, name string) error {
+	id, ok := fileID(f.UUID())
+	if !ok {
+		return nil
+	}
+
+	// Read the values before deleting them, as deleting moves the cursor
+	tags, err := d.fileTags(tagPrefix(id, d.resolveAlias(name)))
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tags {
+		if err := d.removeTagValue(id, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tags returns all tags of a file
+func (d boltData) tags(f tagger.File) ([]tagger.Tag, error) {
+	id, ok := fileID(f.UUID())
+	if !ok {
+		return make([]tagger.Tag, 0), nil
+	}
+	return d.fileTags(id)
+}
+
+func (s *BoltStorage) GetTags(f tagger.File) ([]tagger.Tag, error) {
+	var tags []tagger.Tag
+	err := s.view(func(d boltData) error {
+		var err error
+		tags, err = d.tags(f)
+		return err
+	})
+	return tags, err
+}
+
+func (s *BoltStorage) GetAllTags() ([]tagger.TagInfo, error) {
+	infos := make([]tagger.TagInfo, 0)
+	err := s.view(func(d boltData) error {
+		// The index is ordered by name, so the tags of each name follow
+		// each other
+		var info *tagger.TagInfo
+		var files map[string]bool
+		return d.scanIndex(nil, func(id []byte, t tagger.Tag) {
+			if info == nil || info.Name != t.Name() {
+				infos = append(infos, tagger.TagInfo{Name: t.Name()})
+				info = &infos[len(infos)-1]
+				files = make(map[string]bool)
+			}
+
+			if !files[string(id)] {
+				files[string(id)] = true
+				info.Files++
+			}
+
+			if !t.HasValue() {
+				info.Valueless = true
+				return
+			}
+			if info.Min == nil || compareTags(t, info.Min) < 0 {
+				info.Min = t
+			}
+			if info.Max == nil || compareTags(t, info.Max) > 0 {
+				info.Max = t
+			}
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+func (s *BoltStorage) GetChildTags(parent string) ([]string, error) {
+	names := make([]string, 0)
+	err := s.view(func(d boltData) error {
+		// Fetch the names of all tags below the parent, skipping over the
+		// values of each name
+		prefix := []byte{}
+		if parent != "" {
+			prefix = []byte(parent + tagger.TagSeparator)
+		}
+
+		c := d.tx.Bucket(boltIndexBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); {
+			i := bytes.IndexByte(k, 0)
+			if i < 0 {
+				return fmt.Errorf("%w: Invalid index key %x", tagger.ErrStorageCorrupt, k)
+			}
+
+			names = append(names, string(k[:i]))
+			k, _ = c.Seek(prefixEnd(k[:i+1]))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Reduce the names to the direct children
+	return tagger.ChildTags(names, parent), nil
+}
+
+// resolveAlias returns the tag name an alias refers to, or the name itself if
+// it isn't an alias
+func (d boltData) resolveAlias(name string) string {
+	if canonical := d.tx.Bucket(boltAliasesBucket).Get([]byte(name)); canonical != nil {
+		return string(canonical)
+	}
+	return name
+}
+
+func (s *BoltStorage) AddAlias(alias, name string) error {
+	return s.update(func(d boltData) error {
+		// Make the alias refer to the end of any chain of aliases
+		name = d.resolveAlias(name)
+		if name == alias {
+			return tagger.ErrAliasCycle
+		}
+
+		// Add the alias, and point aliases of the alias at the tag name
+		// instead
+		aliases, err := d.aliases()
+		if err != nil {
+			return err
+		}
+		b := d.tx.Bucket(boltAliasesBucket)
+		for a, n := range aliases {
+			if n == alias {
+				if err := b.Put([]byte(a), []byte(name)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := b.Put([]byte(alias), []byte(name)); err != nil {
+			return err
+		}
+
+		// Move tags stored under the alias to the tag name
+		type fileTag struct {
+			id []byte
+			t  tagger.Tag
+		}
+		moved := make([]fileTag, 0)
+		err = d.scanIndex(indexPrefix(alias), func(id []byte, t tagger.Tag) {
+			moved = append(moved, fileTag{append([]byte{}, id...), t})
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, m := range moved {
+			if err := d.removeTagValue(m.id, m.t); err != nil {
+				return err
+			}
+			f := tagger.NewFile(uuid.UUID(m.id), "")
+			if err := d.addTagValue(f, tagger.RenameTag(m.t, name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStorage) RemoveAlias(alias string) error {
+	return s.update(func(d boltData) error {
+		return d.tx.Bucket(boltAliasesBucket).Delete([]byte(alias))
+	})
+}
+
+// aliases returns all aliases mapped to the tag names they refer to
+func (d boltData) aliases() (map[string]string, error) {
+	aliases := make(map[string]string)
+	err := d.tx.Bucket(boltAliasesBucket).ForEach(func(alias, name []byte) error {
+		aliases[string(alias)] = string(name)
+		return nil
+	})
+	return aliases, err
+}
+
+func (s *BoltStorage) GetAliases() (map[string]string, error) {
+	var aliases map[string]string
+	err := s.view(func(d boltData) error {
+		var err error
+		aliases, err = d.aliases()
+		return err
+	})
+	return aliases, err
+}
+
+func (s *BoltStorage) AddRule(r tagger.Rule) (int, error) {
+	if err := checkValue(r.Implies); err != nil {
+		return 0, err
+	}
+
+	var id int
+	err := s.update(func(d boltData) error {
+		// Make sure the new rule doesn't cause any cycles
+		rules, err := d.rules()
+		if err != nil {
+			return err
+		}
+		err = tagger.CheckRules(append(rules, r))
+		if err != nil {
+			return err
+		}
+
+		// Store the rule, with the condition in the filter language
+		b := d.tx.Bucket(boltRulesBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		id = int(seq)
+
+		rec, err := json.Marshal(boltRule{
+			Condition: r.Condition.String(),
+			Name:      r.Implies.Name(),
+			Kind:      r.Implies.Kind(),
+			Value:     encodeValue(r.Implies),
+		})
+		if err != nil {
+			return err
+		}
+		return b.Put(ruleKey(id), rec)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (s *BoltStorage) RemoveRule(id int) error {
+	return s.update(func(d boltData) error {
+		b := d.tx.Bucket(boltRulesBucket)
+		if b.Get(ruleKey(id)) == nil {
+			return tagger.ErrNoRule
+		}
+		return b.Delete(ruleKey(id))
+	})
+}
+
+// rules returns all rules ordered by ID
+func (d boltData) rules() ([]tagger.Rule, error) {
+	rules := make([]tagger.Rule, 0)
+	err := d.tx.Bucket(boltRulesBucket).ForEach(func(k, v []byte) error {
+		id := int(binary.BigEndian.Uint64(k))
+
+		var rec boltRule
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return fmt.Errorf("%w: Invalid rule %d: %w", tagger.ErrStorageCorrupt, id, err)
+		}
+
+		// Parse the condition and create the implied tag
+		filter, err := tagger.ParseFilter(strings.NewReader(rec.Condition))
+		if err != nil {
+			return fmt.Errorf("%w: Invalid condition in rule %d: %w", tagger.ErrStorageCorrupt, id, err)
+		}
+		tag, err := decodeTag(rec.Name, rec.Kind, rec.Value)
+		if err != nil {
+			return err
+		}
+
+		rules = append(rules, tagger.Rule{ID: id, Condition: filter, Implies: tag})
+		return nil
+	})
+	return rules, err
+}
+
+func (s *BoltStorage) GetRules() ([]tagger.Rule, error) {
+	var rules []tagger.Rule
+	err := s.view(func(d boltData) error {
+		var err error
+		rules, err = d.rules()
+		return err
+	})
+	return rules, err
+}
+
+func (s *BoltStorage) ApplyRules() error {
+	return s.update(func(d boltData) error {
+		rules, err := d.canonicalRules()
+		if err != nil || len(rules) == 0 {
+			return err
+		}
+
+		files, err := d.allFiles()
+		if err != nil {
+			return err
+		}
+
+		// Apply the rules to each of them
+		for _, f := range files {
+			if err := d.applyRules(f, rules); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// canonicalRules returns the rules with conditions using the canonical tag
+// names. The rules are loaded once for each operation and passed to
+// applyRules, as they are parsed when read.
+func (d boltData) canonicalRules() ([]tagger.Rule, error) {
+	rules, err := d.rules()
+	if err != nil || len(rules) == 0 {
+		return rules, err
+	}
+
+	// Tags are stored under their canonical names, so the conditions must
+	// use them as well
+	aliases, err := d.aliases()
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		rules[i].Condition = tagger.RewriteAliases(rules[i].Condition, aliases)
+	}
+	return rules, nil
+}
+
+// applyRules adds the tags implied by the tags of a stored file
+func (d boltData) applyRules(f tagger.File, rules []tagger.Rule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	tags, err := d.tags(f)
+	if err != nil {
+		return err
+	}
+
+	// Add each of the implied tags
+	for _, tag := range tagger.ImpliedTags(rules, tags) {
+		if err := d.addTagValue(f, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltStorage) UpdateFile(f tagger.File, t []tagger.Tag) error {
+	return s.update(func(d boltData) error {
+		return d.updateFile(f, t)
+	})
+}
+
+func (d boltData) updateFile(f tagger.File, t []tagger.Tag) error {
+	id, ok := fileID(f.UUID())
+	if !ok {
+		return fmt.Errorf("storage: Invalid UUID for %s", f.Path())
+	}
+
+	// Check the values before anything is changed
+	for _, tag := range t {
+		if err := checkValue(tag); err != nil {
+			return err
+		}
+	}
+
+	// Replace any other file with the path
+	paths := d.tx.Bucket(boltPathsBucket)
+	if other := paths.Get([]byte(f.Path())); other != nil && !bytes.Equal(other, id) {
+		if err := d.removeFile(append([]byte{}, other...)); err != nil {
+			return err
+		}
+	}
+
+	// Drop the index entries of the file as it was stored
+	old, ok, err := d.file(id)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if err := d.unindexFile(old); err != nil {
+			return err
+		}
+	}
+
+	// Store the file, with the content hash if it's known
+	rec := boltFile{Path: f.Path()}
+	if h, ok := f.Hash(); ok {
+		rec.Hash, rec.Size, rec.ModTime = h.Sum, h.Size, h.ModTime.UnixNano()
+		err = d.tx.Bucket(boltHashesBucket).Put(hashKey(h.Sum, f.Path()), id)
+		if err != nil {
+			return err
+		}
+	}
+	v, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := d.tx.Bucket(boltFilesBucket).Put(id, v); err != nil {
+		return err
+	}
+	if err := paths.Put([]byte(f.Path()), id); err != nil {
+		return err
+	}
+
+	// Further values of a tag with several values are added to the first
+	// value, including values given under an alias of the tag
+	seen := make(map[string]bool)
+	for _, tag := range t {
+		name := d.resolveAlias(tag.Name())
+		var err error
+		if seen[name] {
+			err = d.addTagValue(f, tag)
+		} else {
+			err = d.updateTag(f, tag)
+		}
+		if err != nil {
+			return err
+		}
+		seen[name] = true
+	}
+
+	// Add any tags implied by the tags of the file
+	rules, err := d.canonicalRules()
+	if err != nil {
+		return err
+	}
+	return d.applyRules(f, rules)
+}
+
+// unindexFile removes the path and content hash of a file from their indexes
+func (d boltData) unindexFile(f tagger.File) error {
+	if err := d.tx.Bucket(boltPathsBucket).Delete([]byte(f.Path())); err != nil {
+		return err
+	}
+	if h, ok := f.Hash(); ok {
+		return d.tx.Bucket(boltHashesBucket).Delete(hashKey(h.Sum, f.Path()))
+	}
+	return nil
+}
+
+func (s *BoltStorage) RemoveFile(f tagger.File) error {
+	return s.update(func(d boltData) error {
+		id, ok := fileID(f.UUID())
+		if !ok {
+			return nil
+		}
+		return d.removeFile(id)
+	})
+}
+
+// removeFile removes a file, it's tags and it's index entries
+func (d boltData) removeFile(id []byte) error {
+	f, ok, err := d.file(id)
+	if err != nil || !ok {
+		return err
+	}
+
+	// Remove all tags associated with the file
+	tags, err := d.fileTags(id)
+	if err != nil {
+		return err
+	}
+	for _, t := range tags {
+		if err := d.removeTagValue(id, t); err != nil {
+			return err
+		}
+	}
+
+	// Remove the file itself
+	if err := d.unindexFile(f); err != nil {
+		return err
+	}
+	return d.tx.Bucket(boltFilesBucket).Delete(id)
+}
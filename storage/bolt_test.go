@@ -0,0 +1,18 @@
+package storage
+
+import (
+	"github.com/kiljacken/tagger"
+	"github.com/kiljacken/tagger/storage/storagetest"
+	"path/filepath"
+	"testing"
+)
+
+func TestBolt(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) tagger.StorageProvider {
+		p, err := NewBoltStorage(filepath.Join(t.TempDir(), "tags.bolt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	})
+}
@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"github.com/kiljacken/tagger"
+	"math"
+	"sort"
+)
+
+// idSet is a set of file keys
+type idSet map[string]bool
+
+// matchingFiles returns the stored files whose tags match the filter, ordered
+// by path. Filters are narrowed down to candidate files with the index where
+// possible, and every candidate is checked against the filter.
+func (d boltData) matchingFiles(f tagger.Filter) ([]tagger.File, error) {
+	aliases, err := d.aliases()
+	if err != nil {
+		return nil, err
+	}
+	f = tagger.RewriteAliases(f, aliases)
+
+	ids, ok, err := d.candidates(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []tagger.File
+	if ok {
+		files = make([]tagger.File, 0, len(ids))
+		for id := range ids {
+			file, found, err := d.file([]byte(id))
+			if err != nil {
+				return nil, err
+			} else if found {
+				files = append(files, file)
+			}
+		}
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].Path() < files[j].Path()
+		})
+	} else {
+		files, err = d.allFiles()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Check the candidates against the whole filter
+	matching := make([]tagger.File, 0, len(files))
+	for _, file := range files {
+		tags, err := d.tags(file)
+		if err != nil {
+			return nil, err
+		}
+		if f.Matches(tags) {
+			matching = append(matching, file)
+		}
+	}
+	return matching, nil
+}
+
+// candidates returns a set of files that includes every file matching the
+// filter, read from the index. It returns false if the filter can't be
+// answered from the index, in which case every file is a candidate.
+func (d boltData) candidates(f tagger.Filter) (idSet, bool, error) {
+	switch f := f.(type) {
+	case tagger.NameFilter:
+		ids := make(idSet)
+		add := func(id []byte, t tagger.Tag) {
+			ids[string(id)] = true
+		}
+
+		err := d.scanIndex(indexPrefix(f.Name), add)
+		if err == nil && f.Descendants {
+			err = d.scanIndex([]byte(f.Name+tagger.TagSeparator), add)
+		}
+		return ids, true, err
+
+	case tagger.ComparinsonFilter:
+		lo, hi, ok := comparisonRange(f)
+		if !ok {
+			return nil, false, nil
+		}
+
+		// Only files with a value matching on it's own can match, even if
+		// every value has to match
+		ids := make(idSet)
+		single := tagger.ComparinsonFilter{Name: f.Name, Value: f.Value, Function: f.Function}
+		err := d.scanIndexRange(lo, hi, func(id []byte, t tagger.Tag) {
+			if single.Matches([]tagger.Tag{t}) {
+				ids[string(id)] = true
+			}
+		})
+		return ids, true, err
+
+	case tagger.AndFilter:
+		// Intersect the candidates of the filters that can use the index
+		var ids idSet
+		for _, sub := range f.Filters {
+			subIDs, ok, err := d.candidates(sub)
+			if err != nil {
+				return nil, false, err
+			} else if !ok {
+				continue
+			}
+
+			if ids == nil {
+				ids = subIDs
+				continue
+			}
+			for id := range ids {
+				if !subIDs[id] {
+					delete(ids, id)
+				}
+			}
+		}
+		return ids, ids != nil, nil
+
+	case tagger.OrFilter:
+		// Every filter must use the index, or any file could match
+		ids := make(idSet)
+		for _, sub := range f.Filters {
+			subIDs, ok, err := d.candidates(sub)
+			if err != nil || !ok {
+				return nil, false, err
+			}
+			for id := range subIDs {
+				ids[id] = true
+			}
+		}
+		return ids, true, nil
+	}
+
+	// Negated and unknown filters are checked against every file
+	return nil, false, nil
+}
+
+// comparisonRange returns the range of index keys holding the values a
+// comparison filter can match, and false if the range can't be determined.
+// Values of other kind groups never compare, so the range stays within the
+// group of the filter value.
+func comparisonRange(f tagger.ComparinsonFilter) ([]byte, []byte, bool) {
+	lit, ok := literalTag(f.Name, f.Value)
+	if !ok || (lit.Kind() == tagger.FloatKind && math.IsNaN(lit.FloatValue())) {
+		return nil, nil, false
+	}
+
+	group := append(indexPrefix(f.Name), byte(kindGroup(lit.Kind())))
+	value := appendOrdered(indexPrefix(f.Name), lit)
+
+	// Dates are truncated to the second and large integers share positions
+	// with their neighbours, so the position of the value itself is always
+	// included
+	switch f.Function {
+	case tagger.Equals:
+		return value, prefixEnd(value), true
+	case tagger.NotEquals:
+		return group, prefixEnd(group), true
+	case tagger.LessThan, tagger.LessThanOrEqual:
+		return group, prefixEnd(value), true
+	case tagger.GreaterThan, tagger.GreaterThanOrEqual:
+		return value, prefixEnd(group), true
+	}
+	return nil, nil, false
+}
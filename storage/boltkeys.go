@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/kiljacken/tagger"
+	"math"
+	"time"
+)
+
+// The layout of the buckets of a bolt database. Tag names are followed by a
+// NUL byte in keys, so they can't contain one.
+var (
+	// boltMetaBucket holds the schema version
+	boltMetaBucket = []byte("meta")
+	// boltFilesBucket maps UUIDs to boltFile records
+	boltFilesBucket = []byte("files")
+	// boltPathsBucket maps paths to UUIDs
+	boltPathsBucket = []byte("paths")
+	// boltHashesBucket maps content hash sums followed by a NUL byte and the
+	// path to UUIDs, so the first file by path is found first
+	boltHashesBucket = []byte("hashes")
+	// boltTagsBucket holds a key for every tag of a file, made of the UUID,
+	// the tag name, the kind and the value
+	boltTagsBucket = []byte("tags")
+	// boltIndexBucket holds a key for every tag of a file ordered by tag
+	// name and value, made of the name, the ordered value, the UUID and the
+	// kind. The exact value is stored under the key.
+	boltIndexBucket = []byte("index")
+	// boltAliasesBucket maps aliases to tag names
+	boltAliasesBucket = []byte("aliases")
+	// boltRulesBucket maps rule IDs to boltRule records
+	boltRulesBucket = []byte("rules")
+
+	boltBuckets = [][]byte{boltMetaBucket, boltFilesBucket, boltPathsBucket, boltHashesBucket,
+		boltTagsBucket, boltIndexBucket, boltAliasesBucket, boltRulesBucket}
+)
+
+// boltVersionKey holds the schema version in the meta bucket
+var boltVersionKey = []byte("version")
+
+// boltSchemaVersion is the version of the bucket layout created by this
+// version of tagger
+const boltSchemaVersion = 1
+
+// uuidLen is the length of a UUID in keys
+const uuidLen = 16
+
+// errNulInName is returned for tag names that can't be stored in a key
+var errNulInName = errors.New("storage: Tag names can't contain NUL bytes")
+
+type (
+	// boltFile is the record stored for a file
+	boltFile struct {
+		Path    string `json:"path"`
+		Hash    string `json:"hash,omitempty"`
+		Size    int64  `json:"size,omitempty"`
+		ModTime int64  `json:"mtime,omitempty"`
+	}
+
+	// boltRule is the record stored for a rule, with the condition in the
+	// filter language
+	boltRule struct {
+		Condition string      `json:"condition"`
+		Name      string      `json:"name"`
+		Kind      tagger.Kind `json:"kind"`
+		Value     []byte      `json:"value,omitempty"`
+	}
+)
+
+// signFlip turns a signed integer into an unsigned one with the same order
+const signFlip = 1 << 63
+
+// encodeValue encodes the value of a tag exactly
+func encodeValue(t tagger.Tag) []byte {
+	switch t.Kind() {
+	case tagger.IntKind:
+		return binary.BigEndian.AppendUint64(nil, uint64(int64(t.Value()))^signFlip)
+	case tagger.StringKind:
+		return []byte(t.StringValue())
+	case tagger.FloatKind:
+		return binary.BigEndian.AppendUint64(nil, floatBits(t.FloatValue()))
+	case tagger.DateKind:
+		// Dates are only stored to the second, like in sqlite
+		return binary.BigEndian.AppendUint64(nil, uint64(t.DateValue().Unix())^signFlip)
+	case tagger.BoolKind:
+		return []byte{byte(boolValue(t.BoolValue()))}
+	}
+	return nil
+}
+
+// floatBits returns the bits of a float. Negative zero equals zero, so it's
+// encoded as zero to give both the same keys.
+func floatBits(v float64) uint64 {
+	if v == 0 {
+		v = 0
+	}
+	return math.Float64bits(v)
+}
+
+// decodeTag creates a tag from it's name, kind and encoded value
+func decodeTag(name string, kind tagger.Kind, value []byte) (tagger.Tag, error) {
+	switch {
+	case kind == tagger.NoKind && len(value) == 0:
+		return tagger.NewNamedTag(name), nil
+	case kind == tagger.IntKind && len(value) == 8:
+		return tagger.NewValueTag(name, int(int64(binary.BigEndian.Uint64(value)^signFlip))), nil
+	case kind == tagger.StringKind:
+		return tagger.NewStringTag(name, string(value)), nil
+	case kind == tagger.FloatKind && len(value) == 8:
+		return tagger.NewFloatTag(name, math.Float64frombits(binary.BigEndian.Uint64(value))), nil
+	case kind == tagger.DateKind && len(value) == 8:
+		return tagger.NewDateTag(name, time.Unix(int64(binary.BigEndian.Uint64(value)^signFlip), 0).UTC()), nil
+	case kind == tagger.BoolKind && len(value) == 1:
+		return tagger.NewBoolTag(name, value[0] != 0), nil
+	}
+
+	// The stored kind and value don't fit together
+	return nil, fmt.Errorf("%w: Invalid value %x of kind %d for tag %s", tagger.ErrStorageCorrupt, value, kind, name)
+}
+
+// appendOrdered appends the value of a tag in an encoding whose byte order
+// is the order of compareTags, preceded by the kind group. Integers are
+// ordered as floats, so large integers may share a position.
+func appendOrdered(b []byte, t tagger.Tag) []byte {
+	b = append(b, byte(kindGroup(t.Kind())))
+	switch kindGroup(t.Kind()) {
+	case tagger.IntKind:
+		bits := floatBits(numberValue(t))
+		if bits&signFlip == 0 {
+			bits ^= signFlip
+		} else {
+			bits = ^bits
+		}
+		return binary.BigEndian.AppendUint64(b, bits)
+	case tagger.StringKind:
+		// NUL bytes are escaped, so the terminator sorts before any byte
+		// that can follow in a longer string
+		for _, c := range []byte(t.StringValue()) {
+			if c == 0 {
+				b = append(b, 0, 0xff)
+			} else {
+				b = append(b, c)
+			}
+		}
+		return append(b, 0, 0)
+	case tagger.DateKind, tagger.BoolKind:
+		return append(b, encodeValue(t)...)
+	}
+	return b
+}
+
+// tagKey returns the key of a tag of a file in the tags bucket
+func tagKey(id []byte, t tagger.Tag) []byte {
+	key := append(tagPrefix(id, t.Name()), byte(t.Kind()))
+	return append(key, encodeValue(t)...)
+}
+
+// tagPrefix returns the prefix of the keys of the values of a tag of a file
+// in the tags bucket
+func tagPrefix(id []byte, name string) []byte {
+	key := make([]byte, 0, len(id)+len(name)+2)
+	key = append(key, id...)
+	key = append(key, name...)
+	return append(key, 0)
+}
+
+// parseTagKey reads a tag from it's key in the tags bucket
+func parseTagKey(key []byte) (tagger.Tag, error) {
+	rest := key[uuidLen:]
+	for i, c := range rest {
+		if c == 0 && i+1 < len(rest) {
+			return decodeTag(string(rest[:i]), tagger.Kind(rest[i+1]), rest[i+2:])
+		}
+	}
+	return nil, fmt.Errorf("%w: Invalid tag key %x", tagger.ErrStorageCorrupt, key)
+}
+
+// indexKey returns the key of a tag of a file in the index bucket
+func indexKey(id []byte, t tagger.Tag) []byte {
+	key := appendOrdered(indexPrefix(t.Name()), t)
+	key = append(key, id...)
+	return append(key, byte(t.Kind()))
+}
+
+// indexPrefix returns the prefix of the index keys of a tag name
+func indexPrefix(name string) []byte {
+	return append([]byte(name), 0)
+}
+
+// parseIndexKey reads the UUID of the file and the tag from a key in the
+// index bucket and the exact value stored under it
+func parseIndexKey(key, value []byte) ([]byte, tagger.Tag, error) {
+	if len(key) < uuidLen+2 {
+		return nil, nil, fmt.Errorf("%w: Invalid index key %x", tagger.ErrStorageCorrupt, key)
+	}
+
+	end := len(key) - 1
+	id := key[end-uuidLen : end]
+	for i, c := range key {
+		if c == 0 {
+			t, err := decodeTag(string(key[:i]), tagger.Kind(key[end]), value)
+			return id, t, err
+		}
+	}
+	return nil, nil, fmt.Errorf("%w: Invalid index key %x", tagger.ErrStorageCorrupt, key)
+}
+
+// hashKey returns the key of a file in the hashes bucket
+func hashKey(sum, path string) []byte {
+	key := make([]byte, 0, len(sum)+len(path)+1)
+	key = append(key, sum...)
+	key = append(key, 0)
+	return append(key, path...)
+}
+
+// ruleKey returns the key of a rule in the rules bucket
+func ruleKey(id int) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(id))
+}
+
+// prefixEnd returns the first key after all keys with the prefix, or nil if
+// there is none
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// literalTag returns a tag holding a value from a filter, and false if the
+// value has a type tags can't hold
+func literalTag(name string, v interface{}) (tagger.Tag, bool) {
+	switch v := v.(type) {
+	case int:
+		return tagger.NewValueTag(name, v), true
+	case float64:
+		return tagger.NewFloatTag(name, v), true
+	case string:
+		return tagger.NewStringTag(name, v), true
+	case time.Time:
+		return tagger.NewDateTag(name, v), true
+	case bool:
+		return tagger.NewBoolTag(name, v), true
+	}
+	return nil, false
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"github.com/kiljacken/tagger"
+)
+
+// filterIterator skips the files of another iterator whose tags don't match
+// a filter
+type filterIterator struct {
+	tagger.FileIterator
+	filter tagger.Filter
+	// tags looks up the tags of a file
+	tags func(f tagger.File) ([]tagger.Tag, error)
+	err  error
+}
+
+func (it *filterIterator) Next() bool {
+	for it.err == nil && it.FileIterator.Next() {
+		// Get the files tags
+		tags, err := it.tags(it.File())
+		if err != nil {
+			// TODO: We fail fast now, maybe try other files first?
+			it.err = err
+			return false
+		}
+
+		// Stop at the file only if it's tags match the filter
+		if it.filter.Matches(tags) {
+			return true
+		}
+	}
+	return false
+}
+
+func (it *filterIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.FileIterator.Err()
+}
+
+// collectFiles reads the remaining files of an iterator into a slice
+func collectFiles(it tagger.FileIterator) ([]tagger.File, error) {
+	// Create an empty array of files
+	files := make([]tagger.File, 0)
+
+	for it.Next() {
+		files = append(files, it.File())
+	}
+
+	// If an error occured during the iteration, return the error
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	// Return the array of files
+	return files, nil
+}
+
+// limitIterator skips the first files of another iterator, and stops after
+// returning a number of files
+type limitIterator struct {
+	tagger.FileIterator
+	// offset is the number of files still to be skipped, and limit the
+	// largest number of files to return, or 0 for no limit
+	offset, limit int
+	n             int
+}
+
+func (it *limitIterator) Next() bool {
+	for ; it.offset > 0; it.offset-- {
+		if !it.FileIterator.Next() {
+			return false
+		}
+	}
+
+	if it.limit > 0 && it.n >= it.limit {
+		return false
+	}
+
+	it.n++
+	return it.FileIterator.Next()
+}
+
+// sliceIterator steps through files that have already been read
+type sliceIterator struct {
+	files []tagger.File
+	// i is the index of the current file plus one
+	i int
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.i >= len(it.files) {
+		return false
+	}
+	it.i++
+	return true
+}
+
+func (it *sliceIterator) File() tagger.File {
+	return it.files[it.i-1]
+}
+
+func (it *sliceIterator) Err() error {
+	return nil
+}
+
+func (it *sliceIterator) Close() error {
+	return nil
+}
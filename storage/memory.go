@@ -0,0 +1,866 @@
+package storage
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"context"
+	"errors"
+	"github.com/kiljacken/tagger"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStorage is a storage engine keeping all data in memory, for tests and
+// for embedding tagger in programs that don't need the data to persist. It is
+// safe for concurrent use.
+//
+// Writes are serialized. A transaction holds the write lock from Begin until
+// it is committed or rolled back, so writes made outside of it wait for it to
+// finish, while reads see the data as it was before the transaction.
+type MemoryStorage struct {
+	shared *memoryShared
+	// tx is the state of the transaction of a transactional view, or nil
+	tx *memoryTxState
+	// ctx is the context all operations check before they start
+	ctx context.Context
+}
+
+// memoryShared is the state shared by a storage and all of it's views
+type memoryShared struct {
+	// writer holds a token while a write or transaction is in progress
+	writer chan struct{}
+	// mu guards data, which is replaced when a transaction is committed
+	mu   sync.RWMutex
+	data *memoryData
+}
+
+// memoryTxState holds the copy of the data changed by a transaction
+type memoryTxState struct {
+	mu sync.Mutex
+	// data is nil once the transaction has been committed or rolled back
+	data *memoryData
+}
+
+// memoryData is the content of a MemoryStorage
+type memoryData struct {
+	// files maps the string form of UUIDs to the stored files
+	files map[string]memoryFile
+	// paths maps paths to the string form of the UUID of their file
+	paths   map[string]string
+	aliases map[string]string
+	rules   []tagger.Rule
+	// lastRule is the highest rule ID ever given out, so IDs of removed
+	// rules aren't reused
+	lastRule int
+}
+
+// memoryFile is a stored file and it's tags. The tags slice is never changed
+// in place, so it can be shared between copies of the data.
+type memoryFile struct {
+	file tagger.File
+	tags []tagger.Tag
+}
+
+// memoryTx is a transactional view of a MemoryStorage
+type memoryTx struct {
+	*MemoryStorage
+}
+
+// memoryView is a view of a MemoryStorage bound to a context
+type memoryView struct {
+	*MemoryStorage
+}
+
+// errTxDone is returned when a transactional view is used after it has been
+// committed or rolled back
+var errTxDone = errors.New("storage: Transaction has already been committed or rolled back")
+
+func init() {
+	// The location of a memory DSN is ignored, every storage starts empty
+	Register("memory", func(location string) (tagger.StorageProvider, error) {
+		return NewMemoryStorage(), nil
+	})
+}
+
+// NewMemoryStorage returns a new, empty in-memory storage engine
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		shared: &memoryShared{
+			writer: make(chan struct{}, 1),
+			data:   newMemoryData(),
+		},
+		ctx: context.Background(),
+	}
+}
+
+func newMemoryData() *memoryData {
+	return &memoryData{
+		files:   make(map[string]memoryFile),
+		paths:   make(map[string]string),
+		aliases: make(map[string]string),
+		rules:   make([]tagger.Rule, 0),
+	}
+}
+
+// clone returns a copy of the data that can be changed without affecting the
+// original
+func (d *memoryData) clone() *memoryData {
+	c := &memoryData{
+		files:    make(map[string]memoryFile, len(d.files)),
+		paths:    make(map[string]string, len(d.paths)),
+		aliases:  make(map[string]string, len(d.aliases)),
+		rules:    append(make([]tagger.Rule, 0, len(d.rules)), d.rules...),
+		lastRule: d.lastRule,
+	}
+	for id, f := range d.files {
+		c.files[id] = f
+	}
+	for path, id := range d.paths {
+		c.paths[path] = id
+	}
+	for alias, name := range d.aliases {
+		c.aliases[alias] = name
+	}
+	return c
+}
+
+// lock waits for the write lock, or for the context to be cancelled
+func (m *memoryShared) lock(ctx context.Context) error {
+	select {
+	case m.writer <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *memoryShared) unlock() {
+	<-m.writer
+}
+
+// read runs the function with the data seen by the storage
+func (s *MemoryStorage) read(fn func(d *memoryData) error) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	if s.tx != nil {
+		return s.tx.use(fn)
+	}
+
+	s.shared.mu.RLock()
+	defer s.shared.mu.RUnlock()
+	return fn(s.shared.data)
+}
+
+// write runs the function with the data seen by the storage, allowing it to
+// change the data. Write functions check everything that can fail before
+// making any changes, so a failed write leaves the data as it was.
+func (s *MemoryStorage) write(fn func(d *memoryData) error) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	if s.tx != nil {
+		return s.tx.use(fn)
+	}
+
+	// Wait for other writers and open transactions
+	if err := s.shared.lock(s.ctx); err != nil {
+		return err
+	}
+	defer s.shared.unlock()
+
+	s.shared.mu.Lock()
+	defer s.shared.mu.Unlock()
+	return fn(s.shared.data)
+}
+
+// use runs the function with the data of the transaction
+func (t *memoryTxState) use(fn func(d *memoryData) error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.data == nil {
+		return errTxDone
+	}
+	return fn(t.data)
+}
+
+// Close does nothing, as the data is only kept in memory
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+func (s *MemoryStorage) Begin() (tagger.Tx, error) {
+	if s.tx != nil {
+		return nil, tagger.ErrNestedTx
+	}
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// The transaction is the only writer until it's done
+	if err := s.shared.lock(s.ctx); err != nil {
+		return nil, err
+	}
+
+	s.shared.mu.RLock()
+	data := s.shared.data.clone()
+	s.shared.mu.RUnlock()
+
+	view := *s
+	view.tx = &memoryTxState{data: data}
+	return memoryTx{&view}, nil
+}
+
+func (s *MemoryStorage) WithContext(ctx context.Context) tagger.StorageProvider {
+	view := *s
+	view.ctx = ctx
+	return memoryView{&view}
+}
+
+// Close does nothing, as the view shares the data of the storage
+func (v memoryView) Close() error {
+	return nil
+}
+
+// Commit makes the changes made through the transaction visible to others
+func (t memoryTx) Commit() error {
+	t.tx.mu.Lock()
+	defer t.tx.mu.Unlock()
+
+	if t.tx.data == nil {
+		return errTxDone
+	}
+
+	t.shared.mu.Lock()
+	t.shared.data = t.tx.data
+	t.shared.mu.Unlock()
+
+	t.tx.data = nil
+	t.shared.unlock()
+	return nil
+}
+
+// Rollback discards the changes made through the transaction
+func (t memoryTx) Rollback() error {
+	t.tx.mu.Lock()
+	defer t.tx.mu.Unlock()
+
+	if t.tx.data == nil {
+		return errTxDone
+	}
+
+	t.tx.data = nil
+	t.shared.unlock()
+	return nil
+}
+
+// Close rolls back the transaction unless it has been committed
+func (t memoryTx) Close() error {
+	err := t.Rollback()
+	if err == errTxDone {
+		return nil
+	}
+	return err
+}
+
+// normalizeTag returns the tag with it's value as it would be read back from
+// sqlite, so both storages behave the same. Dates are only kept to the
+// second.
+func normalizeTag(t tagger.Tag) tagger.Tag {
+	if t.Kind() == tagger.DateKind {
+		return tagger.NewDateTag(t.Name(), time.Unix(t.DateValue().Unix(), 0).UTC())
+	}
+	return t
+}
+
+// normalizeFile returns the file with it's content hash as it would be read
+// back from sqlite
+func normalizeFile(f tagger.File) tagger.File {
+	if h, ok := f.Hash(); ok {
+		h.ModTime = time.Unix(0, h.ModTime.UnixNano())
+		return f.WithHash(h)
+	}
+	return f.WithHash(tagger.ContentHash{})
+}
+
+// file returns the stored file with the UUID
+func (d *memoryData) file(u uuid.UUID) (memoryFile, bool) {
+	f, ok := d.files[u.String()]
+	return f, ok
+}
+
+// sortedFiles returns the stored files whose tags match the filter, ordered
+// by path. A nil filter matches every file.
+func (d *memoryData) sortedFiles(f tagger.Filter) []tagger.File {
+	if f != nil {
+		f = tagger.RewriteAliases(f, d.aliases)
+	}
+
+	files := make([]tagger.File, 0)
+	for _, mf := range d.files {
+		if f == nil || f.Matches(mf.tags) {
+			files = append(files, mf.file)
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path() < files[j].Path()
+	})
+	return files
+}
+
+func (s *MemoryStorage) GetFile(u uuid.UUID) (tagger.File, error) {
+	var file tagger.File
+	err := s.read(func(d *memoryData) error {
+		f, ok := d.file(u)
+		if !ok {
+			return tagger.ErrNoFile
+		}
+		file = f.file
+		return nil
+	})
+	return file, err
+}
+
+func (s *MemoryStorage) GetFileForPath(path string) (tagger.File, error) {
+	var file tagger.File
+	err := s.read(func(d *memoryData) error {
+		id, ok := d.paths[path]
+		if !ok {
+			return tagger.ErrNoFile
+		}
+		file = d.files[id].file
+		return nil
+	})
+	return file, err
+}
+
+func (s *MemoryStorage) GetFileForHash(sum string) (tagger.File, error) {
+	var file tagger.File
+	err := s.read(func(d *memoryData) error {
+		// Pick the first of the files with the hash by path
+		found := false
+		for _, f := range d.files {
+			h, ok := f.file.Hash()
+			if !ok || h.Sum != sum {
+				continue
+			}
+			if !found || f.file.Path() < file.Path() {
+				file, found = f.file, true
+			}
+		}
+
+		if !found {
+			return tagger.ErrNoFile
+		}
+		return nil
+	})
+	return file, err
+}
+
+func (s *MemoryStorage) GetAllFiles() ([]tagger.File, error) {
+	var files []tagger.File
+	err := s.read(func(d *memoryData) error {
+		files = d.sortedFiles(nil)
+		return nil
+	})
+	return files, err
+}
+
+func (s *MemoryStorage) GetMatchingFiles(f tagger.Filter) ([]tagger.File, error) {
+	var files []tagger.File
+	err := s.read(func(d *memoryData) error {
+		files = d.sortedFiles(f)
+		return nil
+	})
+	return files, err
+}
+
+// IterateAllFiles returns the files ordered by path. As the files are already
+// in memory, they are read all at once.
+func (s *MemoryStorage) IterateAllFiles() (tagger.FileIterator, error) {
+	files, err := s.GetAllFiles()
+	if err != nil {
+		return nil, err
+	}
+	return &sliceIterator{files: files}, nil
+}
+
+// IterateMatchingFiles returns the matching files ordered by path. As the
+// files are already in memory, they are read all at once.
+func (s *MemoryStorage) IterateMatchingFiles(f tagger.Filter) (tagger.FileIterator, error) {
+	files, err := s.GetMatchingFiles(f)
+	if err != nil {
+		return nil, err
+	}
+	return &sliceIterator{files: files}, nil
+}
+
+func (s *MemoryStorage) QueryFiles(f tagger.Filter, opts tagger.QueryOptions) (tagger.FileIterator, error) {
+	var files []tagger.File
+	err := s.read(func(d *memoryData) error {
+		files = d.sortedFiles(f)
+		sortFiles(files, d.sortKeys(files, opts), opts.Descending)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &sliceIterator{files: pageFiles(files, opts)}, nil
+}
+
+// sortKeys returns the values of the sort tag of the files, or nil if they
+// are ordered by path
+func (d *memoryData) sortKeys(files []tagger.File, opts tagger.QueryOptions) sortKeys {
+	if opts.SortTag == "" {
+		return nil
+	}
+
+	name := tagger.ResolveAlias(d.aliases, opts.SortTag)
+	keys := make(sortKeys, len(files))
+	for _, file := range files {
+		f, _ := d.file(file.UUID())
+		for _, t := range f.tags {
+			if t.Name() == name {
+				keys.add(file.Path(), t, opts.Descending)
+			}
+		}
+	}
+	return keys
+}
+
+func (s *MemoryStorage) UpdateTag(f tagger.File, t tagger.Tag) error {
+	if err := checkValue(t); err != nil {
+		return err
+	}
+
+	return s.write(func(d *memoryData) error {
+		if _, ok := d.file(f.UUID()); !ok {
+			return tagger.ErrNoFile
+		}
+
+		d.updateTag(f, t)
+
+		// Add any tags implied by the new tag
+		d.applyRules(f, d.canonicalRules())
+		return nil
+	})
+}
+
+// canonicalTag returns the tag renamed to it's canonical name if it's name is
+// an alias, with it's value normalized
+func (d *memoryData) canonicalTag(t tagger.Tag) tagger.Tag {
+	if name := tagger.ResolveAlias(d.aliases, t.Name()); name != t.Name() {
+		t = tagger.RenameTag(t, name)
+	}
+	return normalizeTag(t)
+}
+
+// updateTag replaces the values of a tag on a stored file without applying
+// rules
+func (d *memoryData) updateTag(f tagger.File, t tagger.Tag) {
+	d.removeTag(f, t)
+	d.addTagValue(f, t)
+}
+
+func (s *MemoryStorage) AddTagValue(f tagger.File, t tagger.Tag) error {
+	if err := checkValue(t); err != nil {
+		return err
+	}
+
+	return s.write(func(d *memoryData) error {
+		if _, ok := d.file(f.UUID()); !ok {
+			return tagger.ErrNoFile
+		}
+
+		d.addTagValue(f, t)
+
+		// Add any tags implied by the new value
+		d.applyRules(f, d.canonicalRules())
+		return nil
+	})
+}
+
+// addTagValue adds a value to a tag on a stored file without applying rules
+func (d *memoryData) addTagValue(f tagger.File, t tagger.Tag) {
+	mf, ok := d.file(f.UUID())
+	if !ok {
+		return
+	}
+
+	// Add the value unless the file already has it
+	t = d.canonicalTag(t)
+	for _, tag := range mf.tags {
+		if sameTag(tag, t) {
+			return
+		}
+	}
+
+	// Limit the capacity, so appending copies the tags
+	mf.tags = append(mf.tags[:len(mf.tags):len(mf.tags)], t)
+	d.files[f.UUID().String()] = mf
+}
+
+func (s *MemoryStorage) RemoveTagValue(f tagger.File, t tagger.Tag) error {
+	if err := checkValue(t); err != nil {
+		return err
+	}
+
+	return s.write(func(d *memoryData) error {
+		t = d.canonicalTag(t)
+		d.removeTags(f, func(tag tagger.Tag) bool {
+			return sameTag(tag, t)
+		})
+		return nil
+	})
+}
+
+func (s *MemoryStorage) GetTagValues(f tagger.File, name string) ([]tagger.Tag, error) {
+	tags := make([]tagger.Tag, 0)
+	err := s.read(func(d *memoryData) error {
+		mf, _ := d.file(f.UUID())
+		name = tagger.ResolveAlias(d.aliases, name)
+		for _, t := range mf.tags {
+			if t.Name() == name {
+				tags = append(tags, t)
+			}
+		}
+
+		// If no values were found, the file doesn't have the tag
+		if len(tags) == 0 {
+			return tagger.ErrNoTag
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func (s *MemoryStorage) RemoveTag(f tagger.File, t tagger.Tag) error {
+	return s.write(func(d *memoryData) error {
+		d.removeTag(f, t)
+		return nil
+	})
+}
+
+// removeTag removes all values of a tag from a file
+func (d *memoryData) removeTag(f tagger.File, t tagger.Tag) {
+	name := tagger.ResolveAlias(d.aliases, t.Name())
+	d.removeTags(f, func(tag tagger.Tag) bool {
+		return tag.Name() == name
+	})
+}
+
+// removeTags removes the tags selected by the function from a file, if the
+// file is stored
+func (d *memoryData) removeTags(f tagger.File, remove func(t tagger.Tag) bool) {
+	mf, ok := d.file(f.UUID())
+	if !ok {
+		return
+	}
+
+	tags := make([]tagger.Tag, 0, len(mf.tags))
+	for _, tag := range mf.tags {
+		if !remove(tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	mf.tags = tags
+	d.files[f.UUID().String()] = mf
+}
+
+func (s *MemoryStorage) GetTags(f tagger.File) ([]tagger.Tag, error) {
+	var tags []tagger.Tag
+	err := s.read(func(d *memoryData) error {
+		mf, _ := d.file(f.UUID())
+		tags = append(make([]tagger.Tag, 0, len(mf.tags)), mf.tags...)
+		return nil
+	})
+	return tags, err
+}
+
+func (s *MemoryStorage) GetAllTags() ([]tagger.TagInfo, error) {
+	infos := make([]tagger.TagInfo, 0)
+	err := s.read(func(d *memoryData) error {
+		// Aggregate the usage of each tag name
+		byName := make(map[string]*tagger.TagInfo)
+		for _, f := range d.files {
+			counted := make(map[string]bool)
+			for _, t := range f.tags {
+				info, ok := byName[t.Name()]
+				if !ok {
+					info = &tagger.TagInfo{Name: t.Name()}
+					byName[t.Name()] = info
+				}
+
+				if !counted[t.Name()] {
+					counted[t.Name()] = true
+					info.Files++
+				}
+
+				if !t.HasValue() {
+					info.Valueless = true
+					continue
+				}
+				if info.Min == nil || compareTags(t, info.Min) < 0 {
+					info.Min = t
+				}
+				if info.Max == nil || compareTags(t, info.Max) > 0 {
+					info.Max = t
+				}
+			}
+		}
+
+		for _, info := range byName {
+			infos = append(infos, *info)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos, nil
+}
+
+func (s *MemoryStorage) GetChildTags(parent string) ([]string, error) {
+	names := make([]string, 0)
+	err := s.read(func(d *memoryData) error {
+		for _, f := range d.files {
+			for _, t := range f.tags {
+				names = append(names, t.Name())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Reduce the names to the direct children
+	return tagger.ChildTags(names, parent), nil
+}
+
+func (s *MemoryStorage) AddAlias(alias, name string) error {
+	return s.write(func(d *memoryData) error {
+		// Make the alias refer to the end of any chain of aliases
+		name = tagger.ResolveAlias(d.aliases, name)
+		if name == alias {
+			return tagger.ErrAliasCycle
+		}
+
+		d.aliases[alias] = name
+
+		// Point aliases of the alias at the tag name instead
+		for a, n := range d.aliases {
+			if n == alias {
+				d.aliases[a] = name
+			}
+		}
+
+		// Move tags stored under the alias to the tag name, dropping values
+		// the file already has under the tag name
+		for id, f := range d.files {
+			tags := make([]tagger.Tag, 0, len(f.tags))
+			for _, t := range f.tags {
+				if t.Name() != alias {
+					tags = append(tags, t)
+				}
+			}
+		outer:
+			for _, t := range f.tags {
+				if t.Name() != alias {
+					continue
+				}
+				t = tagger.RenameTag(t, name)
+				for _, other := range tags {
+					if sameTag(other, t) {
+						continue outer
+					}
+				}
+				tags = append(tags, t)
+			}
+			f.tags = tags
+			d.files[id] = f
+		}
+		return nil
+	})
+}
+
+func (s *MemoryStorage) RemoveAlias(alias string) error {
+	return s.write(func(d *memoryData) error {
+		delete(d.aliases, alias)
+		return nil
+	})
+}
+
+func (s *MemoryStorage) GetAliases() (map[string]string, error) {
+	aliases := make(map[string]string)
+	err := s.read(func(d *memoryData) error {
+		for alias, name := range d.aliases {
+			aliases[alias] = name
+		}
+		return nil
+	})
+	return aliases, err
+}
+
+func (s *MemoryStorage) AddRule(r tagger.Rule) (int, error) {
+	if err := checkValue(r.Implies); err != nil {
+		return 0, err
+	}
+
+	err := s.write(func(d *memoryData) error {
+		// Make sure the new rule doesn't cause any cycles
+		err := tagger.CheckRules(append(d.rules[:len(d.rules):len(d.rules)], r))
+		if err != nil {
+			return err
+		}
+
+		// Rules are kept ordered by ID, and IDs are never reused, like an
+		// autoincrementing key in sqlite
+		d.lastRule++
+		r.ID = d.lastRule
+		r.Implies = normalizeTag(r.Implies)
+		d.rules = append(d.rules[:len(d.rules):len(d.rules)], r)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return r.ID, nil
+}
+
+func (s *MemoryStorage) RemoveRule(id int) error {
+	return s.write(func(d *memoryData) error {
+		rules := make([]tagger.Rule, 0, len(d.rules))
+		for _, r := range d.rules {
+			if r.ID != id {
+				rules = append(rules, r)
+			}
+		}
+
+		// If nothing was removed, no such rule exists
+		if len(rules) == len(d.rules) {
+			return tagger.ErrNoRule
+		}
+
+		d.rules = rules
+		return nil
+	})
+}
+
+func (s *MemoryStorage) GetRules() ([]tagger.Rule, error) {
+	var rules []tagger.Rule
+	err := s.read(func(d *memoryData) error {
+		rules = append(make([]tagger.Rule, 0, len(d.rules)), d.rules...)
+		return nil
+	})
+	return rules, err
+}
+
+func (s *MemoryStorage) ApplyRules() error {
+	return s.write(func(d *memoryData) error {
+		rules := d.canonicalRules()
+		for _, f := range d.files {
+			d.applyRules(f.file, rules)
+		}
+		return nil
+	})
+}
+
+// canonicalRules returns the rules with conditions using the canonical tag
+// names, which is done once for each operation
+func (d *memoryData) canonicalRules() []tagger.Rule {
+	// Tags are stored under their canonical names, so the conditions must
+	// use them as well
+	rules := make([]tagger.Rule, 0, len(d.rules))
+	for _, r := range d.rules {
+		r.Condition = tagger.RewriteAliases(r.Condition, d.aliases)
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// applyRules adds the tags implied by the tags of a stored file
+func (d *memoryData) applyRules(f tagger.File, rules []tagger.Rule) {
+	if len(rules) == 0 {
+		return
+	}
+
+	// Add each of the implied tags
+	mf, _ := d.file(f.UUID())
+	for _, tag := range tagger.ImpliedTags(rules, mf.tags) {
+		d.addTagValue(f, tag)
+	}
+}
+
+func (s *MemoryStorage) UpdateFile(f tagger.File, t []tagger.Tag) error {
+	// Check the values before anything is changed
+	for _, tag := range t {
+		if err := checkValue(tag); err != nil {
+			return err
+		}
+	}
+
+	return s.write(func(d *memoryData) error {
+		id := f.UUID().String()
+		f = normalizeFile(f)
+
+		// Replace any other file with the path
+		if other, ok := d.paths[f.Path()]; ok && other != id {
+			delete(d.files, other)
+		}
+
+		// Keep the tags of the file if it's already stored
+		mf, ok := d.files[id]
+		if ok {
+			delete(d.paths, mf.file.Path())
+		} else {
+			mf.tags = make([]tagger.Tag, 0)
+		}
+		mf.file = f
+		d.files[id] = mf
+		d.paths[f.Path()] = id
+
+		// Further values of a tag with several values are added to the first
+		// value, including values given under an alias of the tag
+		seen := make(map[string]bool)
+		for _, tag := range t {
+			name := tagger.ResolveAlias(d.aliases, tag.Name())
+			if seen[name] {
+				d.addTagValue(f, tag)
+			} else {
+				d.updateTag(f, tag)
+			}
+			seen[name] = true
+		}
+
+		// Add any tags implied by the tags of the file
+		d.applyRules(f, d.canonicalRules())
+		return nil
+	})
+}
+
+func (s *MemoryStorage) RemoveFile(f tagger.File) error {
+	return s.write(func(d *memoryData) error {
+		mf, ok := d.file(f.UUID())
+		if !ok {
+			return nil
+		}
+
+		delete(d.paths, mf.file.Path())
+		delete(d.files, f.UUID().String())
+		return nil
+	})
+}
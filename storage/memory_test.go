@@ -0,0 +1,13 @@
+package storage
+
+import (
+	"github.com/kiljacken/tagger"
+	"github.com/kiljacken/tagger/storage/storagetest"
+	"testing"
+)
+
+func TestMemory(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) tagger.StorageProvider {
+		return NewMemoryStorage()
+	})
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"github.com/kiljacken/tagger"
+	"math"
+	"sort"
+	"strings"
+)
+
+// kindGroup returns the position of a kind in the order of tag values, where
+// floats are ordered together with integers
+func kindGroup(k tagger.Kind) tagger.Kind {
+	if k == tagger.FloatKind {
+		return tagger.IntKind
+	}
+	return k
+}
+
+// compareTags orders the values of two tags the way sqlite orders the values
+// stored in the tags table. Values are ordered by kind first, with integers
+// and floats compared by their numeric value. The names of the tags are not
+// compared.
+func compareTags(a, b tagger.Tag) int {
+	ka, kb := kindGroup(a.Kind()), kindGroup(b.Kind())
+	switch {
+	case ka < kb:
+		return -1
+	case ka > kb:
+		return 1
+	}
+
+	switch ka {
+	case tagger.IntKind:
+		if a.Kind() == tagger.IntKind && b.Kind() == tagger.IntKind {
+			return compareInts(int64(a.Value()), int64(b.Value()))
+		}
+		return compareNumbers(numberValue(a), numberValue(b))
+	case tagger.StringKind:
+		return strings.Compare(a.StringValue(), b.StringValue())
+	case tagger.DateKind:
+		// Dates are only stored to the second
+		return compareInts(a.DateValue().Unix(), b.DateValue().Unix())
+	case tagger.BoolKind:
+		return compareInts(boolValue(a.BoolValue()), boolValue(b.BoolValue()))
+	}
+	return 0
+}
+
+// sameTag checks whether two tags have the same name, kind and value
+func sameTag(a, b tagger.Tag) bool {
+	return a.Name() == b.Name() && a.Kind() == b.Kind() && compareTags(a, b) == 0
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareNumbers(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// numberValue returns the value of an integer or float tag as a float
+func numberValue(t tagger.Tag) float64 {
+	if t.Kind() == tagger.FloatKind {
+		return t.FloatValue()
+	}
+	return float64(t.Value())
+}
+
+func boolValue(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// checkValue returns tagger.ErrInvalidValue for tags holding a value that
+// can't be stored and compared, which are floats that are NaN or infinite
+func checkValue(t tagger.Tag) error {
+	if t.Kind() == tagger.FloatKind && (math.IsNaN(t.FloatValue()) || math.IsInf(t.FloatValue(), 0)) {
+		return tagger.ErrInvalidValue
+	}
+	return nil
+}
+
+// sortKeys maps the paths of files to the value they are ordered by when
+// sorting by a tag
+type sortKeys map[string]tagger.Tag
+
+// add offers a value of the sort tag of a file. Files are ordered by their
+// smallest value, or their largest if sorting in descending order, like the
+// sort keys of SqliteStorage.QueryFiles.
+func (k sortKeys) add(path string, t tagger.Tag, descending bool) {
+	if !t.HasValue() {
+		return
+	}
+
+	key, ok := k[path]
+	if !ok || (!descending && compareTags(t, key) < 0) || (descending && compareTags(t, key) > 0) {
+		k[path] = t
+	}
+}
+
+// sortFiles orders files by their sort keys, with files without a key last
+// and ties ordered by path in the same direction. Files are ordered by path
+// if keys is nil.
+func sortFiles(files []tagger.File, keys sortKeys, descending bool) {
+	sort.SliceStable(files, func(i, j int) bool {
+		a, aok := keys[files[i].Path()]
+		b, bok := keys[files[j].Path()]
+		if aok != bok {
+			return aok
+		}
+
+		c := 0
+		if aok {
+			c = compareTags(a, b)
+		}
+		if c == 0 {
+			c = strings.Compare(files[i].Path(), files[j].Path())
+		}
+		if descending {
+			return c > 0
+		}
+		return c < 0
+	})
+}
+
+// pageFiles returns the range of the files given by the query options
+func pageFiles(files []tagger.File, opts tagger.QueryOptions) []tagger.File {
+	if opts.Offset >= len(files) {
+		return files[:0]
+	} else if opts.Offset > 0 {
+		files = files[opts.Offset:]
+	}
+	if opts.Limit > 0 && opts.Limit < len(files) {
+		files = files[:opts.Limit]
+	}
+	return files
+}
@@ -0,0 +1,1093 @@
+package storage
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"context"
+	"database/sql"
+	"fmt"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/kiljacken/tagger"
+	"strings"
+	"time"
+)
+
+// PostgresStorage is a storage engine backed by a postgres database, which
+// can be shared by several users at once. Filters are translated into sql,
+// and tag values are indexed by name and value.
+//
+// Queries go through a pool of connections, each of which caches the
+// statements it has prepared. A transactional view holds on to a single
+// connection until it is committed or rolled back, and must only be used by
+// one goroutine at a time.
+type PostgresStorage struct {
+	db *sql.DB
+	// q is used for all queries, and is either the database or the
+	// transaction of a transactional view
+	q  querier
+	tx *sql.Tx
+	// ctx is the context all queries are run with
+	ctx context.Context
+}
+
+// postgresTx is a transactional view of a PostgresStorage
+type postgresTx struct {
+	*PostgresStorage
+}
+
+// postgresView is a view of a PostgresStorage bound to a context
+type postgresView struct {
+	*PostgresStorage
+}
+
+// PostgresOptions are the settings of the connection pool of a postgres
+// database. Zero fields leave the database/sql default in place.
+type PostgresOptions struct {
+	// MaxOpenConns is the largest number of connections open at once
+	MaxOpenConns int
+	// MaxIdleConns is the largest number of idle connections kept open
+	MaxIdleConns int
+	// ConnMaxLifetime is how long a connection is used before it's replaced
+	ConnMaxLifetime time.Duration
+	// ConnMaxIdleTime is how long a connection may be idle before it's
+	// closed
+	ConnMaxIdleTime time.Duration
+}
+
+// DefaultPostgresOptions are settings suitable for a database shared with
+// other clients, which keep a few connections around without holding on to
+// them for long
+var DefaultPostgresOptions = PostgresOptions{
+	MaxOpenConns:    10,
+	MaxIdleConns:    2,
+	ConnMaxLifetime: time.Hour,
+	ConnMaxIdleTime: 5 * time.Minute,
+}
+
+// apply configures the connection pool of the database
+func (o PostgresOptions) apply(db *sql.DB) {
+	if o.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(o.MaxOpenConns)
+	}
+	if o.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(o.MaxIdleConns)
+	}
+	if o.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(o.ConnMaxLifetime)
+	}
+	if o.ConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(o.ConnMaxIdleTime)
+	}
+}
+
+func init() {
+	// Postgres DSNs are connection URLs, or key=value settings after the
+	// driver name
+	open := func(scheme string) Factory {
+		return func(location string) (tagger.StorageProvider, error) {
+			if strings.HasPrefix(location, "//") {
+				location = scheme + ":" + location
+			}
+
+			s, err := NewPostgresStorage(location)
+			if err != nil {
+				return nil, err
+			}
+			return s, nil
+		}
+	}
+	Register("postgres", open("postgres"))
+	Register("postgresql", open("postgresql"))
+}
+
+// NewPostgresStorage returns a new storage engine backed by the postgres
+// database with the given connection string, either a URL or a list of
+// key=value settings, using DefaultPostgresOptions
+func NewPostgresStorage(descriptor string) (*PostgresStorage, error) {
+	return NewPostgresStorageWithOptions(descriptor, DefaultPostgresOptions)
+}
+
+// NewPostgresStorageWithOptions returns a new storage engine backed by the
+// postgres database with the given connection string and pool settings
+func NewPostgresStorageWithOptions(descriptor string, opts PostgresOptions) (*PostgresStorage, error) {
+	db, err := sql.Open("pgx", descriptor)
+	if err != nil {
+		return nil, err
+	}
+	opts.apply(db)
+
+	// Connect right away, so an unreachable server is reported here
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	storage := &PostgresStorage{db: db, q: db, ctx: context.Background()}
+
+	// Bring the database schema up to date
+	_, err = storage.migrate()
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	return storage, nil
+}
+
+// withTx returns a transactional view of the storage using the transaction
+func (s *PostgresStorage) withTx(tx *sql.Tx) *PostgresStorage {
+	return &PostgresStorage{db: s.db, q: tx, tx: tx, ctx: s.ctx}
+}
+
+// postgresUUID returns the value stored for a UUID, which is NULL for
+// invalid UUIDs so they don't match any file
+func postgresUUID(u uuid.UUID) interface{} {
+	if len(u) != uuidLen {
+		return nil
+	}
+	return u.String()
+}
+
+// postgresValue converts a tag to the kind and values stored in the tags
+// table. Values a tag doesn't have are NULL. It fails for values that can't
+// be stored, such as NaN.
+func postgresValue(t tagger.Tag) (kind tagger.Kind, intValue, floatValue, stringValue interface{}, err error) {
+	if err := checkValue(t); err != nil {
+		return tagger.NoKind, nil, nil, nil, err
+	}
+
+	switch t.Kind() {
+	case tagger.IntKind:
+		return tagger.IntKind, int64(t.Value()), float64(t.Value()), nil, nil
+	case tagger.StringKind:
+		return tagger.StringKind, nil, nil, t.StringValue(), nil
+	case tagger.FloatKind:
+		return tagger.FloatKind, nil, t.FloatValue(), nil, nil
+	case tagger.DateKind:
+		// Dates are only stored to the second, like in sqlite
+		return tagger.DateKind, t.DateValue().Unix(), nil, nil, nil
+	case tagger.BoolKind:
+		return tagger.BoolKind, boolValue(t.BoolValue()), nil, nil, nil
+	}
+	return tagger.NoKind, nil, nil, nil, nil
+}
+
+// tagColumns are the columns of the tags table read by scanPostgresTag
+const tagColumns = `name, kind, int_value, float_value, string_value`
+
+// scanPostgresTag reads a tag from a row with the columns in tagColumns
+func scanPostgresTag(row scanner) (tagger.Tag, error) {
+	var name string
+	var kind int64
+	var intValue sql.NullInt64
+	var floatValue sql.NullFloat64
+	var stringValue sql.NullString
+	err := row.Scan(&name, &kind, &intValue, &floatValue, &stringValue)
+	if err != nil {
+		return nil, err
+	}
+
+	return postgresTag(name, tagger.Kind(kind), intValue, floatValue, stringValue)
+}
+
+// postgresTag creates a tag from the values stored in the tags table
+func postgresTag(name string, kind tagger.Kind, intValue sql.NullInt64, floatValue sql.NullFloat64, stringValue sql.NullString) (tagger.Tag, error) {
+	switch {
+	case kind == tagger.NoKind:
+		return tagger.NewNamedTag(name), nil
+	case kind == tagger.IntKind && intValue.Valid:
+		return tagger.NewValueTag(name, int(intValue.Int64)), nil
+	case kind == tagger.StringKind && stringValue.Valid:
+		return tagger.NewStringTag(name, stringValue.String), nil
+	case kind == tagger.FloatKind && floatValue.Valid:
+		return tagger.NewFloatTag(name, floatValue.Float64), nil
+	case kind == tagger.DateKind && intValue.Valid:
+		return tagger.NewDateTag(name, time.Unix(intValue.Int64, 0).UTC()), nil
+	case kind == tagger.BoolKind && intValue.Valid:
+		return tagger.NewBoolTag(name, intValue.Int64 != 0), nil
+	}
+
+	// The stored kind and values don't fit together
+	return nil, fmt.Errorf("%w: Invalid value of kind %d for tag %s", tagger.ErrStorageCorrupt, kind, name)
+}
+
+func (s *PostgresStorage) Close() error {
+	return s.db.Close()
+}
+
+func (s *PostgresStorage) Begin() (tagger.Tx, error) {
+	if s.tx != nil {
+		return nil, tagger.ErrNestedTx
+	}
+
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return postgresTx{s.withTx(tx)}, nil
+}
+
+func (s *PostgresStorage) WithContext(ctx context.Context) tagger.StorageProvider {
+	view := *s
+	view.ctx = ctx
+	return postgresView{&view}
+}
+
+// Close does nothing, as the view shares the database of the storage
+func (v postgresView) Close() error {
+	return nil
+}
+
+// atomic runs the function with a transactional view of the storage, which
+// is committed if the function succeeds. If the storage already is a
+// transactional view, the function is run as part of that transaction.
+func (s *PostgresStorage) atomic(fn func(s *PostgresStorage) error) error {
+	if s.tx != nil {
+		return fn(s)
+	}
+
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(s.withTx(tx))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Commit commits the changes made through the transaction
+func (t postgresTx) Commit() error {
+	return t.tx.Commit()
+}
+
+// Rollback discards the changes made through the transaction
+func (t postgresTx) Rollback() error {
+	return t.tx.Rollback()
+}
+
+// Close rolls back the transaction unless it has been committed. It doesn't
+// close the underlying database.
+func (t postgresTx) Close() error {
+	err := t.tx.Rollback()
+	if err == sql.ErrTxDone {
+		return nil
+	}
+	return err
+}
+
+// getFile reads a single file with a query
+func (s *PostgresStorage) getFile(query string, args ...interface{}) (tagger.File, error) {
+	f, err := scanFile(s.q.QueryRowContext(s.ctx, query, args...))
+	if err == sql.ErrNoRows {
+		// If no row was found, no such file exists
+		return tagger.File{}, tagger.ErrNoFile
+	} else if err != nil {
+		return tagger.File{}, err
+	}
+
+	return f, nil
+}
+
+const getPostgresFileStmt = `SELECT ` + fileColumns + ` FROM files WHERE uuid = $1`
+
+func (s *PostgresStorage) GetFile(u uuid.UUID) (tagger.File, error) {
+	return s.getFile(getPostgresFileStmt, postgresUUID(u))
+}
+
+const getPostgresFileForPathStmt = `SELECT ` + fileColumns + ` FROM files WHERE path = $1`
+
+func (s *PostgresStorage) GetFileForPath(path string) (tagger.File, error) {
+	return s.getFile(getPostgresFileForPathStmt, path)
+}
+
+const getPostgresFileForHashStmt = `SELECT ` + fileColumns + ` FROM files WHERE hash = $1 ORDER BY path LIMIT 1`
+
+func (s *PostgresStorage) GetFileForHash(sum string) (tagger.File, error) {
+	return s.getFile(getPostgresFileForHashStmt, sum)
+}
+
+const getPostgresAllFilesStmt = `SELECT ` + fileColumns + ` FROM files ORDER BY path`
+
+func (s *PostgresStorage) GetAllFiles() ([]tagger.File, error) {
+	it, err := s.IterateAllFiles()
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	return collectFiles(it)
+}
+
+func (s *PostgresStorage) IterateAllFiles() (tagger.FileIterator, error) {
+	rows, err := s.q.QueryContext(s.ctx, getPostgresAllFilesStmt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqlFileIterator{rows: rows}, nil
+}
+
+func (s *PostgresStorage) GetMatchingFiles(f tagger.Filter) ([]tagger.File, error) {
+	it, err := s.IterateMatchingFiles(f)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	return collectFiles(it)
+}
+
+func (s *PostgresStorage) IterateMatchingFiles(f tagger.Filter) (tagger.FileIterator, error) {
+	return s.QueryFiles(f, tagger.QueryOptions{})
+}
+
+// filterCondition translates a filter into a postgres condition, after
+// replacing aliases in the filter with the tag names they refer to. The
+// rewritten filter is returned as well, for matching it in memory if it
+// can't be translated.
+func (s *PostgresStorage) filterCondition(f tagger.Filter, offset int) (*sqlFilter, tagger.Filter, error) {
+	aliases, err := s.GetAliases()
+	if err != nil {
+		return nil, nil, err
+	}
+	f = tagger.RewriteAliases(f, aliases)
+
+	q, err := compileFilter(f, postgresDialect, offset)
+	return q, f, err
+}
+
+const queryPostgresFilesStmt = `SELECT ` + fileColumns + ` FROM files%s WHERE %s ORDER BY %s`
+
+// postgresValueOrder orders the values of tags the way compareTags does, with
+// floats ordered together with integers
+var postgresValueOrder = kindOrder("kind") + ` %[1]s, float_value %[1]s, int_value %[1]s, string_value %[1]s`
+
+// postgresSortKeyJoin joins the value a file is ordered by when sorting by a
+// tag, which is the smallest value or the largest in descending order
+var postgresSortKeyJoin = fmt.Sprintf(` LEFT JOIN LATERAL (
+	SELECT %s AS kind, float_value, int_value, string_value FROM tags
+	WHERE tags.uuid = files.uuid AND tags.name = $1 AND tags.kind <> %d
+	ORDER BY %s LIMIT 1
+) AS sort_key ON TRUE`, kindOrder("kind"), tagger.NoKind, postgresValueOrder)
+
+func (s *PostgresStorage) QueryFiles(f tagger.Filter, opts tagger.QueryOptions) (tagger.FileIterator, error) {
+	dir := "ASC"
+	if opts.Descending {
+		dir = "DESC"
+	}
+
+	// Order by the sort tag if there is one, and by path otherwise
+	join, order := "", fmt.Sprintf("path %s", dir)
+	args := make([]interface{}, 0)
+	if opts.SortTag != "" {
+		name, err := s.resolveAlias(opts.SortTag)
+		if err != nil {
+			return nil, err
+		}
+
+		join = fmt.Sprintf(postgresSortKeyJoin, dir)
+		order = fmt.Sprintf("sort_key.kind %[1]s NULLS LAST, sort_key.float_value %[1]s, sort_key.int_value %[1]s, sort_key.string_value %[1]s, %[2]s", dir, order)
+		args = append(args, name)
+	}
+
+	// Translate the filter into a sql condition, if there is one
+	cond := "TRUE"
+	var slow tagger.Filter
+	if f != nil {
+		q, rewritten, err := s.filterCondition(f, len(args))
+		if err == errUnsupportedFilter {
+			slow = rewritten
+		} else if err != nil {
+			return nil, err
+		} else {
+			cond = q.cond
+			args = append(args, q.args...)
+		}
+	}
+
+	// Let the database skip files when the filter is matched in sql
+	query := fmt.Sprintf(queryPostgresFilesStmt, join, cond, order)
+	if slow == nil && (opts.Limit > 0 || opts.Offset > 0) {
+		var limit interface{}
+		if opts.Limit > 0 {
+			limit = opts.Limit
+		}
+		query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)+1, len(args)+2)
+		args = append(args, limit, opts.Offset)
+	}
+
+	rows, err := s.q.QueryContext(s.ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var it tagger.FileIterator = &sqlFileIterator{rows: rows}
+	if slow != nil {
+		// A connection can't run another query while reading rows, so the
+		// files are read before their tags are looked up
+		files, err := collectFiles(it)
+		it.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		it = &filterIterator{FileIterator: &sliceIterator{files: files}, filter: slow, tags: s.GetTags}
+		it = &limitIterator{FileIterator: it, offset: opts.Offset, limit: opts.Limit}
+	}
+
+	return it, nil
+}
+
+// addPostgresTagValueStmt adds a tag value unless the file already has it.
+// A file that isn't stored is checked for up front, as a failed foreign key
+// would abort the transaction.
+const addPostgresTagValueStmt = `
+	INSERT INTO tags (uuid, name, kind, int_value, float_value, string_value)
+	SELECT $1::UUID, $2::TEXT, $3::SMALLINT, $4::BIGINT, $5::DOUBLE PRECISION, $6::TEXT
+	WHERE EXISTS (SELECT 1 FROM files WHERE uuid = $1)
+	ON CONFLICT DO NOTHING
+`
+const hasPostgresFileStmt = `SELECT EXISTS (SELECT 1 FROM files WHERE uuid = $1)`
+
+func (s *PostgresStorage) UpdateTag(f tagger.File, t tagger.Tag) error {
+	return s.atomic(func(s *PostgresStorage) error {
+		err := s.updateTag(f, t)
+		if err != nil {
+			return err
+		}
+
+		// Add any tags implied by the new tag
+		rules, err := s.canonicalRules()
+		if err != nil {
+			return err
+		}
+		return s.applyRules(f, rules)
+	})
+}
+
+// updateTag replaces the values of a tag without applying rules
+func (s *PostgresStorage) updateTag(f tagger.File, t tagger.Tag) error {
+	// Check the value before the old values are removed
+	if err := checkValue(t); err != nil {
+		return err
+	}
+
+	err := s.RemoveTag(f, t)
+	if err != nil {
+		return err
+	}
+	return s.addTagValue(f, t)
+}
+
+func (s *PostgresStorage) AddTagValue(f tagger.File, t tagger.Tag) error {
+	return s.atomic(func(s *PostgresStorage) error {
+		err := s.addTagValue(f, t)
+		if err != nil {
+			return err
+		}
+
+		// Add any tags implied by the new value
+		rules, err := s.canonicalRules()
+		if err != nil {
+			return err
+		}
+		return s.applyRules(f, rules)
+	})
+}
+
+// addTagValue adds a value to a tag without applying rules
+func (s *PostgresStorage) addTagValue(f tagger.File, t tagger.Tag) error {
+	// Store the tag under it's canonical name
+	t, err := s.canonicalTag(t)
+	if err != nil {
+		return err
+	}
+
+	// Add the value unless the file already has it
+	id := postgresUUID(f.UUID())
+	kind, intValue, floatValue, stringValue, err := postgresValue(t)
+	if err != nil {
+		return err
+	}
+	res, err := s.q.ExecContext(s.ctx, addPostgresTagValueStmt, id, t.Name(), kind, intValue, floatValue, stringValue)
+	if err != nil {
+		return err
+	}
+
+	// If nothing was added, either the file already has the value or it
+	// isn't stored
+	n, err := res.RowsAffected()
+	if err != nil || n > 0 {
+		return err
+	}
+
+	var exists bool
+	err = s.q.QueryRowContext(s.ctx, hasPostgresFileStmt, id).Scan(&exists)
+	if err != nil {
+		return err
+	} else if !exists {
+		return tagger.ErrNoFile
+	}
+	return nil
+}
+
+// postgresSameValue matches the row of a tag with the given kind and values
+const postgresSameValue = `kind = $3 AND int_value IS NOT DISTINCT FROM $4 AND float_value IS NOT DISTINCT FROM $5 AND string_value IS NOT DISTINCT FROM $6`
+
+const removePostgresTagValueStmt = `DELETE FROM tags WHERE uuid = $1 AND name = $2 AND ` + postgresSameValue
+
+func (s *PostgresStorage) RemoveTagValue(f tagger.File, t tagger.Tag) error {
+	// Look up the tag under it's canonical name
+	t, err := s.canonicalTag(t)
+	if err != nil {
+		return err
+	}
+
+	kind, intValue, floatValue, stringValue, err := postgresValue(t)
+	if err != nil {
+		return err
+	}
+	_, err = s.q.ExecContext(s.ctx, removePostgresTagValueStmt, postgresUUID(f.UUID()), t.Name(), kind, intValue, floatValue, stringValue)
+	return err
+}
+
+const getPostgresTagValuesStmt = `SELECT ` + tagColumns + ` FROM tags WHERE uuid = $1 AND name = $2`
+
+func (s *PostgresStorage) GetTagValues(f tagger.File, name string) ([]tagger.Tag, error) {
+	// Look up the tag under it's canonical name
+	name, err := s.resolveAlias(name)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := s.queryTags(getPostgresTagValuesStmt, postgresUUID(f.UUID()), name)
+	if err != nil {
+		return nil, err
+	}
+
+	// If no values were found, the file doesn't have the tag
+	if len(tags) == 0 {
+		return nil, tagger.ErrNoTag
+	}
+
+	return tags, nil
+}
+
+const removePostgresTagStmt = `DELETE FROM tags WHERE uuid = $1 AND name = $2`
+
+func (s *PostgresStorage) RemoveTag(f tagger.File, t tagger.Tag) error {
+	// Look up the tag under it's canonical name
+	name, err := s.resolveAlias(t.Name())
+	if err != nil {
+		return err
+	}
+
+	_, err = s.q.ExecContext(s.ctx, removePostgresTagStmt, postgresUUID(f.UUID()), name)
+	return err
+}
+
+const getPostgresTagsStmt = `SELECT ` + tagColumns + ` FROM tags WHERE uuid = $1`
+
+func (s *PostgresStorage) GetTags(f tagger.File) ([]tagger.Tag, error) {
+	return s.queryTags(getPostgresTagsStmt, postgresUUID(f.UUID()))
+}
+
+// queryTags reads the tags returned by a query
+func (s *PostgresStorage) queryTags(query string, args ...interface{}) ([]tagger.Tag, error) {
+	rows, err := s.q.QueryContext(s.ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make([]tagger.Tag, 0)
+	for rows.Next() {
+		tag, err := scanPostgresTag(rows)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+// getPostgresAllTagsStmt aggregates the usage of each tag name, along with
+// the kind and values of the smallest and largest values
+var getPostgresAllTagsStmt = fmt.Sprintf(`
+	SELECT n.name, n.files, n.valueless,
+		lo.kind, lo.int_value, lo.float_value, lo.string_value,
+		hi.kind, hi.int_value, hi.float_value, hi.string_value
+	FROM (
+		SELECT name, COUNT(DISTINCT uuid) AS files, BOOL_OR(kind = %[1]d) AS valueless
+		FROM tags GROUP BY name
+	) AS n
+	LEFT JOIN LATERAL (
+		SELECT kind, int_value, float_value, string_value FROM tags
+		WHERE tags.name = n.name AND tags.kind <> %[1]d
+		ORDER BY %[2]s LIMIT 1
+	) AS lo ON TRUE
+	LEFT JOIN LATERAL (
+		SELECT kind, int_value, float_value, string_value FROM tags
+		WHERE tags.name = n.name AND tags.kind <> %[1]d
+		ORDER BY %[3]s LIMIT 1
+	) AS hi ON TRUE
+	ORDER BY n.name
+`, tagger.NoKind, fmt.Sprintf(postgresValueOrder, "ASC"), fmt.Sprintf(postgresValueOrder, "DESC"))
+
+func (s *PostgresStorage) GetAllTags() ([]tagger.TagInfo, error) {
+	rows, err := s.q.QueryContext(s.ctx, getPostgresAllTagsStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	infos := make([]tagger.TagInfo, 0)
+	for rows.Next() {
+		var info tagger.TagInfo
+		var loKind, hiKind sql.NullInt64
+		var loInt, hiInt sql.NullInt64
+		var loFloat, hiFloat sql.NullFloat64
+		var loString, hiString sql.NullString
+		err = rows.Scan(&info.Name, &info.Files, &info.Valueless,
+			&loKind, &loInt, &loFloat, &loString,
+			&hiKind, &hiInt, &hiFloat, &hiString)
+		if err != nil {
+			return nil, err
+		}
+
+		// If the tag ever has a value, create tags for the extremes
+		if loKind.Valid && hiKind.Valid {
+			info.Min, err = postgresTag(info.Name, tagger.Kind(loKind.Int64), loInt, loFloat, loString)
+			if err != nil {
+				return nil, err
+			}
+
+			info.Max, err = postgresTag(info.Name, tagger.Kind(hiKind.Int64), hiInt, hiFloat, hiString)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		infos = append(infos, info)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return infos, nil
+}
+
+const getPostgresTagNamesStmt = `SELECT DISTINCT name FROM tags WHERE name >= $1 AND ($2::TEXT IS NULL OR name < $2)`
+
+func (s *PostgresStorage) GetChildTags(parent string) ([]string, error) {
+	// Fetch the names of all tags below the parent
+	var low, high interface{} = "", nil
+	if parent != "" {
+		low, high = descendantRange(parent)
+	}
+
+	rows, err := s.q.QueryContext(s.ctx, getPostgresTagNamesStmt, low, high)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	// Reduce the names to the direct children
+	return tagger.ChildTags(names, parent), nil
+}
+
+const resolvePostgresAliasStmt = `SELECT name FROM aliases WHERE alias = $1`
+
+// resolveAlias returns the tag name an alias refers to, or the name itself if
+// it isn't an alias
+func (s *PostgresStorage) resolveAlias(name string) (string, error) {
+	var canonical string
+	err := s.q.QueryRowContext(s.ctx, resolvePostgresAliasStmt, name).Scan(&canonical)
+	if err == sql.ErrNoRows {
+		return name, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return canonical, nil
+}
+
+// canonicalTag returns the tag renamed to it's canonical name if it's name is
+// an alias
+func (s *PostgresStorage) canonicalTag(t tagger.Tag) (tagger.Tag, error) {
+	name, err := s.resolveAlias(t.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	if name != t.Name() {
+		return tagger.RenameTag(t, name), nil
+	}
+	return t, nil
+}
+
+const addPostgresAliasStmt = `INSERT INTO aliases (alias, name) VALUES ($1, $2) ON CONFLICT (alias) DO UPDATE SET name = EXCLUDED.name`
+const retargetPostgresAliasesStmt = `UPDATE aliases SET name = $1 WHERE name = $2`
+
+// removePostgresDuplicateTagsStmt removes the values of a tag that the file
+// already has under the name the tag is renamed to
+const removePostgresDuplicateTagsStmt = `
+	DELETE FROM tags AS a WHERE a.name = $2 AND EXISTS (
+		SELECT 1 FROM tags AS b WHERE b.uuid = a.uuid AND b.name = $1 AND b.kind = a.kind
+			AND b.int_value IS NOT DISTINCT FROM a.int_value
+			AND b.float_value IS NOT DISTINCT FROM a.float_value
+			AND b.string_value IS NOT DISTINCT FROM a.string_value
+	)
+`
+const renamePostgresTagsStmt = `UPDATE tags SET name = $1 WHERE name = $2`
+
+func (s *PostgresStorage) AddAlias(alias, name string) error {
+	return s.atomic(func(s *PostgresStorage) error {
+		return s.addAlias(alias, name)
+	})
+}
+
+func (s *PostgresStorage) addAlias(alias, name string) error {
+	// Make the alias refer to the end of any chain of aliases
+	name, err := s.resolveAlias(name)
+	if err != nil {
+		return err
+	}
+
+	if name == alias {
+		return tagger.ErrAliasCycle
+	}
+
+	// Add the alias
+	_, err = s.q.ExecContext(s.ctx, addPostgresAliasStmt, alias, name)
+	if err != nil {
+		return err
+	}
+
+	// Point aliases of the alias at the tag name instead
+	_, err = s.q.ExecContext(s.ctx, retargetPostgresAliasesStmt, name, alias)
+	if err != nil {
+		return err
+	}
+
+	// Move tags stored under the alias to the tag name, where each value
+	// may only be stored once per file
+	_, err = s.q.ExecContext(s.ctx, removePostgresDuplicateTagsStmt, name, alias)
+	if err != nil {
+		return err
+	}
+	_, err = s.q.ExecContext(s.ctx, renamePostgresTagsStmt, name, alias)
+	return err
+}
+
+const removePostgresAliasStmt = `DELETE FROM aliases WHERE alias = $1`
+
+func (s *PostgresStorage) RemoveAlias(alias string) error {
+	_, err := s.q.ExecContext(s.ctx, removePostgresAliasStmt, alias)
+	return err
+}
+
+const getPostgresAliasesStmt = `SELECT alias, name FROM aliases`
+
+func (s *PostgresStorage) GetAliases() (map[string]string, error) {
+	rows, err := s.q.QueryContext(s.ctx, getPostgresAliasesStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aliases := make(map[string]string)
+	for rows.Next() {
+		var alias, name string
+		if err := rows.Scan(&alias, &name); err != nil {
+			return nil, err
+		}
+		aliases[alias] = name
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return aliases, nil
+}
+
+const addPostgresRuleStmt = `
+	INSERT INTO rules (condition, name, kind, int_value, float_value, string_value)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id
+`
+
+// lockPostgresRulesStmt keeps other clients from adding rules until the
+// transaction ends, so two rules that only form a cycle together can't be
+// added at the same time
+const lockPostgresRulesStmt = `LOCK TABLE rules IN SHARE ROW EXCLUSIVE MODE`
+
+func (s *PostgresStorage) AddRule(r tagger.Rule) (int, error) {
+	var id int
+	err := s.atomic(func(s *PostgresStorage) error {
+		var err error
+		id, err = s.addRule(r)
+		return err
+	})
+	return id, err
+}
+
+func (s *PostgresStorage) addRule(r tagger.Rule) (int, error) {
+	_, err := s.q.ExecContext(s.ctx, lockPostgresRulesStmt)
+	if err != nil {
+		return 0, err
+	}
+
+	// Make sure the new rule doesn't cause any cycles
+	rules, err := s.GetRules()
+	if err != nil {
+		return 0, err
+	}
+
+	err = tagger.CheckRules(append(rules, r))
+	if err != nil {
+		return 0, err
+	}
+
+	// Store the rule, with the condition in the filter language
+	var id int
+	kind, intValue, floatValue, stringValue, err := postgresValue(r.Implies)
+	if err != nil {
+		return 0, err
+	}
+	err = s.q.QueryRowContext(s.ctx, addPostgresRuleStmt, r.Condition.String(), r.Implies.Name(), kind, intValue, floatValue, stringValue).Scan(&id)
+	return id, err
+}
+
+const removePostgresRuleStmt = `DELETE FROM rules WHERE id = $1`
+
+func (s *PostgresStorage) RemoveRule(id int) error {
+	res, err := s.q.ExecContext(s.ctx, removePostgresRuleStmt, id)
+	if err != nil {
+		return err
+	}
+
+	// If nothing was deleted, no such rule exists
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return tagger.ErrNoRule
+	}
+
+	return nil
+}
+
+const getPostgresRulesStmt = `SELECT id, condition, ` + tagColumns + ` FROM rules ORDER BY id`
+
+func (s *PostgresStorage) GetRules() ([]tagger.Rule, error) {
+	rows, err := s.q.QueryContext(s.ctx, getPostgresRulesStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := make([]tagger.Rule, 0)
+	for rows.Next() {
+		var id int
+		var cond, name string
+		var kind int64
+		var intValue sql.NullInt64
+		var floatValue sql.NullFloat64
+		var stringValue sql.NullString
+		err = rows.Scan(&id, &cond, &name, &kind, &intValue, &floatValue, &stringValue)
+		if err != nil {
+			return nil, err
+		}
+
+		// Parse the condition and create the implied tag
+		filter, err := tagger.ParseFilter(strings.NewReader(cond))
+		if err != nil {
+			return nil, fmt.Errorf("%w: Invalid condition in rule %d: %w", tagger.ErrStorageCorrupt, id, err)
+		}
+
+		tag, err := postgresTag(name, tagger.Kind(kind), intValue, floatValue, stringValue)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, tagger.Rule{ID: id, Condition: filter, Implies: tag})
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return rules, nil
+}
+
+func (s *PostgresStorage) ApplyRules() error {
+	return s.atomic(func(s *PostgresStorage) error {
+		rules, err := s.canonicalRules()
+		if err != nil || len(rules) == 0 {
+			return err
+		}
+
+		// Get ALL files
+		files, err := s.GetAllFiles()
+		if err != nil {
+			return err
+		}
+
+		// Apply the rules to each of them
+		for _, file := range files {
+			err = s.applyRules(file, rules)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// canonicalRules returns the rules with conditions using the canonical tag
+// names. The rules are loaded once for each operation and passed to
+// applyRules, as they are parsed when read.
+func (s *PostgresStorage) canonicalRules() ([]tagger.Rule, error) {
+	rules, err := s.GetRules()
+	if err != nil || len(rules) == 0 {
+		return rules, err
+	}
+
+	// Tags are stored under their canonical names, so the conditions must
+	// use them as well
+	aliases, err := s.GetAliases()
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		rules[i].Condition = tagger.RewriteAliases(rules[i].Condition, aliases)
+	}
+
+	return rules, nil
+}
+
+// applyRules adds the tags implied by the tags of a file
+func (s *PostgresStorage) applyRules(f tagger.File, rules []tagger.Rule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	tags, err := s.GetTags(f)
+	if err != nil {
+		return err
+	}
+
+	// Add each of the implied tags
+	for _, tag := range tagger.ImpliedTags(rules, tags) {
+		err = s.addTagValue(f, tag)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeReplacedFileStmt removes a file stored with the path under another
+// UUID, along with it's tags
+const removeReplacedFileStmt = `DELETE FROM files WHERE path = $1 AND uuid <> $2`
+const updatePostgresFileStmt = `
+	INSERT INTO files (uuid, path, hash, size, mtime) VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (uuid) DO UPDATE SET path = EXCLUDED.path, hash = EXCLUDED.hash, size = EXCLUDED.size, mtime = EXCLUDED.mtime
+`
+
+func (s *PostgresStorage) UpdateFile(f tagger.File, t []tagger.Tag) error {
+	return s.atomic(func(s *PostgresStorage) error {
+		return s.updateFile(f, t)
+	})
+}
+
+func (s *PostgresStorage) updateFile(f tagger.File, t []tagger.Tag) error {
+	id := postgresUUID(f.UUID())
+	if id == nil {
+		return fmt.Errorf("storage: Invalid UUID for %s", f.Path())
+	}
+
+	// Check the values before anything is changed
+	for _, tag := range t {
+		if err := checkValue(tag); err != nil {
+			return err
+		}
+	}
+
+	// Replace any other file with the path
+	_, err := s.q.ExecContext(s.ctx, removeReplacedFileStmt, f.Path(), id)
+	if err != nil {
+		return err
+	}
+
+	// Store the file, with NULLs for the content hash if it isn't known
+	var hash, size, mtime interface{}
+	if h, ok := f.Hash(); ok {
+		hash, size, mtime = h.Sum, h.Size, h.ModTime.UnixNano()
+	}
+	_, err = s.q.ExecContext(s.ctx, updatePostgresFileStmt, id, f.Path(), hash, size, mtime)
+	if err != nil {
+		return err
+	}
+
+	// Further values of a tag with several values are added to the first
+	// value, including values given under an alias of the tag
+	seen := make(map[string]bool)
+	for _, tag := range t {
+		name, err := s.resolveAlias(tag.Name())
+		if err != nil {
+			return err
+		}
+
+		if seen[name] {
+			err = s.addTagValue(f, tag)
+		} else {
+			err = s.updateTag(f, tag)
+		}
+		if err != nil {
+			return err
+		}
+		seen[name] = true
+	}
+
+	// Add any tags implied by the tags of the file
+	rules, err := s.canonicalRules()
+	if err != nil {
+		return err
+	}
+	return s.applyRules(f, rules)
+}
+
+// removePostgresFileStmt removes a file, and it's tags along with it
+const removePostgresFileStmt = `DELETE FROM files WHERE uuid = $1`
+
+func (s *PostgresStorage) RemoveFile(f tagger.File) error {
+	_, err := s.q.ExecContext(s.ctx, removePostgresFileStmt, postgresUUID(f.UUID()))
+	return err
+}
@@ -0,0 +1,20 @@
+package storage
+
+import (
+	"github.com/kiljacken/tagger"
+	"github.com/kiljacken/tagger/storage/storagetest"
+	"testing"
+)
+
+// TestPostgres runs the suite against a postgres server of it's own, and is
+// skipped if the postgres server programs aren't installed
+func TestPostgres(t *testing.T) {
+	pg := storagetest.StartPostgres(t)
+	storagetest.Run(t, func(t *testing.T) tagger.StorageProvider {
+		p, err := NewPostgresStorage(pg.NewDatabase(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	})
+}
@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/kiljacken/tagger"
+	"time"
+)
+
+// postgresDialect compiles filters for the schema of PostgresStorage, where
+// values are stored in a column for each type
+var postgresDialect = sqlDialect{
+	files:       "files",
+	placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+	compare:     comparePostgresValue,
+}
+
+// comparePostgresValue compares the column holding values of the kinds the
+// filter value can be compared with
+func comparePostgresValue(q *sqlFilter, v interface{}, op string) (string, error) {
+	switch v := v.(type) {
+	case int:
+		// Integers compare exactly with integers, and as floats with floats
+		return fmt.Sprintf(`((tags.kind = %d AND tags.int_value %s %s) OR (tags.kind = %d AND tags.float_value %s %s))`,
+			tagger.IntKind, op, q.arg(v), tagger.FloatKind, op, q.arg(float64(v))), nil
+	case float64:
+		return fmt.Sprintf(`(tags.kind IN (%d, %d) AND tags.float_value %s %s)`,
+			tagger.IntKind, tagger.FloatKind, op, q.arg(v)), nil
+	case string:
+		return fmt.Sprintf(`(tags.kind = %d AND tags.string_value %s %s)`, tagger.StringKind, op, q.arg(v)), nil
+	case time.Time:
+		return fmt.Sprintf(`(tags.kind = %d AND tags.int_value %s %s)`, tagger.DateKind, op, q.arg(v.Unix())), nil
+	case bool:
+		return fmt.Sprintf(`(tags.kind = %d AND tags.int_value %s %s)`, tagger.BoolKind, op, q.arg(boolValue(v))), nil
+	}
+
+	return "", errUnsupportedFilter
+}
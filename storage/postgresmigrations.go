@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/kiljacken/tagger"
+)
+
+// postgresMigrations lists every change made to the postgres database schema,
+// in order. Like sqliteMigrations, the schema version of a database is the
+// number of migrations applied to it, so migrations must only be appended.
+//
+// Tag values are stored in a column of their own type, so the database can
+// compare and index them. Integers are stored in both int_value and
+// float_value, so they are ordered and compared together with floats, while
+// dates and bools are stored as integers like in sqlite. Paths, names and
+// strings are compared bytewise, like in Go.
+var postgresMigrations = []struct {
+	description string
+	stmt        string
+}{
+	{"create files and tags tables", `
+		CREATE TABLE files(
+			uuid UUID PRIMARY KEY,
+			path TEXT COLLATE "C" NOT NULL UNIQUE,
+			hash TEXT,
+			size BIGINT,
+			mtime BIGINT
+		);
+		CREATE INDEX files_hash ON files(hash, path);
+		CREATE TABLE tags(
+			uuid UUID NOT NULL REFERENCES files(uuid) ON DELETE CASCADE,
+			name TEXT COLLATE "C" NOT NULL,
+			kind SMALLINT NOT NULL,
+			int_value BIGINT,
+			float_value DOUBLE PRECISION,
+			string_value TEXT COLLATE "C"
+		);
+		CREATE UNIQUE INDEX tags_value ON tags(uuid, name, kind,
+			COALESCE(int_value, 0), COALESCE(float_value, 0), COALESCE(string_value, ''));
+		CREATE INDEX tags_name_int ON tags(name, kind, int_value) WHERE int_value IS NOT NULL;
+		CREATE INDEX tags_name_float ON tags(name, float_value) WHERE float_value IS NOT NULL;
+		CREATE INDEX tags_name_string ON tags(name, string_value) WHERE string_value IS NOT NULL;
+	`},
+	{"add aliases table", `
+		CREATE TABLE aliases(
+			alias TEXT COLLATE "C" PRIMARY KEY,
+			name TEXT COLLATE "C" NOT NULL
+		);
+	`},
+	{"add rules table", `
+		CREATE TABLE rules(
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			condition TEXT NOT NULL,
+			name TEXT NOT NULL,
+			kind SMALLINT NOT NULL,
+			int_value BIGINT,
+			float_value DOUBLE PRECISION,
+			string_value TEXT
+		);
+	`},
+}
+
+// postgresMigrationLock is the key of the advisory lock held while migrating,
+// so clients opening a new database at the same time don't both migrate it
+const postgresMigrationLock = 0x74616767
+
+const createPostgresSchemaVersionStmt = `CREATE TABLE IF NOT EXISTS schema_version(version INTEGER NOT NULL)`
+const lockPostgresSchemaStmt = `SELECT pg_advisory_xact_lock($1)`
+const getPostgresSchemaVersionStmt = `SELECT version FROM schema_version`
+const setPostgresSchemaVersionStmt = `DELETE FROM schema_version; INSERT INTO schema_version (version) VALUES (%d)`
+
+// migrate applies all pending migrations in a single transaction, and returns
+// the descriptions of the applied migrations.
+func (s *PostgresStorage) migrate() ([]string, error) {
+	var applied []string
+	err := s.atomic(func(s *PostgresStorage) error {
+		_, err := s.q.ExecContext(s.ctx, lockPostgresSchemaStmt, postgresMigrationLock)
+		if err != nil {
+			return err
+		}
+		_, err = s.q.ExecContext(s.ctx, createPostgresSchemaVersionStmt)
+		if err != nil {
+			return err
+		}
+
+		// A database without a version has no migrations applied
+		var version int
+		err = s.q.QueryRowContext(s.ctx, getPostgresSchemaVersionStmt).Scan(&version)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("%w: %w", tagger.ErrSchemaMismatch, err)
+		}
+
+		if version > len(postgresMigrations) {
+			return tagger.ErrSchemaTooNew
+		} else if version == len(postgresMigrations) {
+			return nil
+		}
+
+		for _, m := range postgresMigrations[version:] {
+			if _, err := s.q.ExecContext(s.ctx, m.stmt); err != nil {
+				return fmt.Errorf("%w: Migration %q failed: %w", tagger.ErrSchemaMismatch, m.description, err)
+			}
+			applied = append(applied, m.description)
+		}
+
+		// Record the new schema version
+		_, err = s.q.ExecContext(s.ctx, fmt.Sprintf(setPostgresSchemaVersionStmt, len(postgresMigrations)))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return applied, nil
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kiljacken/tagger"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrUnlistedMigrations is returned by PendingMigrations for drivers that
+// apply their migrations when a storage is opened, but can't list them
+var ErrUnlistedMigrations = errors.New("storage: Driver can't list pending migrations")
+
+// Factory opens a storage from the location in a DSN, which is everything
+// after the name of the driver and the colon following it
+type Factory func(location string) (tagger.StorageProvider, error)
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]Factory)
+	// migrations holds the functions listing the pending schema migrations
+	// of the drivers that support it
+	migrations = make(map[string]func(location string) ([]string, error))
+)
+
+// Register makes a storage driver available to Open under the given name.
+// Like sql.Register, it panics if a driver is registered twice or the
+// factory is nil.
+func Register(name string, factory Factory) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	if factory == nil {
+		panic("storage: Register factory is nil")
+	}
+	if _, dup := drivers[name]; dup {
+		panic("storage: Register called twice for driver " + name)
+	}
+	drivers[name] = factory
+}
+
+// registerMigrations makes the pending schema migrations of a driver
+// available to PendingMigrations
+func registerMigrations(name string, pending func(location string) ([]string, error)) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	migrations[name] = pending
+}
+
+// Drivers returns the names of the registered drivers in order
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseDSN splits a DSN into the name of the driver and the location of the
+// storage, such as "sqlite" and "/home/user/tags.db" for
+// "sqlite:/home/user/tags.db"
+func ParseDSN(dsn string) (driver, location string, err error) {
+	driver, location, ok := strings.Cut(dsn, ":")
+	if !ok || driver == "" {
+		return "", "", fmt.Errorf("storage: DSN %q doesn't start with a driver name, one of %s", dsn, strings.Join(Drivers(), ", "))
+	}
+	return driver, location, nil
+}
+
+// factory returns the factory of the driver named in a DSN, along with the
+// location of the storage
+func factory(dsn string) (string, Factory, string, error) {
+	driver, location, err := ParseDSN(dsn)
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	driversMu.RLock()
+	f, ok := drivers[driver]
+	driversMu.RUnlock()
+	if !ok {
+		return "", nil, "", fmt.Errorf("storage: Unknown driver %q, expected one of %s", driver, strings.Join(Drivers(), ", "))
+	}
+	return driver, f, location, nil
+}
+
+// Open opens the storage described by a DSN, which is the name of a
+// registered driver followed by a colon and the location of the storage:
+//
+//	sqlite:/home/user/tags.db
+//	bolt:/home/user/tags.bolt
+//	postgres://user@host/tags
+//	memory:
+func Open(dsn string) (tagger.StorageProvider, error) {
+	_, open, location, err := factory(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return open(location)
+}
+
+// PendingMigrations returns descriptions of the schema migrations that would
+// be applied when opening the storage described by a DSN, for drivers that
+// can list them
+func PendingMigrations(dsn string) ([]string, error) {
+	driver, _, location, err := factory(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	driversMu.RLock()
+	pending, ok := migrations[driver]
+	driversMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnlistedMigrations, driver)
+	}
+	return pending(location)
+}
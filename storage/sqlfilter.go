@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kiljacken/tagger"
+	"strings"
+	"time"
+)
+
+// errUnsupportedFilter is returned by the filter compiler when it encounters
+// a filter type it doesn't know how to translate into sql.
+var errUnsupportedFilter = errors.New("storage: Filter can't be translated to sql")
+
+// sqlDialect holds the parts of a compiled filter that differ between
+// databases
+type sqlDialect struct {
+	// files is the name of the table of files
+	files string
+	// placeholder returns the placeholder of the nth argument of a query,
+	// counting from one
+	placeholder func(n int) string
+	// compare returns a condition comparing the value of a tag with a
+	// filter value, adding the arguments it uses to the filter. The
+	// condition is never NULL, so it can be negated.
+	compare func(q *sqlFilter, v interface{}, op string) (string, error)
+}
+
+// sqliteDialect compiles filters for the schema of SqliteStorage. Arguments
+// are numbered, and plain placeholders following the condition in a query
+// continue after the last of them.
+var sqliteDialect = sqlDialect{
+	files:       "file",
+	placeholder: func(n int) string { return fmt.Sprintf("?%d", n) },
+	compare:     compareSqliteValue,
+}
+
+// sqlFilter is the result of compiling a filter into a sql condition
+type sqlFilter struct {
+	cond string
+	args []interface{}
+
+	dialect sqlDialect
+	// offset is the number of arguments in the query before the condition
+	offset int
+}
+
+// compileFilter translates a filter into a sql condition that is evaluated
+// against a row of the table of files. Each tag check is expressed as an
+// EXISTS subquery against the tags table, which allows the database to use
+// the indexes on the tags table instead of loading every file into memory.
+// The arguments of the condition are numbered after the given number of
+// arguments.
+func compileFilter(f tagger.Filter, dialect sqlDialect, offset int) (*sqlFilter, error) {
+	q := &sqlFilter{args: make([]interface{}, 0), dialect: dialect, offset: offset}
+
+	cond, err := q.compile(f)
+	if err != nil {
+		return nil, err
+	}
+	q.cond = cond
+
+	return q, nil
+}
+
+// arg adds an argument and returns it's placeholder
+func (q *sqlFilter) arg(v interface{}) string {
+	q.args = append(q.args, v)
+	return q.dialect.placeholder(q.offset + len(q.args))
+}
+
+// exists returns a condition checking whether the file has a tag matching
+// the given condition
+func (q *sqlFilter) exists(cond string) string {
+	return fmt.Sprintf(`EXISTS (SELECT 1 FROM tags WHERE tags.uuid = %s.uuid AND %s)`, q.dialect.files, cond)
+}
+
+func (q *sqlFilter) compile(f tagger.Filter) (string, error) {
+	switch f := f.(type) {
+	case tagger.NameFilter:
+		if f.Descendants {
+			// Descendants are matched with a range on the name, so the index
+			// on the tag names can be used
+			low, high := descendantRange(f.Name)
+			return q.exists(fmt.Sprintf(`(tags.name = %s OR (tags.name >= %s AND tags.name < %s))`,
+				q.arg(f.Name), q.arg(low), q.arg(high))), nil
+		}
+
+		return q.exists(fmt.Sprintf(`tags.name = %s`, q.arg(f.Name))), nil
+
+	case tagger.ComparinsonFilter:
+		op, err := comparatorToSql(f.Function)
+		if err != nil {
+			return "", err
+		}
+
+		// Only tags holding a value of a comparable kind are considered,
+		// which also rules out tags without a value.
+		match, err := q.dialect.compare(q, f.Value, op)
+		if err != nil {
+			return "", err
+		}
+
+		if f.All {
+			// The file must have the tag, and no value may fail to match
+			has := q.exists(fmt.Sprintf(`tags.name = %s`, q.arg(f.Name)))
+			fails := q.exists(fmt.Sprintf(`tags.name = %s AND NOT (%s)`, q.arg(f.Name), match))
+			return fmt.Sprintf(`(%s AND NOT %s)`, has, fails), nil
+		}
+
+		return q.exists(fmt.Sprintf(`tags.name = %s AND %s`, q.arg(f.Name), match)), nil
+
+	case tagger.AndFilter:
+		return q.join(f.Filters, " AND ", "TRUE")
+
+	case tagger.OrFilter:
+		return q.join(f.Filters, " OR ", "FALSE")
+
+	case tagger.NotFilter:
+		// Negating a tag check turns it into a NOT EXISTS subquery
+		cond, err := q.compile(f.Filter)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("NOT %s", cond), nil
+	}
+
+	return "", errUnsupportedFilter
+}
+
+// join compiles each of the filters and joins them with the given operator.
+// If there are no filters, the empty value is used as the condition.
+func (q *sqlFilter) join(filters []tagger.Filter, op, empty string) (string, error) {
+	if len(filters) == 0 {
+		return empty, nil
+	}
+
+	conds := make([]string, 0, len(filters))
+	for _, filter := range filters {
+		cond, err := q.compile(filter)
+		if err != nil {
+			return "", err
+		}
+		conds = append(conds, cond)
+	}
+
+	return fmt.Sprintf("(%s)", strings.Join(conds, op)), nil
+}
+
+// descendantRange returns the range of names that are descendants of the
+// given tag name. The upper bound is the prefix with the separator
+// incremented by one, which sorts right after every name with the prefix.
+func descendantRange(name string) (string, string) {
+	prefix := name + tagger.TagSeparator
+	return prefix, prefix[:len(prefix)-1] + string(prefix[len(prefix)-1]+1)
+}
+
+// kindOrder returns an expression ordering a column of kinds, where floats
+// are ordered together with integers
+func kindOrder(column string) string {
+	return fmt.Sprintf(`CASE %[1]s WHEN %[2]d THEN %[3]d ELSE %[1]s END`, column, tagger.FloatKind, tagger.IntKind)
+}
+
+// literalToSql converts a filter value to the representation stored in the
+// tags table, along with the list of kinds it can be compared with.
+func literalToSql(v interface{}) (string, interface{}, error) {
+	switch v := v.(type) {
+	case int:
+		return fmt.Sprintf("%d, %d", tagger.IntKind, tagger.FloatKind), v, nil
+	case float64:
+		return fmt.Sprintf("%d, %d", tagger.IntKind, tagger.FloatKind), v, nil
+	case string:
+		return fmt.Sprintf("%d", tagger.StringKind), v, nil
+	case time.Time:
+		return fmt.Sprintf("%d", tagger.DateKind), v.Unix(), nil
+	case bool:
+		if v {
+			return fmt.Sprintf("%d", tagger.BoolKind), 1, nil
+		}
+		return fmt.Sprintf("%d", tagger.BoolKind), 0, nil
+	}
+
+	return "", nil, errUnsupportedFilter
+}
+
+// compareSqliteValue compares the value column of the sqlite tags table,
+// which holds every kind of value
+func compareSqliteValue(q *sqlFilter, v interface{}, op string) (string, error) {
+	kinds, value, err := literalToSql(v)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`tags.kind IN (%s) AND tags.value %s %s`, kinds, op, q.arg(value)), nil
+}
+
+func comparatorToSql(c tagger.Comparator) (string, error) {
+	switch c {
+	case tagger.Equals:
+		return "=", nil
+	case tagger.NotEquals:
+		return "<>", nil
+	case tagger.LessThan:
+		return "<", nil
+	case tagger.GreaterThan:
+		return ">", nil
+	case tagger.LessThanOrEqual:
+		return "<=", nil
+	case tagger.GreaterThanOrEqual:
+		return ">=", nil
+	}
+
+	return "", errUnsupportedFilter
+}
@@ -1,110 +1,414 @@
+//go:build cgo
+
 package storage
 
 import (
 	"code.google.com/p/go-uuid/uuid"
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"github.com/kiljacken/tagger"
-	_ "github.com/mattn/go-sqlite3"
-	"log"
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"strings"
+	"time"
 )
 
 type SqliteStorage struct {
 	db *sql.DB
+	// q is used for all queries, and is either the database or the
+	// transaction of a transactional view
+	q  querier
+	tx *sql.Tx
+	// ctx is the context all queries are run with
+	ctx context.Context
+
+	// stmts holds the statements prepared when the storage was opened,
+	// keyed by their query. It is shared by all transactional views.
+	stmts map[string]*sql.Stmt
+	// txStmts holds the cached statements bound to the transaction of a
+	// transactional view
+	txStmts map[string]*sql.Stmt
+}
+
+// sqliteTx is a transactional view of a SqliteStorage
+type sqliteTx struct {
+	*SqliteStorage
+}
+
+// sqliteView is a view of a SqliteStorage bound to a context
+type sqliteView struct {
+	*SqliteStorage
+}
+
+// SqliteOptions are the connection settings of a sqlite database. Empty
+// fields leave the sqlite default in place.
+type SqliteOptions struct {
+	// JournalMode is the journal mode of the database, such as "DELETE" or
+	// "WAL". WAL allows readers to proceed while a write is in progress.
+	JournalMode string
+	// BusyTimeout is how long to wait for a lock held by another connection
+	// before giving up
+	BusyTimeout time.Duration
+	// Synchronous is how often sqlite waits for data to reach the disk, one
+	// of "OFF", "NORMAL", "FULL" or "EXTRA"
+	Synchronous string
+}
+
+// DefaultSqliteOptions are settings suitable for a database on disk that is
+// shared by several processes
+var DefaultSqliteOptions = SqliteOptions{
+	JournalMode: "WAL",
+	BusyTimeout: 5 * time.Second,
+	Synchronous: "NORMAL",
+}
+
+// dsn adds the options to a connection descriptor as parameters understood
+// by the sqlite driver, so they are applied to every connection in the pool
+func (o SqliteOptions) dsn(descriptor string) string {
+	params := []string{"_foreign_keys=1"}
+	if o.JournalMode != "" {
+		params = append(params, "_journal_mode="+o.JournalMode)
+	}
+	if o.BusyTimeout > 0 {
+		params = append(params, fmt.Sprintf("_busy_timeout=%d", o.BusyTimeout.Milliseconds()))
+	}
+	if o.Synchronous != "" {
+		params = append(params, "_synchronous="+o.Synchronous)
+	}
+
+	sep := "?"
+	if strings.Contains(descriptor, "?") {
+		sep = "&"
+	}
+	return descriptor + sep + strings.Join(params, "&")
 }
 
-// NewSqliteStorage returns a new storage engine backed by an in memory sqlite database
-// TODO: Support file databases, maybe by passthrough of connection descriptor
+func init() {
+	Register("sqlite", func(location string) (tagger.StorageProvider, error) {
+		s, err := NewSqliteStorageWithOptions(location, DefaultSqliteOptions)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	})
+	registerMigrations("sqlite", PendingSqliteMigrations)
+}
+
+// NewSqliteStorage returns a new storage engine backed by the sqlite database
+// with the given connection descriptor, using the sqlite default settings
 func NewSqliteStorage(descriptor string) (*SqliteStorage, error) {
-	// Open up a sqlite memory connection
-	db, err := sql.Open("sqlite3", descriptor)
+	return NewSqliteStorageWithOptions(descriptor, SqliteOptions{})
+}
+
+// NewSqliteStorageWithOptions returns a new storage engine backed by the
+// sqlite database with the given connection descriptor and settings
+func NewSqliteStorageWithOptions(descriptor string, opts SqliteOptions) (*SqliteStorage, error) {
+	// Open up a sqlite connection
+	db, err := sql.Open("sqlite3", opts.dsn(descriptor))
 	if err != nil {
 		// If an error occurs, returns this error
 		return nil, err
 	}
 
+	// Every connection to an in-memory database has a database of it's own,
+	// so only one connection is used
+	if _, ok := sqliteFile(descriptor); !ok {
+		db.SetMaxOpenConns(1)
+	}
+
+	// Connect right away, so invalid settings are reported here
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, sqliteErr(err, nil)
+	}
+
 	// Create a empty sqlite storage struct, and store the db connection in it
 	storage := new(SqliteStorage)
 	storage.db = db
+	storage.q = db
+	storage.ctx = context.Background()
 
 	// Setup database tables
-	storage.init()
+	err = storage.init()
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
 
 	// Return the new storage engine
 	return storage, nil
 }
 
-func (s *SqliteStorage) init() {
-	setupStmt := `
-	PRAGMA foreign_keys = ON;
-	`
-
-	// Setup database settings
-	_, err := s.db.Exec(setupStmt)
-	if err != nil {
-		// If an error occurs die with an error message
-		log.Fatal(err)
-	}
-
-	tableStmt := `
-	CREATE TABLE IF NOT EXISTS file(
-		uuid TEXT NOT NULL,
-		path TEXT,
-		PRIMARY KEY (uuid)
-		UNIQUE(path) ON CONFLICT REPLACE
-	);
-	CREATE TABLE IF NOT EXISTS tags(
-		uuid TEXT NOT NULL,
-		name TEXT NOT NULL,
-		value INTEGER,
-		FOREIGN KEY(uuid) REFERENCES file(uuid)
-		PRIMARY KEY (uuid, name)	
-	);
-	`
-	/*
-		CREATE TABLE named_tags(
-			uuid TEXT NOT NULL,
-			name TEXT NOT NULL,
-			FOREIGN KEY(uuid) REFERENCES file(uuid)
-			PRIMARY KEY (uuid, name)
-		);
-		CREATE TABLE value_tags(
-			uuid TEXT NOT NULL,
-			name TEXT NOT NULL,
-			value INTEGER NOT NULL,
-			FOREIGN KEY(uuid) REFERENCES file(uuid)
-			PRIMARY KEY (uuid, name)
-		);
-	*/
+// sqliteStmts are the queries prepared when the storage is opened
+var sqliteStmts = []string{
+	getFileStmt,
+	getFileForPathStmt,
+	getFileForHashStmt,
+	getAllFilesStmt,
+	addTagValueStmt,
+	removeTagValueStmt,
+	getTagValuesStmt,
+	removeTagStmt,
+	getTagsStmt,
+	getAllTagsStmt,
+	getAllTagNamesStmt,
+	getDescendantTagNamesStmt,
+	resolveAliasStmt,
+	addAliasStmt,
+	retargetAliasesStmt,
+	removeDuplicateTagsStmt,
+	renameTagsStmt,
+	removeAliasStmt,
+	getAliasesStmt,
+	addRuleStmt,
+	removeRuleStmt,
+	getRulesStmt,
+	updateFileStmt,
+	removeReplacedTagsStmt,
+	removeFileTagsStmt,
+	removeFileStmt,
+	getFileIdsStmt,
+	getOrphanedTagsStmt,
+	removeOrphanedTagsStmt,
+	setFileIdStmt,
+	setTagsIdStmt,
+}
+
+func (s *SqliteStorage) init() error {
+	// Bring the database schema up to date
+	_, err := s.migrate()
+	if err != nil {
+		return err
+	}
 
-	// Setup database tables
-	_, err = s.db.Exec(tableStmt)
+	// Prepare the statements once the tables they refer to exist
+	s.stmts = make(map[string]*sql.Stmt, len(sqliteStmts))
+	for _, query := range sqliteStmts {
+		st, err := s.db.Prepare(query)
+		if err != nil {
+			// If we get an error here the schema isn't what we expect
+			return sqliteErr(err, tagger.ErrSchemaMismatch)
+		}
+		s.stmts[query] = st
+	}
+
+	return nil
+}
+
+// stmt returns the prepared statement for a query, bound to the transaction
+// if the storage is a transactional view
+func (s *SqliteStorage) stmt(query string) (*sql.Stmt, error) {
+	st, ok := s.stmts[query]
+	if !ok {
+		return nil, fmt.Errorf("storage: Statement was not prepared: %q", query)
+	}
+
+	if s.tx == nil {
+		return st, nil
+	}
+
+	if txSt, ok := s.txStmts[query]; ok {
+		return txSt, nil
+	}
+	txSt := s.tx.StmtContext(s.ctx, st)
+	s.txStmts[query] = txSt
+	return txSt, nil
+}
+
+// exec executes a prepared statement
+func (s *SqliteStorage) exec(query string, args ...interface{}) (sql.Result, error) {
+	st, err := s.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	return st.ExecContext(s.ctx, args...)
+}
+
+// query runs a prepared query
+func (s *SqliteStorage) query(query string, args ...interface{}) (*sql.Rows, error) {
+	st, err := s.stmt(query)
 	if err != nil {
-		// If an error occurs die with an error message
-		log.Fatal(err)
+		return nil, err
+	}
+	return st.QueryContext(s.ctx, args...)
+}
+
+// withTx returns a transactional view of the storage using the transaction
+func (s *SqliteStorage) withTx(tx *sql.Tx) *SqliteStorage {
+	return &SqliteStorage{
+		db:      s.db,
+		q:       tx,
+		tx:      tx,
+		ctx:     s.ctx,
+		stmts:   s.stmts,
+		txStmts: make(map[string]*sql.Stmt),
+	}
+}
+
+// tagToRow converts a tag to the kind and value stored in the tags table. It
+// fails for values that can't be stored, such as NaN.
+func tagToRow(t tagger.Tag) (tagger.Kind, interface{}, error) {
+	if err := checkValue(t); err != nil {
+		return tagger.NoKind, nil, err
+	}
+
+	switch t.Kind() {
+	case tagger.IntKind:
+		return tagger.IntKind, t.Value(), nil
+	case tagger.StringKind:
+		return tagger.StringKind, t.StringValue(), nil
+	case tagger.FloatKind:
+		return tagger.FloatKind, t.FloatValue(), nil
+	case tagger.DateKind:
+		// Dates are stored as unix timestamps so they sort correctly
+		return tagger.DateKind, t.DateValue().Unix(), nil
+	case tagger.BoolKind:
+		return tagger.BoolKind, boolValue(t.BoolValue()), nil
+	}
+	return tagger.NoKind, nil, nil
+}
+
+// rowToTag converts a row from the tags table back into a tag
+func rowToTag(name string, kind tagger.Kind, value interface{}) (tagger.Tag, error) {
+	switch kind {
+	case tagger.NoKind:
+		return tagger.NewNamedTag(name), nil
+	case tagger.IntKind:
+		if v, ok := value.(int64); ok {
+			return tagger.NewValueTag(name, int(v)), nil
+		}
+	case tagger.StringKind:
+		switch v := value.(type) {
+		case string:
+			return tagger.NewStringTag(name, v), nil
+		case []byte:
+			return tagger.NewStringTag(name, string(v)), nil
+		}
+	case tagger.FloatKind:
+		switch v := value.(type) {
+		case float64:
+			return tagger.NewFloatTag(name, v), nil
+		case int64:
+			return tagger.NewFloatTag(name, float64(v)), nil
+		}
+	case tagger.DateKind:
+		if v, ok := value.(int64); ok {
+			return tagger.NewDateTag(name, time.Unix(v, 0).UTC()), nil
+		}
+	case tagger.BoolKind:
+		if v, ok := value.(int64); ok {
+			return tagger.NewBoolTag(name, v != 0), nil
+		}
+	}
+
+	// The stored kind and value don't fit together
+	return nil, fmt.Errorf("%w: Invalid value %v of kind %d for tag %s", tagger.ErrStorageCorrupt, value, kind, name)
+}
+
+// sqliteErr wraps an error from sqlite with ErrStorageCorrupt if sqlite
+// reports the database as corrupt, or with the given category otherwise. A
+// nil category leaves other errors as they are.
+func sqliteErr(err error, category error) error {
+	var serr sqlite3.Error
+	if errors.As(err, &serr) && (serr.Code == sqlite3.ErrCorrupt || serr.Code == sqlite3.ErrNotADB) {
+		return fmt.Errorf("%w: %w", tagger.ErrStorageCorrupt, err)
+	}
+	if category == nil {
+		return err
 	}
+	return fmt.Errorf("%w: %w", category, err)
 }
 
 func (s *SqliteStorage) Close() error {
+	// Close the prepared statements before the database
+	for _, st := range s.stmts {
+		st.Close()
+	}
 	return s.db.Close()
 }
 
-const getFileStmt = `SELECT * FROM file WHERE uuid = ?`
+func (s *SqliteStorage) Begin() (tagger.Tx, error) {
+	if s.tx != nil {
+		return nil, tagger.ErrNestedTx
+	}
+
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return sqliteTx{s.withTx(tx)}, nil
+}
+
+func (s *SqliteStorage) WithContext(ctx context.Context) tagger.StorageProvider {
+	view := *s
+	view.ctx = ctx
+	return sqliteView{&view}
+}
+
+// Close does nothing, as the view shares the database of the storage
+func (v sqliteView) Close() error {
+	return nil
+}
+
+// atomic runs the function with a transactional view of the storage, which
+// is committed if the function succeeds. If the storage already is a
+// transactional view, the function is run as part of that transaction.
+func (s *SqliteStorage) atomic(fn func(s *SqliteStorage) error) error {
+	if s.tx != nil {
+		return fn(s)
+	}
+
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(s.withTx(tx))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Commit commits the changes made through the transaction
+func (t sqliteTx) Commit() error {
+	return t.tx.Commit()
+}
+
+// Rollback discards the changes made through the transaction
+func (t sqliteTx) Rollback() error {
+	return t.tx.Rollback()
+}
+
+// Close rolls back the transaction unless it has been committed. It doesn't
+// close the underlying database.
+func (t sqliteTx) Close() error {
+	err := t.tx.Rollback()
+	if err == sql.ErrTxDone {
+		return nil
+	}
+	return err
+}
+
+const getFileStmt = `SELECT ` + fileColumns + ` FROM file WHERE uuid = ?`
 
 func (s *SqliteStorage) GetFile(u uuid.UUID) (tagger.File, error) {
-	// Prepare the statement
-	st, err := s.db.Prepare(getFileStmt)
+	// Get the prepared statement
+	st, err := s.stmt(getFileStmt)
 	if err != nil {
-		// If we get an error here its due to programmer error
-		log.Fatal(err)
+		return tagger.File{}, err
 	}
-	defer st.Close()
 
 	// Fetch the row with the file
-	row := st.QueryRow(u.String())
+	row := st.QueryRowContext(s.ctx, u.String())
 
-	// Get the values from the row
-	var rowUuid, path sql.NullString
-	err = row.Scan(&rowUuid, &path)
+	// Get the file from the row
+	f, err := scanFile(row)
 	if err == sql.ErrNoRows {
 		// If no row was found, no such file exists
 		return tagger.File{}, tagger.ErrNoFile
@@ -113,27 +417,23 @@ func (s *SqliteStorage) GetFile(u uuid.UUID) (tagger.File, error) {
 		return tagger.File{}, err
 	}
 
-	// Construct a file struct and return it
-	return tagger.NewFile(uuid.Parse(rowUuid.String), path.String), nil
+	return f, nil
 }
 
-const getFileForPathStmt = `SELECT * FROM file WHERE path = ?`
+const getFileForPathStmt = `SELECT ` + fileColumns + ` FROM file WHERE path = ?`
 
 func (s *SqliteStorage) GetFileForPath(path string) (tagger.File, error) {
-	// Prepare the statement
-	st, err := s.db.Prepare(getFileForPathStmt)
+	// Get the prepared statement
+	st, err := s.stmt(getFileForPathStmt)
 	if err != nil {
-		// If we get an error here its due to programmer error
-		log.Fatal(err)
+		return tagger.File{}, err
 	}
-	defer st.Close()
 
 	// Fetch the row with the file
-	row := st.QueryRow(path)
+	row := st.QueryRowContext(s.ctx, path)
 
-	// Get the values from the row
-	var rowUuid, rowPath sql.NullString
-	err = row.Scan(&rowUuid, &rowPath)
+	// Get the file from the row
+	f, err := scanFile(row)
 	if err == sql.ErrNoRows {
 		// If no row was found, no such file exists
 		return tagger.File{}, tagger.ErrNoFile
@@ -142,247 +442,936 @@ func (s *SqliteStorage) GetFileForPath(path string) (tagger.File, error) {
 		return tagger.File{}, err
 	}
 
-	// Construct a file struct and return it
-	return tagger.NewFile(uuid.Parse(rowUuid.String), rowPath.String), nil
+	return f, nil
 }
 
-const getAllFilesStmt = `SELECT * FROM file`
+const getFileForHashStmt = `SELECT ` + fileColumns + ` FROM file WHERE hash = ? ORDER BY path LIMIT 1`
 
-func (s *SqliteStorage) GetAllFiles() ([]tagger.File, error) {
-	// Prepare the statement
-	st, err := s.db.Prepare(getAllFilesStmt)
+func (s *SqliteStorage) GetFileForHash(sum string) (tagger.File, error) {
+	// Get the prepared statement
+	st, err := s.stmt(getFileForHashStmt)
 	if err != nil {
-		// If we get an error here its due to programmer error
-		log.Fatal(err)
+		return tagger.File{}, err
 	}
-	defer st.Close()
 
 	// Fetch the row with the file
-	rows, err := st.Query()
-	if err != nil {
-		// An error shouldn't happen here according to docs.
-		// If no row was found row.Scan will return ErrNoRow.
-		return nil, err
-	}
-	defer rows.Close()
-
-	// Create an empty array of files
-	files := make([]tagger.File, 0)
-
-	// Loop through each row in the query
-	for rows.Next() {
-		// Get the values from the row
-		var rowUuid, path sql.NullString
-		err = rows.Scan(&rowUuid, &path)
-		if err != nil {
-			// If an error occured, return the error
-			return nil, err
-		}
-
-		files = append(files, tagger.NewFile(uuid.Parse(rowUuid.String), path.String))
-	}
+	row := st.QueryRowContext(s.ctx, sum)
 
-	// If an error occured during the query, return the error
-	if rows.Err() != nil {
-		return nil, rows.Err()
+	// Get the file from the row
+	f, err := scanFile(row)
+	if err == sql.ErrNoRows {
+		// If no row was found, no such file exists
+		return tagger.File{}, tagger.ErrNoFile
+	} else if err != nil {
+		// If another error occurs return it
+		return tagger.File{}, err
 	}
 
-	// Return the array of files
-	return files, nil
+	return f, nil
 }
 
-func (s *SqliteStorage) GetMatchingFiles(f tagger.Filter) ([]tagger.File, error) {
-	// XXX: This is really bad practice. Database engines should make optimized
-	// sql statements for filtering.
-	matches := make([]tagger.File, 0)
+const getAllFilesStmt = `SELECT ` + fileColumns + ` FROM file`
 
-	// Get ALL files
-	files, err := s.GetAllFiles()
+func (s *SqliteStorage) GetAllFiles() ([]tagger.File, error) {
+	it, err := s.IterateAllFiles()
 	if err != nil {
 		return nil, err
 	}
+	defer it.Close()
 
-	// Loop through ALL files
-	for _, file := range files {
-		// Get the files tags
-		tags, err := s.GetTags(file)
-		if err != nil {
-			// TODO: We fail fast now, maybe try other files first?
-			return nil, err
-		}
+	return collectFiles(it)
+}
 
-		// Add file to result only if it's tags match the filter
-		if f.Matches(tags) {
-			matches = append(matches, file)
-		}
+func (s *SqliteStorage) IterateAllFiles() (tagger.FileIterator, error) {
+	// Fetch the rows with the files
+	rows, err := s.query(getAllFilesStmt)
+	if err != nil {
+		return nil, err
 	}
 
-	return matches, nil
+	return &sqlFileIterator{rows: rows}, nil
 }
 
-const updateTagStmt = `INSERT OR REPLACE INTO tags (uuid, name, value) VALUES (?, ?, ?)`
+const getMatchingFilesStmt = `SELECT ` + fileColumns + ` FROM file WHERE %s`
 
-func (s *SqliteStorage) UpdateTag(f tagger.File, t tagger.Tag) error {
-	// Prepare the statement
-	st, err := s.db.Prepare(updateTagStmt)
+func (s *SqliteStorage) GetMatchingFiles(f tagger.Filter) ([]tagger.File, error) {
+	it, err := s.IterateMatchingFiles(f)
 	if err != nil {
-		// If we get an error here its due to programmer error
-		log.Fatal(err)
+		return nil, err
 	}
-	defer st.Close()
+	defer it.Close()
 
-	if t.HasValue() {
-		// If the tag has a value, update with value
-		_, err = st.Exec(f.UUID().String(), t.Name(), t.Value())
-	} else {
-		// If the tag doesn't have a value, update value to NULL
-		_, err = st.Exec(f.UUID().String(), t.Name(), nil)
+	return collectFiles(it)
+}
+
+func (s *SqliteStorage) IterateMatchingFiles(f tagger.Filter) (tagger.FileIterator, error) {
+	// Translate the filter into a sql condition
+	q, f, err := s.filterCondition(f)
+	if err == errUnsupportedFilter {
+		// The filter contains something we can't express in sql, so fall
+		// back to matching the filter in memory
+		return s.iterateMatchingFilesSlow(f)
+	} else if err != nil {
+		return nil, err
 	}
 
-	// If an error occurs, return it
+	// Execute the query
+	rows, err := s.q.QueryContext(s.ctx, fmt.Sprintf(getMatchingFilesStmt, q.cond), q.args...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return &sqlFileIterator{rows: rows}, nil
 }
 
-const removeTagStmt = `DELETE FROM tags WHERE uuid = ? AND name = ?`
-
-func (s *SqliteStorage) RemoveTag(f tagger.File, t tagger.Tag) error {
-	// Prepare the statement
-	st, err := s.db.Prepare(removeTagStmt)
+// filterCondition translates a filter into a sql condition, after replacing
+// aliases in the filter with the tag names they refer to. The rewritten
+// filter is returned as well, for matching it in memory if it can't be
+// translated.
+func (s *SqliteStorage) filterCondition(f tagger.Filter) (*sqlFilter, tagger.Filter, error) {
+	aliases, err := s.GetAliases()
 	if err != nil {
-		// If we get an error here its due to programmer error
-		log.Fatal(err)
+		return nil, nil, err
 	}
-	defer st.Close()
+	f = tagger.RewriteAliases(f, aliases)
 
-	// Execute the statement
-	_, err = st.Exec(f.UUID().String(), t.Name())
+	q, err := compileFilter(f, sqliteDialect, 0)
+	return q, f, err
+}
 
-	// If an error occurs, return it
-	if err != nil {
-		return err
-	}
+const queryFilesStmt = `SELECT ` + fileColumns + ` FROM file WHERE %s ORDER BY %s`
 
-	return nil
+// sortKey selects the column of the value a file is ordered by when sorting
+// by a tag. Floats are ordered with integers, like in getAllTagsStmt.
+func sortKey(column, dir string) string {
+	return fmt.Sprintf(`(SELECT %[1]s FROM tags WHERE tags.uuid = file.uuid AND tags.name = ? AND tags.kind <> %[2]d ORDER BY %[3]s %[4]s, tags.value %[4]s LIMIT 1)`,
+		column, tagger.NoKind, kindOrder("tags.kind"), dir)
 }
 
-const getTagsStmt = `SELECT name, value FROM tags WHERE uuid = ?`
+func (s *SqliteStorage) QueryFiles(f tagger.Filter, opts tagger.QueryOptions) (tagger.FileIterator, error) {
+	// Translate the filter into a sql condition, if there is one
+	cond, args := "1", make([]interface{}, 0)
+	var slow tagger.Filter
+	if f != nil {
+		q, rewritten, err := s.filterCondition(f)
+		if err == errUnsupportedFilter {
+			// The filter is matched in memory, so the range must be taken
+			// from the matching files after the query
+			slow = rewritten
+		} else if err != nil {
+			return nil, err
+		} else {
+			cond, args = q.cond, q.args
+		}
+	}
 
-func (s *SqliteStorage) GetTags(f tagger.File) ([]tagger.Tag, error) {
-	// Prepare the statement
-	st, err := s.db.Prepare(getTagsStmt)
-	if err != nil {
-		// If we get an error here its due to programmer error
-		log.Fatal(err)
+	// Order by the sort tag if there is one, and by path otherwise
+	dir := "ASC"
+	if opts.Descending {
+		dir = "DESC"
+	}
+	order := fmt.Sprintf("path %s", dir)
+	if opts.SortTag != "" {
+		name, err := s.resolveAlias(opts.SortTag)
+		if err != nil {
+			return nil, err
+		}
+
+		kindKey := sortKey(kindOrder("tags.kind"), dir)
+		valueKey := sortKey("tags.value", dir)
+		order = fmt.Sprintf("%s %s NULLS LAST, %s %s, %s", kindKey, dir, valueKey, dir, order)
+		args = append(args, name, name)
+	}
+
+	// Let the database skip files when the filter is matched in sql
+	query := fmt.Sprintf(queryFilesStmt, cond, order)
+	if slow == nil && (opts.Limit > 0 || opts.Offset > 0) {
+		limit := opts.Limit
+		if limit <= 0 {
+			limit = -1
+		}
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, limit, opts.Offset)
 	}
-	defer st.Close()
 
 	// Execute the query
-	rows, err := st.Query(f.UUID().String())
+	rows, err := s.q.QueryContext(s.ctx, query, args...)
 	if err != nil {
-		// An error shouldn't happen here according to docs.
-		// If no row was found row.Scan will return ErrNoRow.
 		return nil, err
 	}
-	defer rows.Close()
-
-	// Create an empty array of tags
-	tags := make([]tagger.Tag, 0)
 
-	// Loop through each row in the query
-	for rows.Next() {
-		// Get the values from the row
-		var name sql.NullString
-		var value sql.NullInt64
-		err = rows.Scan(&name, &value)
+	var it tagger.FileIterator = &sqlFileIterator{rows: rows}
+	if slow != nil {
+		// The files are read before any tags are looked up, like in
+		// iterateMatchingFilesSlow
+		files, err := collectFiles(it)
+		it.Close()
 		if err != nil {
-			// If an error occured, return the error
 			return nil, err
 		}
 
-		// Depending on if we have a value, create a value tag or a name tag
-		var tag tagger.Tag
-		if value.Valid {
-			tag = tagger.NewValueTag(name.String, int(value.Int64))
-		} else {
-			tag = tagger.NewNamedTag(name.String)
-		}
-
-		// Add the tag to our array
-		tags = append(tags, tag)
+		it = &filterIterator{FileIterator: &sliceIterator{files: files}, filter: slow, tags: s.GetTags}
+		it = &limitIterator{FileIterator: it, offset: opts.Offset, limit: opts.Limit}
 	}
 
-	// If an error occured during the query, return the error
-	if rows.Err() != nil {
-		return nil, rows.Err()
+	return it, nil
+}
+
+// iterateMatchingFilesSlow matches the filter against every file in memory.
+// This is only used for filters that can't be translated into sql.
+func (s *SqliteStorage) iterateMatchingFilesSlow(f tagger.Filter) (tagger.FileIterator, error) {
+	// Get ALL files. They are read before any tags are looked up, as an
+	// in-memory database has only one connection, which the rows of the
+	// files would hold on to.
+	files, err := s.GetAllFiles()
+	if err != nil {
+		return nil, err
 	}
 
-	// Return the array of tags
-	return tags, nil
+	return &filterIterator{FileIterator: &sliceIterator{files: files}, filter: f, tags: s.GetTags}, nil
 }
 
-const updateFileStmt = `INSERT OR REPLACE INTO file (uuid, path) VALUES (?, ?)`
+const addTagValueStmt = `
+	INSERT INTO tags (uuid, name, kind, value)
+	SELECT ?1, ?2, ?3, ?4
+	WHERE NOT EXISTS (SELECT 1 FROM tags WHERE uuid = ?1 AND name = ?2 AND kind = ?3 AND value IS ?4)
+`
 
-func (s *SqliteStorage) UpdateFile(f tagger.File, t []tagger.Tag) error {
-	// Prepare the statement
-	st, err := s.db.Prepare(updateFileStmt)
+func (s *SqliteStorage) UpdateTag(f tagger.File, t tagger.Tag) error {
+	return s.atomic(func(s *SqliteStorage) error {
+		err := s.updateTag(f, t)
+		if err != nil {
+			return err
+		}
+
+		// Add any tags implied by the new tag
+		rules, err := s.canonicalRules()
+		if err != nil {
+			return err
+		}
+		return s.applyRules(f, rules)
+	})
+}
+
+// updateTag replaces the values of a tag without applying rules
+func (s *SqliteStorage) updateTag(f tagger.File, t tagger.Tag) error {
+	// Check the value before the old values are removed
+	if err := checkValue(t); err != nil {
+		return err
+	}
+
+	// Store the tag under it's canonical name
+	t, err := s.canonicalTag(t)
 	if err != nil {
-		// If we get an error here its due to programmer error
-		log.Fatal(err)
+		return err
 	}
-	defer st.Close()
 
-	// If the tag has a value, update with value
-	_, err = st.Exec(f.UUID().String(), f.Path())
-	// If an error occurs, return it
+	// Remove all existing values of the tag
+	err = s.RemoveTag(f, t)
 	if err != nil {
 		return err
 	}
 
-	// For each tag associated with file, update the tag.
-	for _, tag := range t {
-		err := s.UpdateTag(f, tag)
-		// If an error occurs return it
+	// Add the new value
+	return s.addTagValue(f, t)
+}
+
+func (s *SqliteStorage) AddTagValue(f tagger.File, t tagger.Tag) error {
+	return s.atomic(func(s *SqliteStorage) error {
+		err := s.addTagValue(f, t)
 		if err != nil {
 			return err
 		}
-	}
 
-	return nil
+		// Add any tags implied by the new value
+		rules, err := s.canonicalRules()
+		if err != nil {
+			return err
+		}
+		return s.applyRules(f, rules)
+	})
 }
 
-const removeFileStmt = `DELETE FROM file WHERE uuid = ?`
-
-func (s *SqliteStorage) RemoveFile(f tagger.File) error {
-	// Loop through all tags associated with the file and remove them
-	tags, err := s.GetTags(f)
+// addTagValue adds a value to a tag without applying rules
+func (s *SqliteStorage) addTagValue(f tagger.File, t tagger.Tag) error {
+	// Get the prepared statement
+	st, err := s.stmt(addTagValueStmt)
 	if err != nil {
 		return err
 	}
 
-	for _, tag := range tags {
-		err := s.RemoveTag(f, tag)
-		if err != nil {
-			return err
-		}
+	// Store the tag under it's canonical name
+	t, err = s.canonicalTag(t)
+	if err != nil {
+		return err
 	}
 
-	// Prepare the statement
-	st, err := s.db.Prepare(removeFileStmt)
+	// Add the value unless the file already has it, tags without a value
+	// get a NULL value
+	kind, value, err := tagToRow(t)
 	if err != nil {
-		// If we get an error here its due to programmer error
-		log.Fatal(err)
+		return err
 	}
-	defer st.Close()
+	_, err = st.ExecContext(s.ctx, f.UUID().String(), t.Name(), kind, value)
 
-	// Execute the query
-	_, err = st.Exec(f.UUID().String())
+	// The foreign key on the tags table fails if the file isn't stored
+	var serr sqlite3.Error
+	if errors.As(err, &serr) && serr.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+		return tagger.ErrNoFile
+	}
+
+	// If an error occurs, return it
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+const removeTagValueStmt = `DELETE FROM tags WHERE uuid = ? AND name = ? AND kind = ? AND value IS ?`
+
+func (s *SqliteStorage) RemoveTagValue(f tagger.File, t tagger.Tag) error {
+	// Get the prepared statement
+	st, err := s.stmt(removeTagValueStmt)
+	if err != nil {
+		return err
+	}
+
+	// Look up the tag under it's canonical name
+	t, err = s.canonicalTag(t)
+	if err != nil {
+		return err
+	}
+
+	// Execute the statement
+	kind, value, err := tagToRow(t)
+	if err != nil {
+		return err
+	}
+	_, err = st.ExecContext(s.ctx, f.UUID().String(), t.Name(), kind, value)
+
+	// If an error occurs, return it
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+const getTagValuesStmt = `SELECT name, kind, value FROM tags WHERE uuid = ? AND name = ?`
+
+func (s *SqliteStorage) GetTagValues(f tagger.File, name string) ([]tagger.Tag, error) {
+	// Get the prepared statement
+	st, err := s.stmt(getTagValuesStmt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Look up the tag under it's canonical name
+	name, err = s.resolveAlias(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Execute the query
+	rows, err := st.QueryContext(s.ctx, f.UUID().String(), name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags, err := scanTags(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// If no values were found, the file doesn't have the tag
+	if len(tags) == 0 {
+		return nil, tagger.ErrNoTag
+	}
+
+	return tags, nil
+}
+
+const removeTagStmt = `DELETE FROM tags WHERE uuid = ? AND name = ?`
+
+func (s *SqliteStorage) RemoveTag(f tagger.File, t tagger.Tag) error {
+	// Get the prepared statement
+	st, err := s.stmt(removeTagStmt)
+	if err != nil {
+		return err
+	}
+
+	// Look up the tag under it's canonical name
+	t, err = s.canonicalTag(t)
+	if err != nil {
+		return err
+	}
+
+	// Execute the statement
+	_, err = st.ExecContext(s.ctx, f.UUID().String(), t.Name())
+
+	// If an error occurs, return it
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+const getTagsStmt = `SELECT name, kind, value FROM tags WHERE uuid = ?`
+
+func (s *SqliteStorage) GetTags(f tagger.File) ([]tagger.Tag, error) {
+	// Get the prepared statement
+	st, err := s.stmt(getTagsStmt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Execute the query
+	rows, err := st.QueryContext(s.ctx, f.UUID().String())
+	if err != nil {
+		// An error shouldn't happen here according to docs.
+		// If no row was found row.Scan will return ErrNoRow.
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Return the array of tags
+	return scanTags(rows)
+}
+
+// scanTags reads the name, kind and value of tags from the rows of a query
+func scanTags(rows *sql.Rows) ([]tagger.Tag, error) {
+	// Create an empty array of tags
+	tags := make([]tagger.Tag, 0)
+
+	// Loop through each row in the query
+	for rows.Next() {
+		// Get the values from the row
+		var name sql.NullString
+		var kind sql.NullInt64
+		var value interface{}
+		err := rows.Scan(&name, &kind, &value)
+		if err != nil {
+			// If an error occured, return the error
+			return nil, err
+		}
+
+		// Create a tag of the stored kind
+		tag, err := rowToTag(name.String, tagger.Kind(kind.Int64), value)
+		if err != nil {
+			return nil, err
+		}
+
+		// Add the tag to our array
+		tags = append(tags, tag)
+	}
+
+	// If an error occured during the query, return the error
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	// Return the array of tags
+	return tags, nil
+}
+
+// getAllTagsStmt aggregates the usage of each tag name. The smallest and
+// largest values are found by ordering on kind and value, where floats are
+// ordered with integers.
+var getAllTagsStmt = fmt.Sprintf(`
+	SELECT name, COUNT(DISTINCT uuid), MAX(kind = %[1]d),
+		(SELECT kind FROM tags AS t WHERE t.name = tags.name AND t.kind <> %[1]d ORDER BY %[2]s, t.value LIMIT 1),
+		(SELECT value FROM tags AS t WHERE t.name = tags.name AND t.kind <> %[1]d ORDER BY %[2]s, t.value LIMIT 1),
+		(SELECT kind FROM tags AS t WHERE t.name = tags.name AND t.kind <> %[1]d ORDER BY %[2]s DESC, t.value DESC LIMIT 1),
+		(SELECT value FROM tags AS t WHERE t.name = tags.name AND t.kind <> %[1]d ORDER BY %[2]s DESC, t.value DESC LIMIT 1)
+	FROM tags
+	GROUP BY name
+	ORDER BY name
+`, tagger.NoKind, kindOrder("t.kind"))
+
+func (s *SqliteStorage) GetAllTags() ([]tagger.TagInfo, error) {
+	// Execute the query
+	rows, err := s.query(getAllTagsStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Create an empty array of tag infos
+	infos := make([]tagger.TagInfo, 0)
+
+	// Loop through each row in the query
+	for rows.Next() {
+		// Get the values from the row
+		var info tagger.TagInfo
+		var minKind, maxKind sql.NullInt64
+		var minValue, maxValue interface{}
+		err = rows.Scan(&info.Name, &info.Files, &info.Valueless, &minKind, &minValue, &maxKind, &maxValue)
+		if err != nil {
+			// If an error occured, return the error
+			return nil, err
+		}
+
+		// If the tag ever has a value, create tags for the extremes
+		if minKind.Valid && maxKind.Valid {
+			info.Min, err = rowToTag(info.Name, tagger.Kind(minKind.Int64), minValue)
+			if err != nil {
+				return nil, err
+			}
+
+			info.Max, err = rowToTag(info.Name, tagger.Kind(maxKind.Int64), maxValue)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		infos = append(infos, info)
+	}
+
+	// If an error occured during the query, return the error
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	// Return the array of tag infos
+	return infos, nil
+}
+
+const getAllTagNamesStmt = `SELECT DISTINCT name FROM tags`
+const getDescendantTagNamesStmt = `SELECT DISTINCT name FROM tags WHERE name >= ? AND name < ?`
+
+func (s *SqliteStorage) GetChildTags(parent string) ([]string, error) {
+	var rows *sql.Rows
+	var err error
+
+	// Fetch the names of all tags below the parent
+	if parent == "" {
+		rows, err = s.query(getAllTagNamesStmt)
+	} else {
+		low, high := descendantRange(parent)
+		rows, err = s.query(getDescendantTagNamesStmt, low, high)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Create an empty array of names
+	names := make([]string, 0)
+
+	// Loop through each row in the query
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			// If an error occured, return the error
+			return nil, err
+		}
+
+		names = append(names, name)
+	}
+
+	// If an error occured during the query, return the error
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	// Reduce the names to the direct children
+	return tagger.ChildTags(names, parent), nil
+}
+
+const resolveAliasStmt = `SELECT name FROM aliases WHERE alias = ?`
+
+// resolveAlias returns the tag name an alias refers to, or the name itself if
+// it isn't an alias
+func (s *SqliteStorage) resolveAlias(name string) (string, error) {
+	st, err := s.stmt(resolveAliasStmt)
+	if err != nil {
+		return "", err
+	}
+
+	var canonical string
+	err = st.QueryRowContext(s.ctx, name).Scan(&canonical)
+	if err == sql.ErrNoRows {
+		return name, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return canonical, nil
+}
+
+// canonicalTag returns the tag renamed to it's canonical name if it's name is
+// an alias
+func (s *SqliteStorage) canonicalTag(t tagger.Tag) (tagger.Tag, error) {
+	name, err := s.resolveAlias(t.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	if name != t.Name() {
+		return tagger.RenameTag(t, name), nil
+	}
+	return t, nil
+}
+
+const addAliasStmt = `INSERT OR REPLACE INTO aliases (alias, name) VALUES (?, ?)`
+const retargetAliasesStmt = `UPDATE aliases SET name = ? WHERE name = ?`
+
+// removeDuplicateTagsStmt removes the values of a tag that the file already
+// has under the name the tag is renamed to
+const removeDuplicateTagsStmt = `
+	DELETE FROM tags WHERE name = ?2 AND EXISTS (
+		SELECT 1 FROM tags AS other WHERE other.uuid = tags.uuid AND other.name = ?1
+			AND other.kind = tags.kind AND other.value IS tags.value
+	)
+`
+const renameTagsStmt = `UPDATE tags SET name = ? WHERE name = ?`
+
+func (s *SqliteStorage) AddAlias(alias, name string) error {
+	return s.atomic(func(s *SqliteStorage) error {
+		return s.addAlias(alias, name)
+	})
+}
+
+func (s *SqliteStorage) addAlias(alias, name string) error {
+	// Make the alias refer to the end of any chain of aliases
+	name, err := s.resolveAlias(name)
+	if err != nil {
+		return err
+	}
+
+	if name == alias {
+		return tagger.ErrAliasCycle
+	}
+
+	// Add the alias
+	_, err = s.exec(addAliasStmt, alias, name)
+	if err != nil {
+		return err
+	}
+
+	// Point aliases of the alias at the tag name instead
+	_, err = s.exec(retargetAliasesStmt, name, alias)
+	if err != nil {
+		return err
+	}
+
+	// Move tags stored under the alias to the tag name, dropping values the
+	// file already has under the tag name
+	_, err = s.exec(removeDuplicateTagsStmt, name, alias)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(renameTagsStmt, name, alias)
+	return err
+}
+
+const removeAliasStmt = `DELETE FROM aliases WHERE alias = ?`
+
+func (s *SqliteStorage) RemoveAlias(alias string) error {
+	_, err := s.exec(removeAliasStmt, alias)
+	return err
+}
+
+const getAliasesStmt = `SELECT alias, name FROM aliases`
+
+func (s *SqliteStorage) GetAliases() (map[string]string, error) {
+	// Execute the query
+	rows, err := s.query(getAliasesStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Loop through each row in the query
+	aliases := make(map[string]string)
+	for rows.Next() {
+		var alias, name string
+		err = rows.Scan(&alias, &name)
+		if err != nil {
+			// If an error occured, return the error
+			return nil, err
+		}
+
+		aliases[alias] = name
+	}
+
+	// If an error occured during the query, return the error
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return aliases, nil
+}
+
+const addRuleStmt = `INSERT INTO rules (condition, name, kind, value) VALUES (?, ?, ?, ?)`
+
+func (s *SqliteStorage) AddRule(r tagger.Rule) (int, error) {
+	var id int
+	err := s.atomic(func(s *SqliteStorage) error {
+		var err error
+		id, err = s.addRule(r)
+		return err
+	})
+	return id, err
+}
+
+func (s *SqliteStorage) addRule(r tagger.Rule) (int, error) {
+	// Make sure the new rule doesn't cause any cycles
+	rules, err := s.GetRules()
+	if err != nil {
+		return 0, err
+	}
+
+	err = tagger.CheckRules(append(rules, r))
+	if err != nil {
+		return 0, err
+	}
+
+	// Store the rule, with the condition in the filter language
+	kind, value, err := tagToRow(r.Implies)
+	if err != nil {
+		return 0, err
+	}
+	res, err := s.exec(addRuleStmt, r.Condition.String(), r.Implies.Name(), kind, value)
+	if err != nil {
+		return 0, err
+	}
+
+	// Return the ID of the new rule
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+const removeRuleStmt = `DELETE FROM rules WHERE id = ?`
+
+func (s *SqliteStorage) RemoveRule(id int) error {
+	res, err := s.exec(removeRuleStmt, id)
+	if err != nil {
+		return err
+	}
+
+	// If nothing was deleted, no such rule exists
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return tagger.ErrNoRule
+	}
+
+	return nil
+}
+
+const getRulesStmt = `SELECT id, condition, name, kind, value FROM rules ORDER BY id`
+
+func (s *SqliteStorage) GetRules() ([]tagger.Rule, error) {
+	// Execute the query
+	rows, err := s.query(getRulesStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Create an empty array of rules
+	rules := make([]tagger.Rule, 0)
+
+	// Loop through each row in the query
+	for rows.Next() {
+		// Get the values from the row
+		var id int
+		var cond, name string
+		var kind sql.NullInt64
+		var value interface{}
+		err = rows.Scan(&id, &cond, &name, &kind, &value)
+		if err != nil {
+			// If an error occured, return the error
+			return nil, err
+		}
+
+		// Parse the condition and create the implied tag
+		filter, err := tagger.ParseFilter(strings.NewReader(cond))
+		if err != nil {
+			return nil, fmt.Errorf("%w: Invalid condition in rule %d: %w", tagger.ErrStorageCorrupt, id, err)
+		}
+
+		tag, err := rowToTag(name, tagger.Kind(kind.Int64), value)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, tagger.Rule{ID: id, Condition: filter, Implies: tag})
+	}
+
+	// If an error occured during the query, return the error
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	// Return the array of rules
+	return rules, nil
+}
+
+func (s *SqliteStorage) ApplyRules() error {
+	return s.atomic(func(s *SqliteStorage) error {
+		return s.applyAllRules()
+	})
+}
+
+func (s *SqliteStorage) applyAllRules() error {
+	rules, err := s.canonicalRules()
+	if err != nil || len(rules) == 0 {
+		return err
+	}
+
+	// Get ALL files
+	files, err := s.GetAllFiles()
+	if err != nil {
+		return err
+	}
+
+	// Apply the rules to each of them
+	for _, file := range files {
+		err = s.applyRules(file, rules)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// canonicalRules returns the rules with conditions using the canonical tag
+// names. The rules are loaded once for each operation and passed to
+// applyRules, as they are parsed when read.
+func (s *SqliteStorage) canonicalRules() ([]tagger.Rule, error) {
+	rules, err := s.GetRules()
+	if err != nil || len(rules) == 0 {
+		return rules, err
+	}
+
+	// Tags are stored under their canonical names, so the conditions must
+	// use them as well
+	aliases, err := s.GetAliases()
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		rules[i].Condition = tagger.RewriteAliases(rules[i].Condition, aliases)
+	}
+
+	return rules, nil
+}
+
+// applyRules adds the tags implied by the tags of a file
+func (s *SqliteStorage) applyRules(f tagger.File, rules []tagger.Rule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	tags, err := s.GetTags(f)
+	if err != nil {
+		return err
+	}
+
+	// Add each of the implied tags
+	for _, tag := range tagger.ImpliedTags(rules, tags) {
+		err = s.addTagValue(f, tag)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+const updateFileStmt = `INSERT OR REPLACE INTO file (uuid, path, hash, size, mtime) VALUES (?, ?, ?, ?, ?)`
+const removeReplacedTagsStmt = `DELETE FROM tags WHERE uuid IN (SELECT uuid FROM file WHERE path = ? AND uuid <> ?)`
+
+func (s *SqliteStorage) UpdateFile(f tagger.File, t []tagger.Tag) error {
+	return s.atomic(func(s *SqliteStorage) error {
+		return s.updateFile(f, t)
+	})
+}
+
+func (s *SqliteStorage) updateFile(f tagger.File, t []tagger.Tag) error {
+	// Get the prepared statement
+	st, err := s.stmt(updateFileStmt)
+	if err != nil {
+		return err
+	}
+
+	// Check the values before anything is changed
+	for _, tag := range t {
+		if err := checkValue(tag); err != nil {
+			return err
+		}
+	}
+
+	// A file already stored with the path is replaced by the insert below,
+	// so it's tags must go first
+	_, err = s.exec(removeReplacedTagsStmt, f.Path(), f.UUID().String())
+	if err != nil {
+		return err
+	}
+
+	// Store the file, with NULLs for the content hash if it isn't known
+	var hash, size, mtime interface{}
+	if h, ok := f.Hash(); ok {
+		hash, size, mtime = h.Sum, h.Size, h.ModTime.UnixNano()
+	}
+	_, err = st.ExecContext(s.ctx, f.UUID().String(), f.Path(), hash, size, mtime)
+	// If an error occurs, return it
+	if err != nil {
+		return err
+	}
+
+	// For each tag associated with file, update the tag. Further values of a
+	// tag with several values are added to the first value, including values
+	// given under an alias of the tag.
+	seen := make(map[string]bool)
+	for _, tag := range t {
+		name, err := s.resolveAlias(tag.Name())
+		if err != nil {
+			return err
+		}
+
+		if seen[name] {
+			err = s.addTagValue(f, tag)
+		} else {
+			err = s.updateTag(f, tag)
+		}
+		// If an error occurs return it
+		if err != nil {
+			return err
+		}
+		seen[name] = true
+	}
+
+	// Add any tags implied by the tags of the file
+	rules, err := s.canonicalRules()
+	if err != nil {
+		return err
+	}
+	return s.applyRules(f, rules)
+}
+
+const removeFileTagsStmt = `DELETE FROM tags WHERE uuid = ?`
+const removeFileStmt = `DELETE FROM file WHERE uuid = ?`
+
+func (s *SqliteStorage) RemoveFile(f tagger.File) error {
+	return s.atomic(func(s *SqliteStorage) error {
+		// Remove all tags associated with the file
+		_, err := s.exec(removeFileTagsStmt, f.UUID().String())
+		if err != nil {
+			return err
+		}
+
+		// Remove the file itself
+		_, err = s.exec(removeFileStmt, f.UUID().String())
+		return err
+	})
+}
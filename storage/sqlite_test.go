@@ -0,0 +1,69 @@
+//go:build cgo
+
+package storage
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/kiljacken/tagger"
+	"github.com/kiljacken/tagger/storage/storagetest"
+	"path/filepath"
+	"testing"
+)
+
+func TestSqlite(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) tagger.StorageProvider {
+		p, err := NewSqliteStorage(filepath.Join(t.TempDir(), "tags.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	})
+}
+
+// TestSqliteInMemory runs the suite against in-memory databases, which only
+// exist as long as their single connection
+func TestSqliteInMemory(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) tagger.StorageProvider {
+		p, err := NewSqliteStorageWithOptions(":memory:", DefaultSqliteOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	})
+}
+
+// BenchmarkSqliteUpdateTag sets a tag on a file 100000 times, with the
+// default options and with the sqlite defaults. Every call is a transaction
+// of it's own, so the journal and sync settings dominate.
+func BenchmarkSqliteUpdateTag(b *testing.B) {
+	b.Run("DefaultSqliteOptions", func(b *testing.B) {
+		benchmarkSqliteUpdateTag(b, DefaultSqliteOptions)
+	})
+	b.Run("SqliteDefaults", func(b *testing.B) {
+		benchmarkSqliteUpdateTag(b, SqliteOptions{})
+	})
+}
+
+func benchmarkSqliteUpdateTag(b *testing.B, opts SqliteOptions) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		s, err := NewSqliteStorageWithOptions(filepath.Join(b.TempDir(), "tags.db"), opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+		f := tagger.NewFile(uuid.NewUUID(), "a")
+		if err := s.UpdateFile(f, []tagger.Tag{}); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		for n := 0; n < 100000; n++ {
+			if err := s.UpdateTag(f, tagger.NewValueTag("n", n)); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		b.StopTimer()
+		s.Close()
+	}
+}
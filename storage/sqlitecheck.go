@@ -0,0 +1,96 @@
+//go:build cgo
+
+package storage
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/kiljacken/tagger"
+)
+
+const getFileIdsStmt = `SELECT uuid, path FROM file`
+const getOrphanedTagsStmt = `SELECT DISTINCT uuid FROM tags WHERE uuid NOT IN (SELECT uuid FROM file)`
+
+// CheckIntegrity finds files stored with invalid UUIDs, and tags of files
+// that don't exist. Earlier versions left tags behind when a file was
+// replaced by another file with the same path.
+func (s *SqliteStorage) CheckIntegrity() ([]tagger.Problem, error) {
+	problems := make([]tagger.Problem, 0)
+
+	// Look for invalid UUIDs
+	rows, err := s.query(getFileIdsStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, path string
+		err = rows.Scan(&id, &path)
+		if err != nil {
+			return nil, err
+		}
+
+		if uuid.Parse(id) == nil {
+			problems = append(problems, tagger.Problem{Kind: tagger.InvalidUUID, ID: id, Path: path})
+		}
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	// Look for tags of missing files
+	orphans, err := s.query(getOrphanedTagsStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer orphans.Close()
+
+	for orphans.Next() {
+		var id string
+		err = orphans.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		problems = append(problems, tagger.Problem{Kind: tagger.OrphanedTags, ID: id})
+	}
+	if orphans.Err() != nil {
+		return nil, orphans.Err()
+	}
+
+	return problems, nil
+}
+
+const removeOrphanedTagsStmt = `DELETE FROM tags WHERE uuid = ? AND uuid NOT IN (SELECT uuid FROM file)`
+const setFileIdStmt = `UPDATE file SET uuid = ? WHERE uuid = ?`
+const setTagsIdStmt = `UPDATE tags SET uuid = ? WHERE uuid = ?`
+
+// RepairIntegrity removes orphaned tags, and gives files with an invalid
+// UUID a new UUID
+func (s *SqliteStorage) RepairIntegrity(p tagger.Problem) error {
+	switch p.Kind {
+	case tagger.OrphanedTags:
+		_, err := s.exec(removeOrphanedTagsStmt, p.ID)
+		return err
+
+	case tagger.InvalidUUID:
+		return s.atomic(func(s *SqliteStorage) error {
+			// The file and it's tags refer to each other, so the foreign key
+			// is only checked once both have been changed
+			_, err := s.q.ExecContext(s.ctx, `PRAGMA defer_foreign_keys = ON`)
+			if err != nil {
+				return err
+			}
+
+			id := uuid.NewUUID().String()
+			_, err = s.exec(setFileIdStmt, id, p.ID)
+			if err != nil {
+				return err
+			}
+			_, err = s.exec(setTagsIdStmt, id, p.ID)
+			return err
+		})
+	}
+
+	return tagger.ErrNotRepairable
+}
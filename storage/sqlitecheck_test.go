@@ -0,0 +1,106 @@
+//go:build cgo
+
+package storage
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"database/sql"
+	"github.com/kiljacken/tagger"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSqliteCheckIntegrity(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tags.db")
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	for _, p := range []string{a, b} {
+		if err := os.WriteFile(p, []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := NewSqliteStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.UpdateFile(tagger.NewFile(uuid.NewUUID(), a), []tagger.Tag{tagger.NewNamedTag("photo")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write what earlier versions could leave behind, without the foreign
+	// keys getting in the way
+	orphan := uuid.NewUUID().String()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{`INSERT INTO file (uuid, path) VALUES ('not-a-uuid', ?)`, []interface{}{b}},
+		{`INSERT INTO tags (uuid, name, kind, value) VALUES ('not-a-uuid', 'photo', ?, NULL)`, []interface{}{tagger.NoKind}},
+		{`INSERT INTO tags (uuid, name, kind, value) VALUES (?, 'photo', ?, NULL)`, []interface{}{orphan, tagger.NoKind}},
+		{`INSERT INTO tags (uuid, name, kind, value) VALUES (?, 'n', ?, 1)`, []interface{}{orphan, tagger.IntKind}},
+	} {
+		if _, err = db.Exec(stmt.query, stmt.args...); err != nil {
+			break
+		}
+	}
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The invalid UUID is reported once, by the storage
+	problems, err := tagger.Check(s)
+	if err != nil {
+		t.Fatalf("Check: %s", err)
+	}
+	if len(problems) != 2 {
+		t.Fatalf("Check returned %v, want an invalid UUID and orphaned tags", problems)
+	}
+	for _, problem := range problems {
+		switch problem.Kind {
+		case tagger.InvalidUUID:
+			if problem.ID != "not-a-uuid" || problem.Path != b {
+				t.Errorf("Check returned %+v, want not-a-uuid at %s", problem, b)
+			}
+		case tagger.OrphanedTags:
+			if problem.ID != orphan {
+				t.Errorf("Check returned %+v, want the tags of %s", problem, orphan)
+			}
+		default:
+			t.Errorf("Check returned %s", problem)
+		}
+
+		if err := tagger.Repair(s, problem); err != nil {
+			t.Errorf("Repair(%s): %s", problem, err)
+		}
+	}
+
+	problems, err = tagger.Check(s)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Check after repairing returned %v, %v, want no problems", problems, err)
+	}
+
+	// The file has a new UUID and keeps it's tags, and the orphaned tags
+	// are gone
+	f, err := s.GetFileForPath(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.UUID() == nil {
+		t.Errorf("%s still has an invalid UUID", b)
+	}
+	if _, err := s.GetTagValues(f, "photo"); err != nil {
+		t.Errorf("Repaired file lost it's tags: %s", err)
+	}
+	var count int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM tags WHERE uuid = ?`, orphan).Scan(&count); err != nil || count != 0 {
+		t.Errorf("%d orphaned tags are left, %v", count, err)
+	}
+}
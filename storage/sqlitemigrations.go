@@ -0,0 +1,401 @@
+//go:build cgo
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/kiljacken/tagger"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// migration is a single step in the evolution of the sqlite database schema
+type migration struct {
+	description string
+	apply       func(q querier) error
+}
+
+// sqliteMigrations lists every change made to the database schema, in order.
+// The schema version of a database is the number of migrations applied to it,
+// so migrations must never be removed or reordered, only appended.
+//
+// Databases created before the schema was versioned may already have some of
+// these changes, so the first migrations check the existing schema before
+// changing it.
+var sqliteMigrations = []migration{
+	{"create file and tags tables", execMigration(`
+		CREATE TABLE IF NOT EXISTS file(
+			uuid TEXT NOT NULL,
+			path TEXT,
+			PRIMARY KEY (uuid)
+			UNIQUE(path) ON CONFLICT REPLACE
+		);
+		CREATE TABLE IF NOT EXISTS tags(
+			uuid TEXT NOT NULL,
+			name TEXT NOT NULL,
+			value INTEGER,
+			FOREIGN KEY(uuid) REFERENCES file(uuid)
+			PRIMARY KEY (uuid, name)
+		);
+	`)},
+	{"add kinds to tag values", upgradeUntypedTags},
+	{"allow several values per tag", upgradeSingleValueTags},
+	{"add aliases table", execMigration(`
+		CREATE TABLE IF NOT EXISTS aliases(
+			alias TEXT NOT NULL,
+			name TEXT NOT NULL,
+			PRIMARY KEY (alias)
+		);
+	`)},
+	{"add rules table", execMigration(`
+		CREATE TABLE IF NOT EXISTS rules(
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			condition TEXT NOT NULL,
+			name TEXT NOT NULL,
+			kind INTEGER NOT NULL DEFAULT 0,
+			value
+		);
+	`)},
+	{"add content hashes to files", execMigration(`
+		ALTER TABLE file ADD COLUMN hash TEXT;
+		ALTER TABLE file ADD COLUMN size INTEGER;
+		ALTER TABLE file ADD COLUMN mtime INTEGER;
+		CREATE INDEX file_hash ON file(hash);
+	`)},
+}
+
+/*
+	A possible future split of the tags table:
+
+	CREATE TABLE named_tags(
+		uuid TEXT NOT NULL,
+		name TEXT NOT NULL,
+		FOREIGN KEY(uuid) REFERENCES file(uuid)
+		PRIMARY KEY (uuid, name)
+	);
+	CREATE TABLE value_tags(
+		uuid TEXT NOT NULL,
+		name TEXT NOT NULL,
+		value INTEGER NOT NULL,
+		FOREIGN KEY(uuid) REFERENCES file(uuid)
+		PRIMARY KEY (uuid, name)
+	);
+*/
+
+// execMigration creates a migration step that executes the given statements
+func execMigration(stmt string) func(q querier) error {
+	return func(q querier) error {
+		_, err := q.Exec(stmt)
+		return err
+	}
+}
+
+// upgradeUntypedTags adds the kind column to the tags table. The value column
+// has integer affinity in databases without it, which would mangle string
+// values, so the table has to be rebuilt.
+func upgradeUntypedTags(q querier) error {
+	cols, err := columns(q, "tags")
+	if err != nil {
+		return err
+	}
+	if _, hasKind := cols["kind"]; hasKind {
+		return nil
+	}
+
+	_, err = q.Exec(`
+		ALTER TABLE tags RENAME TO tags_old;
+		CREATE TABLE tags(
+			uuid TEXT NOT NULL,
+			name TEXT NOT NULL,
+			kind INTEGER NOT NULL DEFAULT 0,
+			value,
+			FOREIGN KEY(uuid) REFERENCES file(uuid)
+			PRIMARY KEY (uuid, name)
+		);
+		INSERT INTO tags (uuid, name, kind, value)
+			SELECT uuid, name, CASE WHEN value IS NULL THEN 0 ELSE 1 END, value FROM tags_old;
+		DROP TABLE tags_old;
+	`)
+	return err
+}
+
+// upgradeSingleValueTags removes the primary key on the tag name, so a file
+// can have several rows with the same tag name, one for each value.
+func upgradeSingleValueTags(q querier) error {
+	cols, err := columns(q, "tags")
+	if err != nil {
+		return err
+	}
+
+	if cols["name"] {
+		_, err = q.Exec(`
+			ALTER TABLE tags RENAME TO tags_old;
+			CREATE TABLE tags(
+				uuid TEXT NOT NULL,
+				name TEXT NOT NULL,
+				kind INTEGER NOT NULL DEFAULT 0,
+				value,
+				FOREIGN KEY(uuid) REFERENCES file(uuid)
+			);
+			INSERT INTO tags (uuid, name, kind, value)
+				SELECT uuid, name, kind, value FROM tags_old;
+			DROP TABLE tags_old;
+		`)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = q.Exec(`
+		CREATE INDEX IF NOT EXISTS tags_uuid_name ON tags(uuid, name);
+		CREATE INDEX IF NOT EXISTS tags_name_value ON tags(name, kind, value);
+	`)
+	return err
+}
+
+// columns returns the columns of the given table, mapped to whether they are
+// part of the primary key
+func columns(q querier, table string) (map[string]bool, error) {
+	rows, err := q.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols := make(map[string]bool)
+	for rows.Next() {
+		// Get the values from the row, we only care about the name and
+		// primary key index
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		err = rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk)
+		if err != nil {
+			return nil, err
+		}
+
+		cols[name] = pk > 0
+	}
+
+	return cols, rows.Err()
+}
+
+const hasSchemaVersionStmt = `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'`
+const getSchemaVersionStmt = `SELECT version FROM schema_version`
+
+// schemaVersion returns the number of migrations applied to the database
+func schemaVersion(q querier) (int, error) {
+	// Databases created before the schema was versioned have no version
+	var n int
+	err := q.QueryRow(hasSchemaVersionStmt).Scan(&n)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+
+	var version int
+	err = q.QueryRow(getSchemaVersionStmt).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+const setSchemaVersionStmt = `
+	CREATE TABLE IF NOT EXISTS schema_version(version INTEGER NOT NULL);
+	DELETE FROM schema_version;
+`
+const insertSchemaVersionStmt = `INSERT INTO schema_version (version) VALUES (?)`
+
+// pendingMigrations returns the migrations not yet applied to the database,
+// or ErrSchemaTooNew if the database was created by a newer version.
+func pendingMigrations(q querier) ([]migration, int, error) {
+	version, err := schemaVersion(q)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if version > len(sqliteMigrations) {
+		return nil, 0, tagger.ErrSchemaTooNew
+	}
+
+	return sqliteMigrations[version:], version, nil
+}
+
+// migrate applies all pending migrations in a single transaction, and returns
+// the descriptions of the applied migrations.
+func (s *SqliteStorage) migrate() ([]string, error) {
+	// Opening an up to date database doesn't need the write lock
+	pending, _, err := pendingMigrations(s.db)
+	if err == tagger.ErrSchemaTooNew {
+		return nil, err
+	} else if err != nil {
+		return nil, sqliteErr(err, tagger.ErrSchemaMismatch)
+	} else if len(pending) == 0 {
+		return nil, nil
+	}
+
+	// Another process may be migrating the database as well, so the
+	// migrations are applied in a transaction holding the write lock from the
+	// start, which database/sql can't begin on it's own
+	conn, err := s.db.Conn(s.ctx)
+	if err != nil {
+		return nil, sqliteErr(err, nil)
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(s.ctx, "BEGIN IMMEDIATE")
+	if err != nil {
+		return nil, sqliteErr(err, nil)
+	}
+
+	applied, err := applyMigrations(connQuerier{Conn: conn, ctx: s.ctx})
+	if err != nil {
+		conn.ExecContext(s.ctx, "ROLLBACK")
+		return nil, err
+	}
+
+	_, err = conn.ExecContext(s.ctx, "COMMIT")
+	if err != nil {
+		conn.ExecContext(s.ctx, "ROLLBACK")
+		return nil, err
+	}
+
+	return applied, nil
+}
+
+// applyMigrations applies the migrations that are still pending once the
+// write lock is held, and records the new schema version
+func applyMigrations(q querier) ([]string, error) {
+	pending, version, err := pendingMigrations(q)
+	if err == tagger.ErrSchemaTooNew {
+		return nil, err
+	} else if err != nil {
+		return nil, sqliteErr(err, tagger.ErrSchemaMismatch)
+	} else if len(pending) == 0 {
+		return nil, nil
+	}
+
+	applied := make([]string, 0, len(pending))
+	for _, m := range pending {
+		if err := m.apply(q); err != nil {
+			return nil, fmt.Errorf("%w: Migration %q failed: %w", tagger.ErrSchemaMismatch, m.description, err)
+		}
+		applied = append(applied, m.description)
+	}
+
+	// Record the new schema version
+	_, err = q.Exec(setSchemaVersionStmt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = q.Exec(insertSchemaVersionStmt, version+len(pending))
+	if err != nil {
+		return nil, err
+	}
+
+	return applied, nil
+}
+
+// connQuerier runs queries on a single connection of a database, for
+// transactions begun with statements of their own
+type connQuerier struct {
+	*sql.Conn
+	ctx context.Context
+}
+
+func (c connQuerier) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.ExecContext(c.ctx, query, args...)
+}
+
+func (c connQuerier) Prepare(query string) (*sql.Stmt, error) {
+	return c.PrepareContext(c.ctx, query)
+}
+
+func (c connQuerier) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.QueryContext(c.ctx, query, args...)
+}
+
+func (c connQuerier) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.QueryRowContext(c.ctx, query, args...)
+}
+
+// PendingSqliteMigrations returns descriptions of the schema migrations that
+// would be applied when opening the sqlite database with NewSqliteStorage,
+// without changing the database. The database is opened read-only, and every
+// migration is pending for databases that don't exist yet.
+func PendingSqliteMigrations(descriptor string) ([]string, error) {
+	pending := sqliteMigrations
+
+	if path, ok := sqliteFile(descriptor); ok {
+		_, err := os.Stat(path)
+		if err == nil {
+			pending, err = pendingSqliteFileMigrations(path, descriptor)
+		} else if os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	descriptions := make([]string, 0, len(pending))
+	for _, m := range pending {
+		descriptions = append(descriptions, m.description)
+	}
+
+	return descriptions, nil
+}
+
+// pendingSqliteFileMigrations returns the migrations not yet applied to an
+// existing database file, which is opened read-only
+func pendingSqliteFileMigrations(path, descriptor string) ([]migration, error) {
+	db, err := sql.Open("sqlite3", readOnlyDescriptor(path, descriptor))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	pending, _, err := pendingMigrations(db)
+	if err != nil {
+		return nil, sqliteErr(err, nil)
+	}
+	return pending, nil
+}
+
+// sqliteFile returns the path of the database file in a connection
+// descriptor, or false for databases that only live as long as the
+// connection, like ":memory:"
+func sqliteFile(descriptor string) (string, bool) {
+	path, query, _ := strings.Cut(descriptor, "?")
+	if uri, ok := strings.CutPrefix(path, "file:"); ok {
+		// URI filenames may have escaped characters
+		path = uri
+		if p, err := url.PathUnescape(uri); err == nil {
+			path = p
+		}
+	}
+	if path == "" || path == ":memory:" {
+		return "", false
+	}
+
+	params, _ := url.ParseQuery(query)
+	if params.Get("mode") == "memory" {
+		return "", false
+	}
+	return path, true
+}
+
+// readOnlyDescriptor returns a connection descriptor opening the database file
+// read-only. The access mode is only passed on to sqlite for URI filenames.
+func readOnlyDescriptor(path, descriptor string) string {
+	_, query, _ := strings.Cut(descriptor, "?")
+	params, _ := url.ParseQuery(query)
+	params.Set("mode", "ro")
+
+	// Percent signs and hashes have a meaning in URIs
+	path = strings.NewReplacer("%", "%25", "#", "%23").Replace(path)
+	return "file:" + path + "?" + params.Encode()
+}
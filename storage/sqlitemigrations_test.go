@@ -0,0 +1,173 @@
+//go:build cgo
+
+package storage
+
+import (
+	"database/sql"
+	"github.com/kiljacken/tagger"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestPendingSqliteMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tags.db")
+
+	// Every migration is pending for a database that doesn't exist, and
+	// listing them doesn't create it
+	for _, descriptor := range []string{path, "file:" + path + "?cache=shared", ":memory:", "file:tags?mode=memory"} {
+		pending, err := PendingSqliteMigrations(descriptor)
+		if err != nil {
+			t.Fatalf("PendingSqliteMigrations(%q): %s", descriptor, err)
+		}
+		if len(pending) != len(sqliteMigrations) {
+			t.Errorf("PendingSqliteMigrations(%q) returned %d migrations, want %d", descriptor, len(pending), len(sqliteMigrations))
+		}
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("PendingSqliteMigrations created the database: %v", err)
+	}
+
+	s, err := NewSqliteStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	pending, err := PendingSqliteMigrations(path)
+	if err != nil {
+		t.Fatalf("PendingSqliteMigrations: %s", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("PendingSqliteMigrations returned %q for a migrated database, want none", pending)
+	}
+}
+
+func TestConcurrentSqliteMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tags.db")
+
+	// Storages opened at the same time apply the migrations once
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := NewSqliteStorageWithOptions(path, DefaultSqliteOptions)
+			if err == nil {
+				err = s.Close()
+			}
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("NewSqliteStorageWithOptions: %s", err)
+		}
+	}
+
+	s, err := NewSqliteStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	version, err := schemaVersion(s.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != len(sqliteMigrations) {
+		t.Errorf("Schema version is %d, want %d", version, len(sqliteMigrations))
+	}
+}
+
+func TestUpgradeBaselineSqlite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tags.db")
+
+	// Create a database the way it was created before the schema was
+	// versioned, where values are untyped integers
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS file(
+			uuid TEXT NOT NULL,
+			path TEXT,
+			PRIMARY KEY (uuid)
+			UNIQUE(path) ON CONFLICT REPLACE
+		);
+		CREATE TABLE IF NOT EXISTS tags(
+			uuid TEXT NOT NULL,
+			name TEXT NOT NULL,
+			value INTEGER,
+			FOREIGN KEY(uuid) REFERENCES file(uuid)
+			PRIMARY KEY (uuid, name)
+		);
+		INSERT INTO file (uuid, path) VALUES ('6ba7b810-9dad-11d1-80b4-00c04fd430c8', 'a.jpg');
+		INSERT INTO tags (uuid, name, value) VALUES ('6ba7b810-9dad-11d1-80b4-00c04fd430c8', 'picture', NULL);
+		INSERT INTO tags (uuid, name, value) VALUES ('6ba7b810-9dad-11d1-80b4-00c04fd430c8', 'year', 2007);
+	`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := PendingSqliteMigrations(path)
+	if err != nil {
+		t.Fatalf("PendingSqliteMigrations: %s", err)
+	}
+	if len(pending) != len(sqliteMigrations) {
+		t.Errorf("PendingSqliteMigrations returned %d migrations for an unversioned database, want %d", len(pending), len(sqliteMigrations))
+	}
+
+	s, err := NewSqliteStorage(path)
+	if err != nil {
+		t.Fatalf("NewSqliteStorage: %s", err)
+	}
+	defer s.Close()
+
+	version, err := schemaVersion(s.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != len(sqliteMigrations) {
+		t.Errorf("Schema version is %d, want %d", version, len(sqliteMigrations))
+	}
+
+	// The file and it's tags are kept
+	f, err := s.GetFileForPath("a.jpg")
+	if err != nil {
+		t.Fatalf("GetFileForPath: %s", err)
+	}
+	tags, err := s.GetTags(f)
+	if err != nil {
+		t.Fatalf("GetTags: %s", err)
+	}
+	got := make(map[string]interface{})
+	for _, tag := range tags {
+		got[tag.Name()] = tagger.TagValue(tag)
+	}
+	if len(got) != 2 || got["picture"] != nil || got["year"] != 2007 {
+		t.Errorf("GetTags returned %v, want picture without a value and year = 2007", got)
+	}
+
+	// Values are no longer stored with integer affinity, so a string of
+	// digits stays a string, and a tag can have several values
+	for _, tag := range []tagger.Tag{tagger.NewStringTag("code", "0123"), tagger.NewValueTag("year", 2008)} {
+		if err := s.AddTagValue(f, tag); err != nil {
+			t.Fatalf("AddTagValue: %s", err)
+		}
+	}
+	codes, err := s.GetTagValues(f, "code")
+	if err != nil || len(codes) != 1 || codes[0].Kind() != tagger.StringKind || codes[0].StringValue() != "0123" {
+		t.Errorf("GetTagValues returned %v, %v, want the string 0123", codes, err)
+	}
+	years, err := s.GetTagValues(f, "year")
+	if err != nil || len(years) != 2 {
+		t.Errorf("GetTagValues returned %v, %v, want two years", years, err)
+	}
+}
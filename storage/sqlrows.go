@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"context"
+	"database/sql"
+	"github.com/kiljacken/tagger"
+	"time"
+)
+
+// querier is the set of methods shared by sql.DB and sql.Tx
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// fileColumns are the columns of the file table read by scanFile
+const fileColumns = `uuid, path, hash, size, mtime`
+
+// scanner is the Scan method shared by sql.Row and sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanFile reads a file from a row with the columns in fileColumns
+func scanFile(row scanner) (tagger.File, error) {
+	// Get the values from the row
+	var rowUuid, path, hash sql.NullString
+	var size, mtime sql.NullInt64
+	err := row.Scan(&rowUuid, &path, &hash, &size, &mtime)
+	if err != nil {
+		return tagger.File{}, err
+	}
+
+	// Construct a file struct, with the content hash if it's known
+	f := tagger.NewFile(uuid.Parse(rowUuid.String), path.String)
+	if hash.Valid {
+		f = f.WithHash(tagger.ContentHash{Sum: hash.String, Size: size.Int64, ModTime: time.Unix(0, mtime.Int64)})
+	}
+	return f, nil
+}
+
+// sqlFileIterator reads files from the rows of a query
+type sqlFileIterator struct {
+	rows *sql.Rows
+	file tagger.File
+	err  error
+}
+
+func (it *sqlFileIterator) Next() bool {
+	if it.err != nil || !it.rows.Next() {
+		return false
+	}
+
+	// Get the file from the row
+	it.file, it.err = scanFile(it.rows)
+	return it.err == nil
+}
+
+func (it *sqlFileIterator) File() tagger.File {
+	return it.file
+}
+
+func (it *sqlFileIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.rows.Err()
+}
+
+func (it *sqlFileIterator) Close() error {
+	return it.rows.Close()
+}
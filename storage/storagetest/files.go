@@ -0,0 +1,207 @@
+package storagetest
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/kiljacken/tagger"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testFiles(t *testing.T, p tagger.StorageProvider) {
+	_, err := p.GetFile(uuid.NewUUID())
+	checkErr(t, "GetFile of an unknown UUID", err, tagger.ErrNoFile)
+	_, err = p.GetFileForPath("missing")
+	checkErr(t, "GetFileForPath of an unknown path", err, tagger.ErrNoFile)
+	_, err = p.GetFileForHash("missing")
+	checkErr(t, "GetFileForHash of an unknown hash", err, tagger.ErrNoFile)
+
+	files, err := p.GetAllFiles()
+	checkFiles(t, "GetAllFiles of an empty storage", files, err, false)
+
+	// Files are read back with their path and content hash
+	h := tagger.ContentHash{Sum: "0123abcd", Size: 3, ModTime: time.Unix(1500000000, 123)}
+	a := tagger.NewFile(uuid.NewUUID(), "a").WithHash(h)
+	if err := p.UpdateFile(a, []tagger.Tag{tagger.NewNamedTag("x")}); err != nil {
+		t.Fatalf("UpdateFile: %s", err)
+	}
+
+	f, err := p.GetFile(a.UUID())
+	if err != nil {
+		t.Fatalf("GetFile: %s", err)
+	}
+	if !uuid.Equal(f.UUID(), a.UUID()) || f.Path() != "a" {
+		t.Errorf("GetFile returned %s at %q, want %s at %q", f.UUID(), f.Path(), a.UUID(), "a")
+	}
+	if got, ok := f.Hash(); !ok || got.Sum != h.Sum || got.Size != h.Size || !got.ModTime.Equal(h.ModTime) {
+		t.Errorf("GetFile returned the content hash %+v, want %+v", got, h)
+	}
+
+	f, err = p.GetFileForPath("a")
+	if err != nil {
+		t.Errorf("GetFileForPath: %s", err)
+	} else if !uuid.Equal(f.UUID(), a.UUID()) {
+		t.Errorf("GetFileForPath returned %s, want %s", f.UUID(), a.UUID())
+	}
+
+	// Files without a content hash have none when read back
+	b := addFile(t, p, "b")
+	f, err = p.GetFile(b.UUID())
+	if err != nil {
+		t.Errorf("GetFile: %s", err)
+	} else if _, ok := f.Hash(); ok {
+		t.Errorf("GetFile returned a content hash for a file stored without one")
+	}
+
+	// The first file by path is returned for a shared content hash
+	addFile(t, p, "c")
+	if err := p.UpdateFile(tagger.NewFile(uuid.NewUUID(), "0").WithHash(h), []tagger.Tag{}); err != nil {
+		t.Fatalf("UpdateFile: %s", err)
+	}
+	f, err = p.GetFileForHash(h.Sum)
+	if err != nil {
+		t.Errorf("GetFileForHash: %s", err)
+	} else if f.Path() != "0" {
+		t.Errorf("GetFileForHash returned %q, want the first file by path %q", f.Path(), "0")
+	}
+
+	files, err = p.GetAllFiles()
+	checkFiles(t, "GetAllFiles", files, err, false, "0", "a", "b", "c")
+	files, err = collect(p.IterateAllFiles())
+	checkFiles(t, "IterateAllFiles", files, err, false, "0", "a", "b", "c")
+
+	// Storing a file with a new path moves it, keeping it's tags
+	if err := p.UpdateFile(a.WithPath("d"), []tagger.Tag{}); err != nil {
+		t.Fatalf("UpdateFile: %s", err)
+	}
+	_, err = p.GetFileForPath("a")
+	checkErr(t, "GetFileForPath of the old path of a moved file", err, tagger.ErrNoFile)
+	f, err = p.GetFileForPath("d")
+	if err != nil {
+		t.Errorf("GetFileForPath of a moved file: %s", err)
+	} else if !uuid.Equal(f.UUID(), a.UUID()) {
+		t.Errorf("GetFileForPath of a moved file returned %s, want %s", f.UUID(), a.UUID())
+	}
+	tags, err := p.GetTags(a)
+	checkTags(t, "GetTags of a moved file", tags, err, "x")
+
+	files, err = p.GetAllFiles()
+	checkFiles(t, "GetAllFiles after a move", files, err, false, "0", "b", "c", "d")
+}
+
+func testPathUniqueness(t *testing.T, p tagger.StorageProvider) {
+	old := addFile(t, p, "a", tagger.NewNamedTag("old"))
+	keep := addFile(t, p, "b", tagger.NewNamedTag("old"))
+
+	// A new file with the path of a stored file replaces it and it's tags
+	f := addFile(t, p, "a", tagger.NewNamedTag("new"))
+
+	got, err := p.GetFileForPath("a")
+	if err != nil {
+		t.Fatalf("GetFileForPath: %s", err)
+	}
+	if !uuid.Equal(got.UUID(), f.UUID()) {
+		t.Errorf("GetFileForPath returned %s, want the new file %s", got.UUID(), f.UUID())
+	}
+
+	_, err = p.GetFile(old.UUID())
+	checkErr(t, "GetFile of a replaced file", err, tagger.ErrNoFile)
+
+	files, err := p.GetAllFiles()
+	checkFiles(t, "GetAllFiles", files, err, false, "a", "b")
+
+	tags, err := p.GetTags(f)
+	checkTags(t, "GetTags of the new file", tags, err, "new")
+	tags, err = p.GetTags(old)
+	checkTags(t, "GetTags of a replaced file", tags, err)
+
+	files, err = p.GetMatchingFiles(tagger.NameFilter{Name: "old"})
+	checkFiles(t, "GetMatchingFiles for a tag of a replaced file", files, err, false, keep.Path())
+
+	infos, err := p.GetAllTags()
+	if err != nil {
+		t.Fatalf("GetAllTags: %s", err)
+	}
+	for _, info := range infos {
+		if info.Name == "old" && info.Files != 1 {
+			t.Errorf("GetAllTags counted %d files with a tag of a replaced file, want 1", info.Files)
+		}
+	}
+}
+
+func testUpdateFile(t *testing.T, p tagger.StorageProvider) {
+	// Several values of a tag are all kept
+	f := addFile(t, p, "a", tagger.NewValueTag("n", 1), tagger.NewValueTag("n", 2), tagger.NewNamedTag("x"))
+	tags, err := p.GetTags(f)
+	checkTags(t, "GetTags", tags, err, "n = 1", "n = 2", "x")
+
+	// The given tags replace the values of tags the file has, while other
+	// tags are kept
+	if err := p.UpdateFile(f, []tagger.Tag{tagger.NewValueTag("n", 3), tagger.NewNamedTag("y")}); err != nil {
+		t.Fatalf("UpdateFile: %s", err)
+	}
+	tags, err = p.GetTags(f)
+	checkTags(t, "GetTags after UpdateFile", tags, err, "n = 3", "x", "y")
+
+	if err := p.UpdateFile(f, []tagger.Tag{}); err != nil {
+		t.Fatalf("UpdateFile: %s", err)
+	}
+	tags, err = p.GetTags(f)
+	checkTags(t, "GetTags after UpdateFile without tags", tags, err, "n = 3", "x", "y")
+}
+
+func testRemoveFile(t *testing.T, p tagger.StorageProvider) {
+	a := addFile(t, p, "a", tagger.NewNamedTag("x/y"), tagger.NewValueTag("n", 1))
+	b := addFile(t, p, "b", tagger.NewNamedTag("x/z"), tagger.NewValueTag("n", 2))
+
+	// Removing a file removes it's tags as well
+	if err := p.RemoveFile(a); err != nil {
+		t.Fatalf("RemoveFile: %s", err)
+	}
+
+	_, err := p.GetFile(a.UUID())
+	checkErr(t, "GetFile of a removed file", err, tagger.ErrNoFile)
+	_, err = p.GetFileForPath("a")
+	checkErr(t, "GetFileForPath of a removed file", err, tagger.ErrNoFile)
+
+	tags, err := p.GetTags(a)
+	checkTags(t, "GetTags of a removed file", tags, err)
+	_, err = p.GetTagValues(a, "n")
+	checkErr(t, "GetTagValues of a removed file", err, tagger.ErrNoTag)
+
+	files, err := p.GetAllFiles()
+	checkFiles(t, "GetAllFiles", files, err, false, "b")
+	files, err = p.GetMatchingFiles(tagger.NameFilter{Name: "n"})
+	checkFiles(t, "GetMatchingFiles", files, err, false, "b")
+
+	names, err := p.GetChildTags("x")
+	if err != nil {
+		t.Errorf("GetChildTags: %s", err)
+	} else if strings.Join(names, ", ") != "x/z" {
+		t.Errorf("GetChildTags returned %v, want [x/z]", names)
+	}
+
+	infos, err := p.GetAllTags()
+	if err != nil {
+		t.Fatalf("GetAllTags: %s", err)
+	}
+	for _, info := range infos {
+		if info.Files != 1 {
+			t.Errorf("GetAllTags counted %d files with %s, want 1", info.Files, info.Name)
+		}
+		if info.Name == "n" && info.Min != nil && info.Min.Value() != 2 {
+			t.Errorf("GetAllTags returned %s as the smallest value of n, want 2", formatTag(info.Min))
+		}
+	}
+
+	// Once every file is gone, so are the tags
+	if err := p.RemoveFile(b); err != nil {
+		t.Fatalf("RemoveFile: %s", err)
+	}
+	infos, err = p.GetAllTags()
+	if err != nil {
+		t.Errorf("GetAllTags: %s", err)
+	} else if len(infos) != 0 {
+		t.Errorf("GetAllTags returned %d tags after removing every file, want none", len(infos))
+	}
+}
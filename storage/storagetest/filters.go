@@ -0,0 +1,269 @@
+package storagetest
+
+import (
+	"fmt"
+	"github.com/kiljacken/tagger"
+	"math"
+	"sort"
+	"testing"
+	"time"
+)
+
+// countFilter is a filter type unknown to the storage backends, which must
+// be matched by calling Matches
+type countFilter struct {
+	n int
+}
+
+func (c countFilter) Matches(tags []tagger.Tag) bool {
+	return len(tags) >= c.n
+}
+
+func (c countFilter) String() string {
+	return fmt.Sprintf("count >= %d", c.n)
+}
+
+// day returns midnight of a date in UTC
+func day(year int, month time.Month, d int) time.Time {
+	return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+}
+
+func testFilters(t *testing.T, p tagger.StorageProvider) {
+	addFile(t, p, "a",
+		tagger.NewNamedTag("animal/cat"),
+		tagger.NewValueTag("legs", 4),
+		tagger.NewStringTag("name", "tom"),
+		tagger.NewFloatTag("weight", 4.5),
+		tagger.NewDateTag("born", day(2019, 5, 1)),
+		tagger.NewBoolTag("pet", true),
+	)
+	addFile(t, p, "b",
+		tagger.NewNamedTag("animal/dog"),
+		tagger.NewValueTag("legs", 4),
+		tagger.NewValueTag("legs", 3),
+		tagger.NewStringTag("name", "rex"),
+		tagger.NewValueTag("weight", 30),
+		tagger.NewDateTag("born", day(2015, 1, 1)),
+		tagger.NewBoolTag("pet", true),
+	)
+	addFile(t, p, "c",
+		tagger.NewNamedTag("plant"),
+		tagger.NewStringTag("name", "fern"),
+		tagger.NewBoolTag("pet", false),
+	)
+	addFile(t, p, "d")
+
+	cmp := func(name string, fn tagger.Comparator, v interface{}) tagger.ComparinsonFilter {
+		return tagger.ComparinsonFilter{Name: name, Function: fn, Value: v}
+	}
+	all := func(f tagger.ComparinsonFilter) tagger.ComparinsonFilter {
+		f.All = true
+		return f
+	}
+	and := func(filters ...tagger.Filter) tagger.Filter { return tagger.AndFilter{Filters: filters} }
+	or := func(filters ...tagger.Filter) tagger.Filter { return tagger.OrFilter{Filters: filters} }
+	not := func(f tagger.Filter) tagger.Filter { return tagger.NotFilter{Filter: f} }
+
+	cases := []struct {
+		filter tagger.Filter
+		want   []string
+	}{
+		// Names, and names with their descendants
+		{tagger.NameFilter{Name: "plant"}, []string{"c"}},
+		{tagger.NameFilter{Name: "animal/cat"}, []string{"a"}},
+		{tagger.NameFilter{Name: "animal"}, []string{}},
+		{tagger.NameFilter{Name: "animal", Descendants: true}, []string{"a", "b"}},
+		{tagger.NameFilter{Name: "plant", Descendants: true}, []string{"c"}},
+		{tagger.NameFilter{Name: "missing"}, []string{}},
+
+		// Every comparator on integers, where any value may match
+		{cmp("legs", tagger.Equals, 4), []string{"a", "b"}},
+		{cmp("legs", tagger.NotEquals, 4), []string{"b"}},
+		{cmp("legs", tagger.LessThan, 4), []string{"b"}},
+		{cmp("legs", tagger.GreaterThan, 3), []string{"a", "b"}},
+		{cmp("legs", tagger.LessThanOrEqual, 3), []string{"b"}},
+		{cmp("legs", tagger.GreaterThanOrEqual, 4), []string{"a", "b"}},
+
+		// Comparisons every value must match
+		{all(cmp("legs", tagger.Equals, 4)), []string{"a"}},
+		{all(cmp("legs", tagger.GreaterThanOrEqual, 3)), []string{"a", "b"}},
+		{all(cmp("legs", tagger.LessThan, 4)), []string{}},
+
+		// Integers and floats compare with each other
+		{cmp("weight", tagger.GreaterThan, 10), []string{"b"}},
+		{cmp("weight", tagger.LessThan, 5.0), []string{"a"}},
+		{cmp("weight", tagger.Equals, 30.0), []string{"b"}},
+		{cmp("legs", tagger.Equals, 3.0), []string{"b"}},
+
+		// Strings, dates and bools
+		{cmp("name", tagger.Equals, "rex"), []string{"b"}},
+		{cmp("name", tagger.LessThan, "s"), []string{"b", "c"}},
+		{cmp("name", tagger.GreaterThanOrEqual, "t"), []string{"a"}},
+		{cmp("born", tagger.LessThan, day(2018, 1, 1)), []string{"b"}},
+		{cmp("born", tagger.GreaterThanOrEqual, day(2019, 5, 1)), []string{"a"}},
+		{cmp("born", tagger.Equals, day(2015, 1, 1)), []string{"b"}},
+		{cmp("pet", tagger.Equals, true), []string{"a", "b"}},
+		{cmp("pet", tagger.Equals, false), []string{"c"}},
+		{cmp("pet", tagger.LessThan, true), []string{"c"}},
+
+		// Values of another kind never match
+		{cmp("name", tagger.Equals, 4), []string{}},
+		{cmp("name", tagger.NotEquals, 4), []string{}},
+		{cmp("legs", tagger.Equals, "4"), []string{}},
+		{cmp("pet", tagger.Equals, 1), []string{}},
+		{cmp("missing", tagger.Equals, 1), []string{}},
+
+		// Combinations of filters
+		{and(tagger.NameFilter{Name: "animal", Descendants: true}, cmp("legs", tagger.Equals, 3)), []string{"b"}},
+		{or(tagger.NameFilter{Name: "plant"}, cmp("name", tagger.Equals, "tom")), []string{"a", "c"}},
+		{not(cmp("pet", tagger.Equals, true)), []string{"c", "d"}},
+		{not(tagger.NameFilter{Name: "animal", Descendants: true}), []string{"c", "d"}},
+		{not(cmp("missing", tagger.Equals, 1)), []string{"a", "b", "c", "d"}},
+		{or(and(tagger.NameFilter{Name: "animal", Descendants: true}, not(cmp("name", tagger.Equals, "rex"))), tagger.NameFilter{Name: "plant"}), []string{"a", "c"}},
+
+		// Filters of types the storage doesn't know
+		{countFilter{n: 7}, []string{"b"}},
+		{and(countFilter{n: 1}, not(tagger.NameFilter{Name: "plant"})), []string{"a", "b"}},
+	}
+
+	for _, c := range cases {
+		checkMatches(t, p, c.filter, c.want...)
+	}
+}
+
+// checkMatches checks the files matching a filter through every method that
+// takes a filter
+func checkMatches(t *testing.T, p tagger.StorageProvider, f tagger.Filter, want ...string) {
+	t.Helper()
+
+	files, err := p.GetMatchingFiles(f)
+	checkFiles(t, fmt.Sprintf("GetMatchingFiles(%s)", f), files, err, false, want...)
+
+	files, err = collect(p.IterateMatchingFiles(f))
+	checkFiles(t, fmt.Sprintf("IterateMatchingFiles(%s)", f), files, err, false, want...)
+
+	// QueryFiles orders the files by path
+	files, err = collect(p.QueryFiles(f, tagger.QueryOptions{}))
+	want = append([]string{}, want...)
+	sort.Strings(want)
+	checkFiles(t, fmt.Sprintf("QueryFiles(%s)", f), files, err, true, want...)
+}
+
+// testFilterValues compares values that are equal without being identical:
+// dates in other time zones than UTC, dates with fractions of a second, which
+// are stored to the second, and negative zero
+func testFilterValues(t *testing.T, p tagger.StorageProvider) {
+	east, west := time.FixedZone("UTC+2", 2*60*60), time.FixedZone("UTC-5", -5*60*60)
+	at := time.Date(2020, 3, 1, 21, 30, 0, 0, time.UTC)
+	negZero := math.Copysign(0, -1)
+
+	addFile(t, p, "a",
+		tagger.NewDateTag("taken", time.Date(2020, 3, 1, 23, 30, 0, 0, east)),
+		tagger.NewFloatTag("offset", negZero),
+	)
+	addFile(t, p, "b",
+		tagger.NewDateTag("taken", at.Add(250*time.Millisecond)),
+		tagger.NewValueTag("offset", 0),
+	)
+	addFile(t, p, "c",
+		tagger.NewDateTag("taken", time.Date(2020, 3, 2, 1, 0, 0, 0, west)),
+		tagger.NewFloatTag("offset", -0.5),
+	)
+	addFile(t, p, "d",
+		tagger.NewDateTag("taken", at.Add(-time.Nanosecond)),
+		tagger.NewFloatTag("offset", 1.5),
+	)
+
+	cmp := func(name string, fn tagger.Comparator, v interface{}) tagger.ComparinsonFilter {
+		return tagger.ComparinsonFilter{Name: name, Function: fn, Value: v}
+	}
+
+	cases := []struct {
+		filter tagger.Filter
+		want   []string
+	}{
+		// Dates compare by the instant they describe, to the second
+		{cmp("taken", tagger.Equals, at), []string{"a", "b"}},
+		{cmp("taken", tagger.Equals, at.In(west)), []string{"a", "b"}},
+		{cmp("taken", tagger.Equals, at.Add(750*time.Millisecond)), []string{"a", "b"}},
+		{cmp("taken", tagger.NotEquals, at.In(east)), []string{"c", "d"}},
+		{cmp("taken", tagger.LessThan, at.In(east)), []string{"d"}},
+		{cmp("taken", tagger.LessThanOrEqual, at.Add(500*time.Millisecond)), []string{"a", "b", "d"}},
+		{cmp("taken", tagger.GreaterThan, at), []string{"c"}},
+		{cmp("taken", tagger.GreaterThanOrEqual, at.Add(-500*time.Millisecond)), []string{"a", "b", "c", "d"}},
+		{cmp("taken", tagger.LessThan, at.Add(-500*time.Millisecond)), []string{}},
+		{cmp("taken", tagger.GreaterThan, time.Date(2020, 3, 2, 0, 59, 59, 0, west)), []string{"c"}},
+
+		// Negative zero is zero, both as a value and in a filter
+		{cmp("offset", tagger.Equals, 0), []string{"a", "b"}},
+		{cmp("offset", tagger.Equals, negZero), []string{"a", "b"}},
+		{cmp("offset", tagger.NotEquals, negZero), []string{"c", "d"}},
+		{cmp("offset", tagger.LessThan, 0.0), []string{"c"}},
+		{cmp("offset", tagger.LessThan, negZero), []string{"c"}},
+		{cmp("offset", tagger.LessThanOrEqual, negZero), []string{"a", "b", "c"}},
+		{cmp("offset", tagger.GreaterThan, negZero), []string{"d"}},
+		{cmp("offset", tagger.GreaterThanOrEqual, 0), []string{"a", "b", "d"}},
+		{cmp("offset", tagger.GreaterThanOrEqual, negZero), []string{"a", "b", "d"}},
+	}
+
+	for _, c := range cases {
+		checkMatches(t, p, c.filter, c.want...)
+	}
+
+	// Equal values are ordered by path when sorting
+	for _, c := range []struct {
+		opts tagger.QueryOptions
+		want []string
+	}{
+		{tagger.QueryOptions{SortTag: "taken"}, []string{"d", "a", "b", "c"}},
+		{tagger.QueryOptions{SortTag: "taken", Descending: true}, []string{"c", "b", "a", "d"}},
+		{tagger.QueryOptions{SortTag: "offset"}, []string{"c", "a", "b", "d"}},
+		{tagger.QueryOptions{SortTag: "offset", Descending: true}, []string{"d", "b", "a", "c"}},
+	} {
+		files, err := collect(p.QueryFiles(nil, c.opts))
+		checkFiles(t, fmt.Sprintf("QueryFiles(nil, %+v)", c.opts), files, err, true, c.want...)
+	}
+}
+
+func testQueryFiles(t *testing.T, p tagger.StorageProvider) {
+	addFile(t, p, "a", tagger.NewValueTag("rank", 3))
+	addFile(t, p, "b", tagger.NewFloatTag("rank", 1.5))
+	addFile(t, p, "c", tagger.NewValueTag("rank", 2), tagger.NewValueTag("rank", 5))
+	addFile(t, p, "d", tagger.NewNamedTag("rank"))
+	addFile(t, p, "e", tagger.NewStringTag("rank", "x"))
+	addFile(t, p, "f", tagger.NewValueTag("rank", 3))
+	if err := p.AddAlias("position", "rank"); err != nil {
+		t.Fatalf("AddAlias: %s", err)
+	}
+
+	cases := []struct {
+		filter tagger.Filter
+		opts   tagger.QueryOptions
+		want   []string
+	}{
+		{nil, tagger.QueryOptions{}, []string{"a", "b", "c", "d", "e", "f"}},
+		{nil, tagger.QueryOptions{Descending: true}, []string{"f", "e", "d", "c", "b", "a"}},
+		{nil, tagger.QueryOptions{Limit: 2}, []string{"a", "b"}},
+		{nil, tagger.QueryOptions{Offset: 4}, []string{"e", "f"}},
+		{nil, tagger.QueryOptions{Limit: 2, Offset: 3}, []string{"d", "e"}},
+		{nil, tagger.QueryOptions{Offset: 10}, []string{}},
+
+		// Files are ordered by their smallest value, numbers before strings,
+		// and files without a value last
+		{nil, tagger.QueryOptions{SortTag: "rank"}, []string{"b", "c", "a", "f", "e", "d"}},
+		// In descending order, files are ordered by their largest value
+		{nil, tagger.QueryOptions{SortTag: "rank", Descending: true}, []string{"e", "c", "f", "a", "b", "d"}},
+		{nil, tagger.QueryOptions{SortTag: "position"}, []string{"b", "c", "a", "f", "e", "d"}},
+		{nil, tagger.QueryOptions{SortTag: "rank", Limit: 3, Offset: 1}, []string{"c", "a", "f"}},
+		{nil, tagger.QueryOptions{SortTag: "missing"}, []string{"a", "b", "c", "d", "e", "f"}},
+
+		// The range is taken from the matching files
+		{tagger.ComparinsonFilter{Name: "rank", Function: tagger.GreaterThan, Value: 2}, tagger.QueryOptions{SortTag: "rank", Offset: 1}, []string{"a", "f"}},
+		{countFilter{n: 1}, tagger.QueryOptions{SortTag: "rank", Descending: true, Limit: 2, Offset: 1}, []string{"c", "f"}},
+	}
+
+	for _, c := range cases {
+		files, err := collect(p.QueryFiles(c.filter, c.opts))
+		checkFiles(t, fmt.Sprintf("QueryFiles(%v, %+v)", c.filter, c.opts), files, err, true, c.want...)
+	}
+}
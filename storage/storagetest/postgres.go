@@ -0,0 +1,117 @@
+package storagetest
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Postgres is a postgres server started for the tests of a package, running
+// from a temporary directory with it's socket in that directory. A backend
+// built on postgres is tested by creating a database for every test:
+//
+//	func TestPostgres(t *testing.T) {
+//		pg := storagetest.StartPostgres(t)
+//		storagetest.Run(t, func(t *testing.T) tagger.StorageProvider {
+//			p, err := storage.NewPostgresStorage(pg.NewDatabase(t))
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return p
+//		})
+//	}
+type Postgres struct {
+	bin  string
+	dir  string
+	user string
+	n    atomic.Int32
+}
+
+// postgresUser is the superuser of the test server
+const postgresUser = "tagger"
+
+// StartPostgres starts a new postgres server, which is stopped when the test
+// is done. The test is skipped if the postgres server programs can't be
+// found in PATH, and when running as root, which postgres refuses. Setting
+// TAGGER_POSTGRES_BIN to the directory of the programs makes the test fail
+// instead, so a CI job that sets it can't pass without running postgres.
+func StartPostgres(t testing.TB) *Postgres {
+	t.Helper()
+
+	skip := t.Skipf
+	if os.Getenv("TAGGER_POSTGRES_BIN") != "" {
+		skip = t.Fatalf
+	}
+
+	if os.Geteuid() == 0 {
+		skip("postgres can't be run as root")
+	}
+
+	bin, err := postgresBin()
+	if err != nil {
+		skip("postgres not available: %s", err)
+	}
+
+	// The socket path is limited to around a hundred bytes, so the server
+	// runs from a short temporary directory rather than t.TempDir
+	dir, err := os.MkdirTemp("", "tagger-pg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	pg := &Postgres{bin: bin, dir: dir, user: postgresUser}
+	data := filepath.Join(dir, "data")
+	pg.run(t, "initdb", "-D", data, "-U", pg.user, "--auth=trust", "--encoding=UTF8", "--no-locale")
+	pg.run(t, "pg_ctl", "-D", data, "-l", filepath.Join(dir, "log"), "-w",
+		"-o", fmt.Sprintf("-c listen_addresses='' -c unix_socket_directories='%s' -c fsync=off", dir), "start")
+	t.Cleanup(func() {
+		exec.Command(filepath.Join(bin, "pg_ctl"), "-D", data, "-m", "immediate", "stop").Run()
+	})
+
+	return pg
+}
+
+// NewDatabase creates a new, empty database on the server and returns it's
+// connection string
+func (pg *Postgres) NewDatabase(t testing.TB) string {
+	t.Helper()
+
+	name := fmt.Sprintf("tagger_test_%d", pg.n.Add(1))
+	pg.run(t, "createdb", "-h", pg.dir, "-U", pg.user, name)
+	return fmt.Sprintf("host=%s user=%s dbname=%s sslmode=disable", pg.dir, pg.user, name)
+}
+
+// run runs one of the postgres server programs, and fails the test if it
+// fails
+func (pg *Postgres) run(t testing.TB, name string, args ...string) {
+	t.Helper()
+
+	out, err := exec.Command(filepath.Join(pg.bin, name), args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %s\n%s", name, err, strings.TrimSpace(string(out)))
+	}
+}
+
+// postgresBin returns the directory with the postgres server programs.
+// Distributions often keep them out of PATH, in which case pg_config knows
+// where they are.
+func postgresBin() (string, error) {
+	if dir := os.Getenv("TAGGER_POSTGRES_BIN"); dir != "" {
+		return dir, nil
+	}
+
+	if path, err := exec.LookPath("initdb"); err == nil {
+		return filepath.Dir(path), nil
+	}
+
+	out, err := exec.Command("pg_config", "--bindir").Output()
+	if err != nil {
+		return "", fmt.Errorf("initdb and pg_config not found in PATH")
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,155 @@
+// Package storagetest checks that an implementation of
+// tagger.StorageProvider behaves like the storage backends of tagger. A
+// backend is tested by running the suite from a test in it's own package:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) tagger.StorageProvider {
+//			return storage.NewMemoryStorage()
+//		})
+//	}
+//
+// The suite is kept in a regular package rather than in test files, so
+// backends outside this repository can run it as well. Each test gets an
+// empty storage, and never writes to the storage outside of a transaction
+// while the transaction is open.
+package storagetest
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"errors"
+	"fmt"
+	"github.com/kiljacken/tagger"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Factory returns a new, empty storage. It is called once for every test of
+// the suite, and the storage is closed when the test is done.
+type Factory func(t *testing.T) tagger.StorageProvider
+
+// tests are the tests of the suite, run in order
+var tests = []struct {
+	name string
+	fn   func(t *testing.T, p tagger.StorageProvider)
+}{
+	{"Files", testFiles},
+	{"PathUniqueness", testPathUniqueness},
+	{"UpdateFile", testUpdateFile},
+	{"RemoveFile", testRemoveFile},
+	{"UpdateTag", testUpdateTag},
+	{"TagValues", testTagValues},
+	{"ValueKinds", testValueKinds},
+	{"InvalidValues", testInvalidValues},
+	{"Filters", testFilters},
+	{"FilterValues", testFilterValues},
+	{"QueryFiles", testQueryFiles},
+	{"Aliases", testAliases},
+	{"AliasValues", testAliasValues},
+	{"Rules", testRules},
+	{"GetAllTags", testGetAllTags},
+	{"GetChildTags", testGetChildTags},
+	{"Transactions", testTransactions},
+	{"WithContext", testWithContext},
+}
+
+// Run runs every test of the suite as a subtest of t, each with a new
+// storage from the factory
+func Run(t *testing.T, newStorage Factory) {
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			p := newStorage(t)
+			defer p.Close()
+			test.fn(t, p)
+		})
+	}
+}
+
+// addFile stores a new file with the given path and tags
+func addFile(t *testing.T, p tagger.StorageProvider, path string, tags ...tagger.Tag) tagger.File {
+	t.Helper()
+
+	f := tagger.NewFile(uuid.NewUUID(), path)
+	if err := p.UpdateFile(f, tags); err != nil {
+		t.Fatalf("UpdateFile(%q): %s", path, err)
+	}
+	return f
+}
+
+// formatTag formats a tag as "name" or "name = value", where the value is
+// written so tags of different kinds are told apart
+func formatTag(t tagger.Tag) string {
+	if !t.HasValue() {
+		return t.Name()
+	}
+	return fmt.Sprintf("%s = %s", t.Name(), tagger.FormatValue(tagger.TagValue(t)))
+}
+
+// checkTags compares tags with the expected tags in any order
+func checkTags(t *testing.T, what string, tags []tagger.Tag, err error, want ...string) {
+	t.Helper()
+
+	if err != nil {
+		t.Errorf("%s: %s", what, err)
+		return
+	}
+
+	got := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		got = append(got, formatTag(tag))
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("%s returned [%s], want [%s]", what, strings.Join(got, ", "), strings.Join(want, ", "))
+	}
+}
+
+// checkFiles compares the paths of files with the expected paths. If ordered
+// is false, the files may be in any order.
+func checkFiles(t *testing.T, what string, files []tagger.File, err error, ordered bool, want ...string) {
+	t.Helper()
+
+	if err != nil {
+		t.Errorf("%s: %s", what, err)
+		return
+	}
+
+	got := make([]string, 0, len(files))
+	for _, f := range files {
+		got = append(got, f.Path())
+	}
+	if !ordered {
+		sort.Strings(got)
+		sort.Strings(want)
+	}
+
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("%s returned [%s], want [%s]", what, strings.Join(got, ", "), strings.Join(want, ", "))
+	}
+}
+
+// collect reads the files of an iterator
+func collect(it tagger.FileIterator, err error) ([]tagger.File, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	files := make([]tagger.File, 0)
+	for it.Next() {
+		files = append(files, it.File())
+	}
+	return files, it.Err()
+}
+
+// checkErr checks that an error is, or wraps, the expected error
+func checkErr(t *testing.T, what string, err, want error) {
+	t.Helper()
+
+	if !errors.Is(err, want) {
+		t.Errorf("%s returned %v, want %v", what, err, want)
+	}
+}
@@ -0,0 +1,406 @@
+package storagetest
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"fmt"
+	"github.com/kiljacken/tagger"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testUpdateTag(t *testing.T, p tagger.StorageProvider) {
+	f := addFile(t, p, "a", tagger.NewNamedTag("other"))
+
+	// UpdateTag replaces every value of the tag
+	if err := p.UpdateTag(f, tagger.NewValueTag("n", 1)); err != nil {
+		t.Fatalf("UpdateTag: %s", err)
+	}
+	if err := p.AddTagValue(f, tagger.NewValueTag("n", 2)); err != nil {
+		t.Fatalf("AddTagValue: %s", err)
+	}
+	tags, err := p.GetTagValues(f, "n")
+	checkTags(t, "GetTagValues", tags, err, "n = 1", "n = 2")
+
+	if err := p.UpdateTag(f, tagger.NewValueTag("n", 3)); err != nil {
+		t.Fatalf("UpdateTag: %s", err)
+	}
+	tags, err = p.GetTagValues(f, "n")
+	checkTags(t, "GetTagValues after UpdateTag", tags, err, "n = 3")
+
+	// Values of another kind replace the values as well
+	if err := p.UpdateTag(f, tagger.NewStringTag("n", "three")); err != nil {
+		t.Fatalf("UpdateTag: %s", err)
+	}
+	tags, err = p.GetTagValues(f, "n")
+	checkTags(t, "GetTagValues after UpdateTag with a string", tags, err, `n = "three"`)
+
+	if err := p.UpdateTag(f, tagger.NewNamedTag("n")); err != nil {
+		t.Fatalf("UpdateTag: %s", err)
+	}
+	tags, err = p.GetTags(f)
+	checkTags(t, "GetTags after UpdateTag without a value", tags, err, "n", "other")
+
+	// Tags can't be set on files that aren't stored
+	missing := tagger.NewFile(uuid.NewUUID(), "missing")
+	err = p.UpdateTag(missing, tagger.NewNamedTag("n"))
+	checkErr(t, "UpdateTag of an unknown file", err, tagger.ErrNoFile)
+
+	files, err := p.GetMatchingFiles(tagger.NameFilter{Name: "n"})
+	checkFiles(t, "GetMatchingFiles", files, err, false, "a")
+}
+
+func testTagValues(t *testing.T, p tagger.StorageProvider) {
+	f := addFile(t, p, "a")
+
+	_, err := p.GetTagValues(f, "n")
+	checkErr(t, "GetTagValues of a missing tag", err, tagger.ErrNoTag)
+
+	// A value is only stored once
+	for _, v := range []int{1, 2, 1} {
+		if err := p.AddTagValue(f, tagger.NewValueTag("n", v)); err != nil {
+			t.Fatalf("AddTagValue: %s", err)
+		}
+	}
+	tags, err := p.GetTagValues(f, "n")
+	checkTags(t, "GetTagValues", tags, err, "n = 1", "n = 2")
+
+	// Values that are equal are the same value, even when they are written
+	// differently
+	at := time.Date(2020, 3, 1, 21, 30, 0, 0, time.UTC)
+	equal := []tagger.Tag{
+		tagger.NewFloatTag("z", 0),
+		tagger.NewFloatTag("z", math.Copysign(0, -1)),
+		tagger.NewDateTag("d", at),
+		tagger.NewDateTag("d", at.In(time.FixedZone("UTC+2", 2*60*60))),
+	}
+	for _, tag := range equal {
+		if err := p.AddTagValue(f, tag); err != nil {
+			t.Fatalf("AddTagValue: %s", err)
+		}
+	}
+	tags, err = p.GetTagValues(f, "z")
+	checkTags(t, "GetTagValues of equal floats", tags, err, "z = 0.0")
+	tags, err = p.GetTagValues(f, "d")
+	checkTags(t, "GetTagValues of equal dates", tags, err, "d = 2020-03-01T21:30:00Z")
+
+	// Only the given value is removed
+	if err := p.RemoveTagValue(f, tagger.NewValueTag("n", 1)); err != nil {
+		t.Fatalf("RemoveTagValue: %s", err)
+	}
+	tags, err = p.GetTagValues(f, "n")
+	checkTags(t, "GetTagValues after RemoveTagValue", tags, err, "n = 2")
+
+	// A value of another kind isn't the same value
+	if err := p.RemoveTagValue(f, tagger.NewStringTag("n", "2")); err != nil {
+		t.Fatalf("RemoveTagValue: %s", err)
+	}
+	tags, err = p.GetTagValues(f, "n")
+	checkTags(t, "GetTagValues after RemoveTagValue of another kind", tags, err, "n = 2")
+
+	// RemoveTag removes every value
+	if err := p.AddTagValue(f, tagger.NewValueTag("n", 3)); err != nil {
+		t.Fatalf("AddTagValue: %s", err)
+	}
+	if err := p.RemoveTag(f, tagger.NewNamedTag("n")); err != nil {
+		t.Fatalf("RemoveTag: %s", err)
+	}
+	_, err = p.GetTagValues(f, "n")
+	checkErr(t, "GetTagValues of a removed tag", err, tagger.ErrNoTag)
+
+	missing := tagger.NewFile(uuid.NewUUID(), "missing")
+	err = p.AddTagValue(missing, tagger.NewNamedTag("n"))
+	checkErr(t, "AddTagValue of an unknown file", err, tagger.ErrNoFile)
+	_, err = p.GetTagValues(missing, "n")
+	checkErr(t, "GetTagValues of an unknown file", err, tagger.ErrNoTag)
+}
+
+func testValueKinds(t *testing.T, p tagger.StorageProvider) {
+	date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	want := []tagger.Tag{
+		tagger.NewNamedTag("named"),
+		tagger.NewValueTag("int", -42),
+		tagger.NewStringTag("string", "hello, world"),
+		tagger.NewFloatTag("float", 1.5),
+		tagger.NewDateTag("date", date),
+		tagger.NewBoolTag("bool", true),
+	}
+	f := addFile(t, p, "a", want...)
+
+	for _, w := range want {
+		tags, err := p.GetTagValues(f, w.Name())
+		if err != nil {
+			t.Errorf("GetTagValues(%q): %s", w.Name(), err)
+			continue
+		}
+		if len(tags) != 1 {
+			t.Errorf("GetTagValues(%q) returned %d values, want 1", w.Name(), len(tags))
+			continue
+		}
+
+		got := tags[0]
+		if got.Kind() != w.Kind() || got.HasValue() != w.HasValue() {
+			t.Errorf("GetTagValues(%q) returned a tag of kind %d, want %d", w.Name(), got.Kind(), w.Kind())
+			continue
+		}
+
+		switch w.Kind() {
+		case tagger.DateKind:
+			if !got.DateValue().Equal(date) {
+				t.Errorf("GetTagValues(%q) returned %s, want %s", w.Name(), got.DateValue(), date)
+			}
+		default:
+			if tagger.TagValue(got) != tagger.TagValue(w) {
+				t.Errorf("GetTagValues(%q) returned %s, want %s", w.Name(), formatTag(got), formatTag(w))
+			}
+		}
+	}
+}
+
+func testInvalidValues(t *testing.T, p tagger.StorageProvider) {
+	f := addFile(t, p, "a", tagger.NewValueTag("n", 1))
+
+	// Floats that aren't finite can't be stored or compared
+	for _, v := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		tag := tagger.NewFloatTag("n", v)
+		checkErr(t, fmt.Sprintf("UpdateTag with %g", v), p.UpdateTag(f, tag), tagger.ErrInvalidValue)
+		checkErr(t, fmt.Sprintf("AddTagValue with %g", v), p.AddTagValue(f, tag), tagger.ErrInvalidValue)
+		checkErr(t, fmt.Sprintf("UpdateFile with %g", v), p.UpdateFile(f, []tagger.Tag{tagger.NewNamedTag("m"), tag}), tagger.ErrInvalidValue)
+
+		_, err := p.AddRule(tagger.Rule{Condition: tagger.NameFilter{Name: "m"}, Implies: tag})
+		checkErr(t, fmt.Sprintf("AddRule with %g", v), err, tagger.ErrInvalidValue)
+	}
+
+	// Nothing was changed by the failed calls
+	tags, err := p.GetTags(f)
+	checkTags(t, "GetTags", tags, err, "n = 1")
+	rules, err := p.GetRules()
+	if err != nil || len(rules) != 0 {
+		t.Errorf("GetRules returned %d rules and %v, want none", len(rules), err)
+	}
+}
+
+func testAliases(t *testing.T, p tagger.StorageProvider) {
+	f := addFile(t, p, "a", tagger.NewNamedTag("moggy"))
+
+	// Tags already stored under the alias are moved to the tag name
+	if err := p.AddAlias("moggy", "cat"); err != nil {
+		t.Fatalf("AddAlias: %s", err)
+	}
+	tags, err := p.GetTags(f)
+	checkTags(t, "GetTags after AddAlias", tags, err, "cat")
+
+	// Tags written and read under an alias use the tag name
+	if err := p.AddAlias("kitty", "cat"); err != nil {
+		t.Fatalf("AddAlias: %s", err)
+	}
+	if err := p.UpdateTag(f, tagger.NewValueTag("kitty", 1)); err != nil {
+		t.Fatalf("UpdateTag: %s", err)
+	}
+	tags, err = p.GetTags(f)
+	checkTags(t, "GetTags", tags, err, "cat = 1")
+	tags, err = p.GetTagValues(f, "kitty")
+	checkTags(t, "GetTagValues of an alias", tags, err, "cat = 1")
+
+	files, err := p.GetMatchingFiles(tagger.ComparinsonFilter{Name: "kitty", Function: tagger.Equals, Value: 1})
+	checkFiles(t, "GetMatchingFiles of an alias", files, err, false, "a")
+
+	// Aliases refer to the end of a chain of aliases
+	if err := p.AddAlias("feline", "kitty"); err != nil {
+		t.Fatalf("AddAlias: %s", err)
+	}
+	err = p.AddAlias("cat", "feline")
+	checkErr(t, "AddAlias of a cycle", err, tagger.ErrAliasCycle)
+
+	// Aliases of a name that becomes an alias follow it
+	if err := p.AddAlias("cat", "felis"); err != nil {
+		t.Fatalf("AddAlias: %s", err)
+	}
+	tags, err = p.GetTags(f)
+	checkTags(t, "GetTags after aliasing the tag name", tags, err, "felis = 1")
+
+	if err := p.RemoveAlias("moggy"); err != nil {
+		t.Fatalf("RemoveAlias: %s", err)
+	}
+
+	aliases, err := p.GetAliases()
+	if err != nil {
+		t.Fatalf("GetAliases: %s", err)
+	}
+	want := map[string]string{"cat": "felis", "kitty": "felis", "feline": "felis"}
+	if fmt.Sprint(aliases) != fmt.Sprint(want) {
+		t.Errorf("GetAliases returned %v, want %v", aliases, want)
+	}
+}
+
+func testAliasValues(t *testing.T, p tagger.StorageProvider) {
+	if err := p.AddAlias("kitty", "cat"); err != nil {
+		t.Fatalf("AddAlias: %s", err)
+	}
+
+	// Values given under an alias and the tag name are all kept
+	f := addFile(t, p, "a", tagger.NewValueTag("cat", 1), tagger.NewValueTag("kitty", 2), tagger.NewValueTag("cat", 3))
+	tags, err := p.GetTags(f)
+	checkTags(t, "GetTags of a file stored with an alias", tags, err, "cat = 1", "cat = 2", "cat = 3")
+
+	// Values a file has under both names are only kept once when one of
+	// the names becomes an alias
+	g := addFile(t, p, "b", tagger.NewValueTag("dog", 1), tagger.NewValueTag("dog", 2), tagger.NewValueTag("hound", 2), tagger.NewValueTag("hound", 3))
+	if err := p.AddAlias("hound", "dog"); err != nil {
+		t.Fatalf("AddAlias: %s", err)
+	}
+	tags, err = p.GetTags(g)
+	checkTags(t, "GetTags after AddAlias", tags, err, "dog = 1", "dog = 2", "dog = 3")
+
+	infos, err := p.GetAllTags()
+	if err != nil {
+		t.Fatalf("GetAllTags: %s", err)
+	}
+	for _, info := range infos {
+		if info.Name == "dog" && info.Files != 1 {
+			t.Errorf("GetAllTags counted %d files with dog, want 1", info.Files)
+		}
+	}
+}
+
+func testRules(t *testing.T, p tagger.StorageProvider) {
+	dog := addFile(t, p, "dog", tagger.NewNamedTag("dog"))
+
+	parse := func(s string) tagger.Rule {
+		r, err := tagger.ParseRule(s)
+		if err != nil {
+			t.Fatalf("ParseRule(%q): %s", s, err)
+		}
+		return r
+	}
+
+	// Rules are applied when tags are written
+	catRule, err := p.AddRule(parse("cat => animal"))
+	if err != nil {
+		t.Fatalf("AddRule: %s", err)
+	}
+	if _, err := p.AddRule(parse("animal => legs = 4")); err != nil {
+		t.Fatalf("AddRule: %s", err)
+	}
+	cat := addFile(t, p, "cat", tagger.NewNamedTag("cat"))
+	tags, err := p.GetTags(cat)
+	checkTags(t, "GetTags of a file with implied tags", tags, err, "animal", "cat", "legs = 4")
+
+	_, err = p.AddRule(parse("legs == 4 => cat"))
+	checkErr(t, "AddRule of a cycle", err, tagger.ErrRuleCycle)
+
+	// Existing files only get implied tags from ApplyRules
+	if _, err := p.AddRule(parse("dog => animal")); err != nil {
+		t.Fatalf("AddRule: %s", err)
+	}
+	tags, err = p.GetTags(dog)
+	checkTags(t, "GetTags before ApplyRules", tags, err, "dog")
+	if err := p.ApplyRules(); err != nil {
+		t.Fatalf("ApplyRules: %s", err)
+	}
+	tags, err = p.GetTags(dog)
+	checkTags(t, "GetTags after ApplyRules", tags, err, "animal", "dog", "legs = 4")
+
+	rules, err := p.GetRules()
+	if err != nil {
+		t.Fatalf("GetRules: %s", err)
+	}
+	got := make([]string, 0, len(rules))
+	for _, r := range rules {
+		got = append(got, r.String())
+	}
+	want := "cat => animal; animal => legs = 4; dog => animal"
+	if strings.Join(got, "; ") != want {
+		t.Errorf("GetRules returned %q, want %q", strings.Join(got, "; "), want)
+	}
+
+	if err := p.RemoveRule(catRule); err != nil {
+		t.Fatalf("RemoveRule: %s", err)
+	}
+	err = p.RemoveRule(catRule)
+	checkErr(t, "RemoveRule of a removed rule", err, tagger.ErrNoRule)
+
+	// New rules get an ID of their own, and are returned last
+	id, err := p.AddRule(parse("cat => pet"))
+	if err != nil {
+		t.Fatalf("AddRule: %s", err)
+	}
+	rules, err = p.GetRules()
+	if err != nil {
+		t.Fatalf("GetRules: %s", err)
+	}
+	if len(rules) != 3 || rules[0].ID == id || rules[1].ID == id || rules[2].ID != id {
+		t.Errorf("GetRules doesn't return the new rule with ID %d last", id)
+	}
+
+	// The ID of a removed rule isn't given out again, even if it was the
+	// last rule
+	if err := p.RemoveRule(id); err != nil {
+		t.Fatalf("RemoveRule: %s", err)
+	}
+	next, err := p.AddRule(parse("cat => pet"))
+	if err != nil {
+		t.Fatalf("AddRule: %s", err)
+	}
+	if next == id {
+		t.Errorf("AddRule reused the ID %d of a removed rule", id)
+	}
+}
+
+func testGetAllTags(t *testing.T, p tagger.StorageProvider) {
+	addFile(t, p, "a", tagger.NewValueTag("n", 1), tagger.NewFloatTag("n", 2.5), tagger.NewNamedTag("flag"))
+	addFile(t, p, "b", tagger.NewStringTag("n", "s"), tagger.NewValueTag("n", -1))
+	addFile(t, p, "c", tagger.NewNamedTag("flag"), tagger.NewNamedTag("n"), tagger.NewBoolTag("z", false))
+
+	infos, err := p.GetAllTags()
+	if err != nil {
+		t.Fatalf("GetAllTags: %s", err)
+	}
+
+	got := make([]string, 0, len(infos))
+	for _, info := range infos {
+		min, max := "nil", "nil"
+		if info.Min != nil {
+			min = formatTag(info.Min)
+		}
+		if info.Max != nil {
+			max = formatTag(info.Max)
+		}
+		got = append(got, fmt.Sprintf("%s %d %s %s %t", info.Name, info.Files, min, max, info.Valueless))
+	}
+
+	want := []string{
+		"flag 2 nil nil true",
+		`n 3 n = -1 n = "s" true`,
+		"z 1 z = false z = false false",
+	}
+	if strings.Join(got, "; ") != strings.Join(want, "; ") {
+		t.Errorf("GetAllTags returned %q, want %q", strings.Join(got, "; "), strings.Join(want, "; "))
+	}
+}
+
+func testGetChildTags(t *testing.T, p tagger.StorageProvider) {
+	addFile(t, p, "a", tagger.NewNamedTag("a/b/c"), tagger.NewNamedTag("e"))
+	addFile(t, p, "b", tagger.NewNamedTag("a/d"), tagger.NewNamedTag("ab"))
+
+	cases := []struct {
+		parent string
+		want   string
+	}{
+		{"", "a, ab, e"},
+		{"a", "a/b, a/d"},
+		{"a/b", "a/b/c"},
+		{"a/b/c", ""},
+		{"missing", ""},
+	}
+
+	for _, c := range cases {
+		names, err := p.GetChildTags(c.parent)
+		if err != nil {
+			t.Errorf("GetChildTags(%q): %s", c.parent, err)
+		} else if strings.Join(names, ", ") != c.want {
+			t.Errorf("GetChildTags(%q) returned [%s], want [%s]", c.parent, strings.Join(names, ", "), c.want)
+		}
+	}
+}
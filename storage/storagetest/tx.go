@@ -0,0 +1,100 @@
+package storagetest
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"context"
+	"github.com/kiljacken/tagger"
+	"testing"
+)
+
+func testTransactions(t *testing.T, p tagger.StorageProvider) {
+	// Committed changes are kept
+	tx, err := p.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %s", err)
+	}
+	f := addFile(t, tx, "a", tagger.NewNamedTag("x"))
+
+	_, err = tx.Begin()
+	checkErr(t, "Begin of a transactional view", err, tagger.ErrNestedTx)
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %s", err)
+	}
+	if err := tx.Close(); err != nil {
+		t.Errorf("Close of a committed transaction: %s", err)
+	}
+	if _, err := tx.GetAllFiles(); err == nil {
+		t.Errorf("GetAllFiles of a committed transaction didn't fail")
+	}
+
+	tags, err := p.GetTags(f)
+	checkTags(t, "GetTags after Commit", tags, err, "x")
+
+	// Rolled back changes are discarded
+	tx, err = p.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %s", err)
+	}
+	addFile(t, tx, "b")
+	if err := tx.UpdateTag(f, tagger.NewNamedTag("y")); err != nil {
+		t.Fatalf("UpdateTag: %s", err)
+	}
+	if err := tx.RemoveFile(f); err != nil {
+		t.Fatalf("RemoveFile: %s", err)
+	}
+
+	files, err := tx.GetAllFiles()
+	checkFiles(t, "GetAllFiles within a transaction", files, err, false, "b")
+
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback: %s", err)
+	}
+
+	files, err = p.GetAllFiles()
+	checkFiles(t, "GetAllFiles after Rollback", files, err, false, "a")
+	tags, err = p.GetTags(f)
+	checkTags(t, "GetTags after Rollback", tags, err, "x")
+
+	// Closing an open transaction rolls it back
+	tx, err = p.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %s", err)
+	}
+	addFile(t, tx, "c")
+	if err := tx.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	files, err = p.GetAllFiles()
+	checkFiles(t, "GetAllFiles after Close", files, err, false, "a")
+}
+
+func testWithContext(t *testing.T, p tagger.StorageProvider) {
+	addFile(t, p, "a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	view := p.WithContext(ctx)
+
+	files, err := view.GetAllFiles()
+	checkFiles(t, "GetAllFiles of a view", files, err, false, "a")
+
+	// Closing the view leaves the storage open
+	if err := view.Close(); err != nil {
+		t.Errorf("Close of a view: %s", err)
+	}
+	files, err = p.GetAllFiles()
+	checkFiles(t, "GetAllFiles after closing a view", files, err, false, "a")
+
+	// Once the context is cancelled, the view stops with it's error
+	cancel()
+	_, err = view.GetAllFiles()
+	checkErr(t, "GetAllFiles of a cancelled view", err, context.Canceled)
+	err = view.UpdateFile(tagger.NewFile(uuid.NewUUID(), "b"), []tagger.Tag{})
+	checkErr(t, "UpdateFile of a cancelled view", err, context.Canceled)
+	_, err = view.Begin()
+	checkErr(t, "Begin of a cancelled view", err, context.Canceled)
+
+	files, err = p.GetAllFiles()
+	checkFiles(t, "GetAllFiles after cancelling a view", files, err, false, "a")
+}
@@ -0,0 +1,249 @@
+// Package watch keeps a tag database in sync with the changes made to a
+// directory tree
+package watch
+
+import (
+	"errors"
+	"github.com/kiljacken/tagger"
+	"github.com/kiljacken/tagger/scanner"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUnsupported is returned by Watch on platforms where watching isn't
+// implemented
+var ErrUnsupported = errors.New("watch: Watching isn't supported on this platform")
+
+// MissingTag is set on files that have been deleted, unless deleted files are
+// removed from storage. It is removed again if the file reappears.
+const MissingTag = "missing"
+
+// Options controls how changes to the watched tree are applied to storage
+type Options struct {
+	// Scan decides which new files are added, and how they are tagged
+	Scan scanner.Options
+	// RemoveDeleted removes deleted files from storage instead of tagging
+	// them with MissingTag
+	RemoveDeleted bool
+	// Logger receives a line for every change made to storage, and for
+	// every error that doesn't stop the watch. Nothing is logged if nil.
+	Logger *log.Logger
+}
+
+// syncer applies changes in the watched tree to storage. All paths are in
+// the form stored in storage, which is the path joined with the root.
+type syncer struct {
+	p    tagger.StorageProvider
+	root string
+	opts Options
+}
+
+func (s *syncer) logf(format string, args ...interface{}) {
+	if s.opts.Logger != nil {
+		s.opts.Logger.Printf(format, args...)
+	}
+}
+
+// written handles a file that has been created or changed
+func (s *syncer) written(path string) error {
+	f, err := s.p.GetFileForPath(path)
+	if err == tagger.ErrNoFile {
+		return s.added(path)
+	} else if err != nil {
+		return err
+	}
+
+	// The file is known, so bring it's content hash up to date
+	if !s.opts.Scan.SkipHash {
+		h, err := tagger.HashFile(path)
+		if err != nil {
+			return err
+		}
+		err = s.p.UpdateFile(f.WithHash(h), []tagger.Tag{})
+		if err != nil {
+			return err
+		}
+	}
+
+	// If the file was deleted before, it's back now
+	err = s.p.RemoveTag(f, tagger.NewNamedTag(MissingTag))
+	if err != nil {
+		return err
+	}
+
+	s.logf("Updated %s", path)
+	return nil
+}
+
+// added adds a new file if it's matched by the scan options
+func (s *syncer) added(path string) error {
+	rel, err := filepath.Rel(s.root, path)
+	if err != nil {
+		return err
+	}
+
+	if !s.opts.Scan.Matches(rel) {
+		return nil
+	}
+
+	file, err := s.opts.Scan.NewFile(path)
+	if err != nil {
+		return err
+	}
+
+	err = s.p.UpdateFile(file, s.opts.Scan.Tags(rel))
+	if err != nil {
+		return err
+	}
+
+	s.logf("Added %s", path)
+	return nil
+}
+
+// removed handles a file that has been deleted or moved out of the tree
+func (s *syncer) removed(path string) error {
+	f, err := s.p.GetFileForPath(path)
+	if err == tagger.ErrNoFile {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if s.opts.RemoveDeleted {
+		err = s.p.RemoveFile(f)
+		if err != nil {
+			return err
+		}
+		s.logf("Removed %s", path)
+		return nil
+	}
+
+	err = s.p.UpdateTag(f, tagger.NewNamedTag(MissingTag))
+	if err != nil {
+		return err
+	}
+	s.logf("Tagged %s as %s", path, MissingTag)
+	return nil
+}
+
+// moved handles a file that has been renamed within the tree
+func (s *syncer) moved(from, to string) error {
+	f, err := s.p.GetFileForPath(from)
+	if err == tagger.ErrNoFile {
+		// The file wasn't known, so treat it as a new file
+		return s.written(to)
+	} else if err != nil {
+		return err
+	}
+
+	// A file moved on top of a known file takes it's place. This is how many
+	// editors save files, so the tags of both files are kept.
+	existing, err := s.p.GetFileForPath(to)
+	if err == nil {
+		return s.merged(f, existing)
+	} else if err != tagger.ErrNoFile {
+		return err
+	}
+
+	err = s.p.UpdateFile(f.WithPath(to), []tagger.Tag{})
+	if err != nil {
+		return err
+	}
+
+	s.logf("Moved %s to %s", from, to)
+	return nil
+}
+
+// merged moves the tags and content hash of a file to the file it replaced
+func (s *syncer) merged(f, replaced tagger.File) error {
+	tx, err := s.p.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	tags, err := tx.GetTags(f)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		err = tx.AddTagValue(replaced, tag)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.RemoveFile(f)
+	if err != nil {
+		return err
+	}
+
+	if h, ok := f.Hash(); ok {
+		err = tx.UpdateFile(replaced.WithHash(h), []tagger.Tag{})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	s.logf("Moved %s to %s, replacing the existing file", f.Path(), replaced.Path())
+	return nil
+}
+
+// dirMoved handles a directory that has been renamed within the tree
+func (s *syncer) dirMoved(from, to string) error {
+	files, err := s.filesBelow(from)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		err = s.p.UpdateFile(f.WithPath(to+f.Path()[len(from):]), []tagger.Tag{})
+		if err != nil {
+			return err
+		}
+	}
+
+	s.logf("Moved %s to %s with %d files", from, to, len(files))
+	return nil
+}
+
+// dirRemoved handles a directory that has been moved out of the tree
+func (s *syncer) dirRemoved(path string) error {
+	files, err := s.filesBelow(path)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		err = s.removed(f.Path())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// filesBelow returns the known files in a directory and it's subdirectories
+func (s *syncer) filesBelow(dir string) ([]tagger.File, error) {
+	files, err := s.p.GetAllFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := dir + string(filepath.Separator)
+	below := make([]tagger.File, 0)
+	for _, f := range files {
+		if strings.HasPrefix(f.Path(), prefix) {
+			below = append(below, f)
+		}
+	}
+
+	return below, nil
+}
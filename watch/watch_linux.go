@@ -0,0 +1,315 @@
+package watch
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/kiljacken/tagger"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// watchMask selects the inotify events needed to follow the tree
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR | syscall.IN_DONT_FOLLOW
+
+// event is a single inotify event
+type event struct {
+	wd     int
+	mask   uint32
+	cookie uint32
+	name   string
+}
+
+// movedFrom is the first half of a rename, whose second half hasn't been
+// read yet
+type movedFrom struct {
+	path   string
+	isDir  bool
+	cookie uint32
+}
+
+// moveTimeout is how long to wait for the second half of a rename, when the
+// first half is the last event of a read. Renames out of the tree never get
+// a second half.
+const moveTimeout = 100 * time.Millisecond
+
+// inotifyWatcher follows changes to a tree through an inotify instance with a
+// watch on every directory of the tree
+type inotifyWatcher struct {
+	*syncer
+	fd int
+	// dirs maps watch descriptors to the paths of their directories
+	dirs map[int]string
+	// pending is a rename waiting for it's second half, or nil
+	pending *movedFrom
+}
+
+// Watch keeps the storage in sync with the directory tree at root until the
+// context is cancelled. Renamed files get their new path, deleted files are
+// tagged or removed, and new files are added according to the scan options.
+// Files already in the tree are not added when the watch starts, so the tree
+// should be scanned first.
+//
+// The storage must not be a transactional view, as some changes are applied
+// in transactions of their own.
+func Watch(ctx context.Context, p tagger.StorageProvider, root string, opts Options) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+
+	// Wrapping the non-blocking descriptor in a file lets reads wait in the
+	// runtime poller, so they can be interrupted with a deadline
+	f := os.NewFile(uintptr(fd), "inotify")
+	defer f.Close()
+
+	w := &inotifyWatcher{
+		syncer: &syncer{p: p, root: filepath.Clean(root), opts: opts},
+		fd:     fd,
+		dirs:   make(map[int]string),
+	}
+
+	// Watch every directory of the tree
+	if err := w.addTree(w.root, false); err != nil {
+		return err
+	}
+
+	// Interrupt the read below when the context is cancelled
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		// Wait only a moment for the second half of a pending rename. The
+		// context is checked after setting the deadline, so a cancellation
+		// can't be overwritten.
+		var deadline time.Time
+		if w.pending != nil {
+			deadline = time.Now().Add(moveTimeout)
+		}
+		f.SetReadDeadline(deadline)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		n, err := f.Read(buf)
+		if ctx.Err() != nil {
+			return nil
+		} else if errors.Is(err, os.ErrDeadlineExceeded) {
+			// The second half never came, so the pending rename moved the
+			// file out of the tree
+			w.handle(nil)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		w.handle(parseEvents(buf[:n]))
+	}
+}
+
+// parseEvents splits the data read from an inotify instance into events
+func parseEvents(buf []byte) []event {
+	events := make([]event, 0)
+	for len(buf) >= syscall.SizeofInotifyEvent {
+		e := event{
+			wd:     int(int32(binary.NativeEndian.Uint32(buf[0:]))),
+			mask:   binary.NativeEndian.Uint32(buf[4:]),
+			cookie: binary.NativeEndian.Uint32(buf[8:]),
+		}
+		n := int(binary.NativeEndian.Uint32(buf[12:]))
+		buf = buf[syscall.SizeofInotifyEvent:]
+
+		// The name is padded with NUL bytes
+		e.name = strings.TrimRight(string(buf[:n]), "\x00")
+		buf = buf[n:]
+
+		events = append(events, e)
+	}
+	return events
+}
+
+// handle applies a batch of events to storage. The two halves of a rename
+// are paired by their cookie. The kernel queues them next to each other, but
+// a read may end between them, so a rename ending a batch is kept pending
+// until the next batch.
+func (w *inotifyWatcher) handle(events []event) {
+	// A pending rename happened before any of the events
+	if m := w.pending; m != nil {
+		w.pending = nil
+		if err := w.movedFrom(m, events); err != nil {
+			w.logf("Error while handling %s: %s", m.path, err)
+		}
+	}
+
+	for i, e := range events {
+		if e.mask&syscall.IN_Q_OVERFLOW != 0 {
+			w.logf("Events were lost, scan the tree to catch up")
+			continue
+		}
+		if e.mask&syscall.IN_IGNORED != 0 {
+			// The watch was removed along with it's directory
+			delete(w.dirs, e.wd)
+			continue
+		}
+
+		dir, ok := w.dirs[e.wd]
+		if !ok {
+			continue
+		}
+		path := filepath.Join(dir, e.name)
+		isDir := e.mask&syscall.IN_ISDIR != 0
+
+		var err error
+		switch {
+		case e.mask&syscall.IN_MOVED_FROM != 0:
+			m := &movedFrom{path: path, isDir: isDir, cookie: e.cookie}
+			if i == len(events)-1 {
+				// The second half may be in the next batch
+				w.pending = m
+				continue
+			}
+			err = w.movedFrom(m, events[i+1:])
+
+		case e.mask&syscall.IN_MOVED_TO != 0:
+			// Moves within the tree have been handled with their first half,
+			// so this was moved into the tree
+			if e.cookie == 0 {
+				continue
+			}
+			if isDir {
+				err = w.addTree(path, true)
+			} else {
+				err = w.written(path)
+			}
+
+		case e.mask&syscall.IN_CREATE != 0 && isDir:
+			// Files may have been created before the watch is in place, so
+			// they are added as well
+			err = w.addTree(path, true)
+
+		case e.mask&syscall.IN_CLOSE_WRITE != 0:
+			err = w.written(path)
+
+		case e.mask&syscall.IN_DELETE != 0 && !isDir:
+			err = w.removed(path)
+		}
+
+		if err != nil {
+			w.logf("Error while handling %s: %s", path, err)
+		}
+	}
+}
+
+// movedFrom handles the first half of a rename, with the events following
+// it. Without a second half, the file was moved out of the tree.
+func (w *inotifyWatcher) movedFrom(m *movedFrom, events []event) error {
+	to, ok := w.moveTarget(events, m.cookie)
+	switch {
+	case ok && m.isDir:
+		err := w.dirMoved(m.path, to)
+		w.renameDirs(m.path, to)
+		return err
+	case ok:
+		return w.moved(m.path, to)
+	case m.isDir:
+		err := w.dirRemoved(m.path)
+		w.removeDirs(m.path)
+		return err
+	default:
+		return w.removed(m.path)
+	}
+}
+
+// moveTarget finds the path a file was moved to among the following events,
+// and marks the event as handled by clearing it's cookie
+func (w *inotifyWatcher) moveTarget(events []event, cookie uint32) (string, bool) {
+	for i := range events {
+		e := &events[i]
+		if e.mask&syscall.IN_MOVED_TO == 0 || e.cookie != cookie {
+			continue
+		}
+
+		dir, ok := w.dirs[e.wd]
+		if !ok {
+			return "", false
+		}
+		e.cookie = 0
+		return filepath.Join(dir, e.name), true
+	}
+	return "", false
+}
+
+// addTree watches a directory and it's subdirectories, skipping the
+// directories excluded by the scan options. If scan is set, the files found
+// are handled as new files.
+func (w *inotifyWatcher) addTree(root string, scan bool) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil && path == root {
+			return err
+		} else if err != nil {
+			w.logf("Skipping %s: %s", path, err)
+			return nil
+		}
+
+		if !info.IsDir() {
+			if scan && info.Mode().IsRegular() {
+				if err := w.written(path); err != nil {
+					w.logf("Error while handling %s: %s", path, err)
+				}
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(w.root, path)
+		if err != nil {
+			return err
+		}
+		if rel != "." && w.opts.Scan.SkipsDir(rel) {
+			return filepath.SkipDir
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, path, watchMask)
+		if err != nil {
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+		w.dirs[wd] = path
+		return nil
+	})
+}
+
+// renameDirs updates the paths of the watched directories in a renamed
+// directory. The watches themselves follow the directories.
+func (w *inotifyWatcher) renameDirs(from, to string) {
+	prefix := from + string(filepath.Separator)
+	for wd, dir := range w.dirs {
+		if dir == from {
+			w.dirs[wd] = to
+		} else if strings.HasPrefix(dir, prefix) {
+			w.dirs[wd] = to + dir[len(from):]
+		}
+	}
+}
+
+// removeDirs stops watching a directory moved out of the tree, and it's
+// subdirectories
+func (w *inotifyWatcher) removeDirs(path string) {
+	prefix := path + string(filepath.Separator)
+	for wd, dir := range w.dirs {
+		if dir == path || strings.HasPrefix(dir, prefix) {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+		}
+	}
+}
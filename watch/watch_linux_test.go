@@ -0,0 +1,225 @@
+package watch
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"context"
+	"encoding/binary"
+	"github.com/kiljacken/tagger"
+	"github.com/kiljacken/tagger/storage"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// rawEvent encodes an event the way the kernel does, with the name padded
+// with NUL bytes
+func rawEvent(wd int, mask, cookie uint32, name string, padding int) []byte {
+	buf := make([]byte, syscall.SizeofInotifyEvent)
+	binary.NativeEndian.PutUint32(buf[0:], uint32(int32(wd)))
+	binary.NativeEndian.PutUint32(buf[4:], mask)
+	binary.NativeEndian.PutUint32(buf[8:], cookie)
+	if name != "" {
+		binary.NativeEndian.PutUint32(buf[12:], uint32(len(name)+padding))
+		buf = append(buf, name...)
+		buf = append(buf, make([]byte, padding)...)
+	}
+	return buf
+}
+
+func TestParseEvents(t *testing.T) {
+	var buf []byte
+	buf = append(buf, rawEvent(1, syscall.IN_MOVED_FROM, 7, "a.txt", 3)...)
+	buf = append(buf, rawEvent(2, syscall.IN_MOVED_TO, 7, "b.txt", 11)...)
+	buf = append(buf, rawEvent(-1, syscall.IN_Q_OVERFLOW, 0, "", 0)...)
+
+	want := []event{
+		{wd: 1, mask: syscall.IN_MOVED_FROM, cookie: 7, name: "a.txt"},
+		{wd: 2, mask: syscall.IN_MOVED_TO, cookie: 7, name: "b.txt"},
+		{wd: -1, mask: syscall.IN_Q_OVERFLOW},
+	}
+	got := parseEvents(buf)
+	if len(got) != len(want) {
+		t.Fatalf("parseEvents returned %d events, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Event %d is %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+// newTestWatcher returns a watcher of /w, with a file stored for each path
+func newTestWatcher(t *testing.T, paths ...string) *inotifyWatcher {
+	p := storage.NewMemoryStorage()
+	for _, path := range paths {
+		if err := p.UpdateFile(tagger.NewFile(uuid.NewUUID(), path), []tagger.Tag{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &inotifyWatcher{
+		syncer: &syncer{p: p, root: "/w", opts: Options{}},
+		fd:     -1,
+		dirs:   map[int]string{1: "/w", 2: "/w/sub"},
+	}
+}
+
+// checkFile checks whether a file is stored with the path, and whether it's
+// tagged as missing
+func checkFile(t *testing.T, w *inotifyWatcher, path string, stored, missing bool) {
+	t.Helper()
+
+	f, err := w.p.GetFileForPath(path)
+	if err == tagger.ErrNoFile {
+		if stored {
+			t.Errorf("%s isn't stored", path)
+		}
+		return
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if !stored {
+		t.Errorf("%s is stored", path)
+		return
+	}
+
+	_, err = w.p.GetTagValues(f, MissingTag)
+	if (err == nil) != missing {
+		t.Errorf("%s is tagged as missing: %t, want %t", path, err == nil, missing)
+	}
+}
+
+func TestHandleRename(t *testing.T) {
+	w := newTestWatcher(t, "/w/a")
+	w.handle([]event{
+		{wd: 1, mask: syscall.IN_MOVED_FROM, cookie: 1, name: "a"},
+		{wd: 2, mask: syscall.IN_MOVED_TO, cookie: 1, name: "b"},
+	})
+
+	checkFile(t, w, "/w/a", false, false)
+	checkFile(t, w, "/w/sub/b", true, false)
+}
+
+func TestHandleSplitRename(t *testing.T) {
+	w := newTestWatcher(t, "/w/a")
+
+	// The first half ends a batch, so it waits for the next one
+	w.handle([]event{{wd: 1, mask: syscall.IN_MOVED_FROM, cookie: 2, name: "a"}})
+	if w.pending == nil {
+		t.Fatal("Rename ending a batch isn't pending")
+	}
+	checkFile(t, w, "/w/a", true, false)
+
+	w.handle([]event{{wd: 1, mask: syscall.IN_MOVED_TO, cookie: 2, name: "b"}})
+	if w.pending != nil {
+		t.Error("Rename is still pending")
+	}
+	checkFile(t, w, "/w/a", false, false)
+	checkFile(t, w, "/w/b", true, false)
+}
+
+func TestHandleMoveOut(t *testing.T) {
+	// Without a second half before the timeout, the file is gone
+	w := newTestWatcher(t, "/w/a")
+	w.handle([]event{{wd: 1, mask: syscall.IN_MOVED_FROM, cookie: 3, name: "a"}})
+	w.handle(nil)
+	checkFile(t, w, "/w/a", true, true)
+
+	// The pending rename is completed before the events of the next batch
+	w = newTestWatcher(t, "/w/a", "/w/b")
+	w.handle([]event{{wd: 1, mask: syscall.IN_MOVED_FROM, cookie: 4, name: "a"}})
+	w.handle([]event{{wd: 1, mask: syscall.IN_DELETE, name: "b"}})
+	checkFile(t, w, "/w/a", true, true)
+	checkFile(t, w, "/w/b", true, true)
+	if w.pending != nil {
+		t.Error("Rename is still pending")
+	}
+}
+
+func TestHandleMoveOver(t *testing.T) {
+	// A file moved on top of another keeps the tags of both
+	w := newTestWatcher(t, "/w/a", "/w/b")
+	a, _ := w.p.GetFileForPath("/w/a")
+	if err := w.p.UpdateTag(a, tagger.NewNamedTag("keep")); err != nil {
+		t.Fatal(err)
+	}
+
+	w.handle([]event{{wd: 1, mask: syscall.IN_MOVED_FROM, cookie: 5, name: "a"}})
+	w.handle([]event{{wd: 1, mask: syscall.IN_MOVED_TO, cookie: 5, name: "b"}})
+
+	checkFile(t, w, "/w/a", false, false)
+	b, err := w.p.GetFileForPath("/w/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.p.GetTagValues(b, "keep"); err != nil {
+		t.Errorf("Tags of the moved file weren't kept: %s", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	a, b := filepath.Join(root, "a"), filepath.Join(root, "b")
+	if err := os.WriteFile(a, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := storage.NewMemoryStorage()
+	if err := p.UpdateFile(tagger.NewFile(uuid.NewUUID(), a), []tagger.Tag{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- Watch(ctx, p, root, Options{}) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Watch: %s", err)
+		}
+	}()
+
+	// wait polls the storage until the condition holds
+	wait := func(what string, cond func() bool) {
+		t.Helper()
+		for start := time.Now(); !cond(); time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("Timed out waiting until %s", what)
+			}
+		}
+	}
+	stored := func(path string) bool {
+		_, err := p.GetFileForPath(path)
+		return err == nil
+	}
+
+	// The watch is in place once a new file shows up, which is written
+	// until it does
+	probe := filepath.Join(root, "probe")
+	wait("a new file is added", func() bool {
+		if err := os.WriteFile(probe, []byte("probe"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return stored(probe)
+	})
+
+	if err := os.Rename(a, b); err != nil {
+		t.Fatal(err)
+	}
+	wait("the file is renamed", func() bool { return stored(b) })
+
+	// A file moved out of the tree is missing once the rename times out
+	if err := os.Rename(b, filepath.Join(outside, "b")); err != nil {
+		t.Fatal(err)
+	}
+	wait("the file is missing", func() bool {
+		f, err := p.GetFileForPath(b)
+		if err != nil {
+			return false
+		}
+		_, err = p.GetTagValues(f, MissingTag)
+		return err == nil
+	})
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package watch
+
+import (
+	"context"
+	"github.com/kiljacken/tagger"
+)
+
+// Watch would keep the storage in sync with the directory tree at root, but
+// is only implemented on Linux
+func Watch(ctx context.Context, p tagger.StorageProvider, root string, opts Options) error {
+	return ErrUnsupported
+}